@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/hnakamur/pipesecret/internal/audit"
+)
+
+type AuditCmd struct {
+	File    string        `type:"path" default:"${default_audit_log}" env:"PIPESECRET_AUDIT_LOG" help:"path to the audit log"`
+	Rotated bool          `help:"read rotated audit logs too"`
+	Host    string        `help:"show records of this remote host only"`
+	Item    string        `help:"show records of this item only"`
+	Result  string        `enum:",allowed,denied,error" default:"" help:"show records of this result only (allowed, denied, error)"`
+	Since   time.Duration `help:"show records in this duration until now only. example: --since=24h"`
+	Format  string        `enum:"text,json" default:"text" help:"output format (text, json)"`
+}
+
+func (c *AuditCmd) Run(ctx context.Context) error {
+	filter := audit.Filter{
+		Host:   c.Host,
+		Item:   c.Item,
+		Result: c.Result,
+	}
+	if c.Since > 0 {
+		filter.Since = time.Now().Add(-c.Since)
+	}
+	enc := json.NewEncoder(os.Stdout)
+	return audit.Read(c.File, c.Rotated, filter, func(rec *audit.Record) error {
+		if c.Format == "json" {
+			return enc.Encode(rec)
+		}
+		_, err := fmt.Println(formatAuditRecord(rec))
+		return err
+	})
+}
+
+func formatAuditRecord(rec *audit.Record) string {
+	peer := "peer=unknown"
+	if rec.Peer != nil {
+		peer = fmt.Sprintf("uid=%d pid=%d exe=%s", rec.Peer.UID, rec.Peer.PID, rec.Peer.Exe)
+	}
+	result := rec.Result
+	if rec.Reason != "" {
+		result += "(" + rec.Reason + ")"
+	}
+	if rec.Action != "" {
+		result = rec.Action + ":" + result
+	}
+	return fmt.Sprintf("%s %s %s item=%s query=%.12s %s %.1fms",
+		rec.Time.Local().Format(time.RFC3339), rec.Host, result, rec.Item, rec.QuerySHA256, peer, rec.LatencyMS)
+}
+
+// defaultAuditLogPath returns the default path of the audit log under
+// $XDG_STATE_HOME.
+func defaultAuditLogPath() string {
+	stateDir := os.Getenv("XDG_STATE_HOME")
+	if stateDir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		stateDir = filepath.Join(home, ".local", "state")
+	}
+	return filepath.Join(stateDir, "pipesecret", "audit.jsonl")
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/hnakamur/pipesecret/internal"
+	"golang.org/x/term"
+	"golang.org/x/xerrors"
+)
+
+func (c *ServeCmd) newItemGetter(ctx context.Context) (internal.ItemGetter, error) {
+	defaultBackend := c.Backend
+	if c.BackendExec != "" {
+		defaultBackend = "exec"
+	}
+	if len(c.Route) == 0 && len(c.Fallback) == 0 {
+		return c.newBackend(ctx, defaultBackend)
+	}
+
+	// A backend used in multiple routes or the fallback chain is created
+	// only once, since some backends read a password from the terminal.
+	backends := make(map[string]internal.ItemGetter)
+	getBackend := func(name string) (internal.ItemGetter, error) {
+		if getter, ok := backends[name]; ok {
+			return getter, nil
+		}
+		getter, err := c.newBackend(ctx, name)
+		if err != nil {
+			return nil, xerrors.Errorf("failed to set up %s backend: %s", name, err)
+		}
+		backends[name] = getter
+		return getter, nil
+	}
+
+	var defaultGetter internal.ItemGetter
+	if len(c.Fallback) > 0 {
+		var getters []internal.ItemGetter
+		for _, name := range c.Fallback {
+			getter, err := getBackend(name)
+			if err != nil {
+				return nil, err
+			}
+			getters = append(getters, getter)
+		}
+		defaultGetter = internal.NewFallbackItemGetter(getters, c.FallbackSkipUnavailable)
+	} else {
+		var err error
+		defaultGetter, err = getBackend(defaultBackend)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(c.Route) == 0 {
+		return defaultGetter, nil
+	}
+
+	routes := make(map[string]internal.ItemGetter)
+	for _, scheme := range slices.Sorted(maps.Keys(c.Route)) {
+		getter, err := getBackend(c.Route[scheme])
+		if err != nil {
+			return nil, err
+		}
+		routes[scheme] = getter
+	}
+	return internal.NewRouterItemGetter(routes, defaultGetter), nil
+}
+
+func (c *ServeCmd) newBackend(ctx context.Context, backend string) (internal.ItemGetter, error) {
+	switch backend {
+	case "1password":
+		var signIn *internal.OnePasswordSignIn
+		if c.OpSignin {
+			signIn = &internal.OnePasswordSignIn{
+				Command: strings.Fields(c.OpSigninCommand),
+				Timeout: c.OpSigninTimeout,
+			}
+		}
+		return internal.NewOnePasswordItemGetter(c.Op, signIn)
+	case "1password-connect":
+		return internal.NewOnePasswordConnectItemGetter(c.ConnectHost, c.ConnectToken, c.ConnectVault, nil)
+	case "bitwarden":
+		return internal.NewBitwardenItemGetter(c.BW, c.BWSession)
+	case "pass":
+		return internal.NewPasswordStoreItemGetter(c.PassDir, c.PassDecryptCommand)
+	case "vault":
+		return internal.NewVaultItemGetter(c.VaultAddr, c.VaultToken, c.VaultNamespace, c.VaultMount, c.VaultKVVersion, nil)
+	case "keepass":
+		if c.KeePassDB == "" {
+			return nil, errors.New("--keepass-db must be specified for keepass backend")
+		}
+		if !c.KeePassPassword && c.KeePassKeyfile == "" {
+			return nil, errors.New("--keepass-keyfile must be specified with --no-keepass-password")
+		}
+		var password string
+		if c.KeePassPassword {
+			var err error
+			password, err = readPassword(fmt.Sprintf("Master password for %s: ", c.KeePassDB))
+			if err != nil {
+				return nil, err
+			}
+		}
+		return internal.NewKeePassItemGetter(c.KeePassDB, password, c.KeePassKeyfile)
+	case "sops":
+		if c.SOPSFile == "" {
+			return nil, errors.New("--sops-file must be specified for sops backend")
+		}
+		return internal.NewEncryptedFileItemGetter(c.SOPSFile, c.AgeIdentity, c.SOPS)
+	case "fixture":
+		if c.FixtureFile == "" {
+			return nil, errors.New("--fixture-file must be specified for fixture backend")
+		}
+		return internal.NewFixtureItemGetter(c.FixtureFile)
+	case "exec":
+		if c.BackendExec == "" {
+			return nil, errors.New("--backend-exec must be specified for exec backend")
+		}
+		return internal.NewExecPluginItemGetter(ctx, c.BackendExec)
+	default:
+		return nil, fmt.Errorf("unsupported backend: %s", backend)
+	}
+}
+
+// readPassword reads a password from the terminal without echo.
+func readPassword(prompt string) (string, error) {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return "", xerrors.Errorf("failed to open terminal: %s", err)
+	}
+	defer tty.Close()
+
+	if _, err := fmt.Fprint(tty, prompt); err != nil {
+		return "", err
+	}
+	password, err := term.ReadPassword(int(tty.Fd()))
+	fmt.Fprintln(tty)
+	if err != nil {
+		return "", xerrors.Errorf("failed to read password: %s", err)
+	}
+	return string(password), nil
+}
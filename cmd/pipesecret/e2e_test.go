@@ -0,0 +1,472 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hnakamur/pipesecret/internal"
+	"github.com/hnakamur/pipesecret/internal/approval"
+	"github.com/hnakamur/pipesecret/internal/audit"
+	"github.com/hnakamur/pipesecret/internal/policy"
+	"github.com/hnakamur/pipesecret/internal/rpc"
+)
+
+var exampleFixtures = map[string]json.RawMessage{
+	"test1": json.RawMessage(`{"title":"test1","fields":[{"id":"username","value":"username1"},{"id":"password","value":"my_password1"}]}`),
+}
+
+func TestEndToEnd(t *testing.T) {
+	k := startTestKit(t, rpc.LocalServerConfig{
+		Getter: internal.NewFixtureItemGetterFromMap(exampleFixtures),
+	})
+
+	outPath := filepath.Join(t.TempDir(), "out.txt")
+	err := k.run(t, &RunCmd{
+		Item:    []string{"test1"},
+		Query:   defaultQuery,
+		Env:     map[string]string{"SECRET": "{{.username}}:{{.password}}"},
+		Command: "sh",
+		Args:    []string{"-c", `printf %s "$SECRET" > "$0"`, outPath},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(outPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "username1:my_password1"; string(got) != want {
+		t.Errorf("result mismatch, got=%s, want=%s", got, want)
+	}
+
+	err = k.run(t, &RunCmd{
+		Item:    []string{"no_such_item"},
+		Query:   defaultQuery,
+		Env:     map[string]string{"SECRET": "{{.password}}"},
+		Command: "true",
+	})
+	if err == nil {
+		t.Error("should fail for an item which does not exist")
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	k := startTestKit(t, rpc.LocalServerConfig{
+		Getter:     internal.NewFixtureItemGetterFromMap(exampleFixtures),
+		Reconnect:  true,
+		MinBackoff: 10 * time.Millisecond,
+		MaxBackoff: 100 * time.Millisecond,
+	})
+
+	for i := range 2 {
+		if i > 0 {
+			oldPID := k.KillRemote(t)
+			k.WaitListening(t, oldPID)
+		}
+		err := k.run(t, &RunCmd{
+			Item:    []string{"test1"},
+			Query:   defaultQuery,
+			Env:     map[string]string{"SECRET": "{{.password}}"},
+			Command: "sh",
+			Args:    []string{"-c", `test "$SECRET" = my_password1`},
+		})
+		if err != nil {
+			t.Fatalf("i=%d, err=%v", i, err)
+		}
+	}
+}
+
+func TestMultipleHosts(t *testing.T) {
+	k := startTestKit(t, rpc.LocalServerConfig{
+		Hosts:  []rpc.HostConfig{{Host: "dev1"}, {Host: "dev2"}},
+		Getter: internal.NewFixtureItemGetterFromMap(exampleFixtures),
+	})
+
+	for _, host := range []string{"dev1", "dev2"} {
+		err := k.run(t, &RunCmd{
+			Item:    []string{"test1"},
+			Query:   defaultQuery,
+			Env:     map[string]string{"SECRET": "{{.password}}"},
+			Socket:  k.SocketPaths[host],
+			Command: "sh",
+			Args:    []string{"-c", `test "$SECRET" = my_password1`},
+		})
+		if err != nil {
+			t.Fatalf("host=%s, err=%v", host, err)
+		}
+	}
+}
+
+func TestApproval(t *testing.T) {
+	// The approval command allows only test1.
+	script := filepath.Join(t.TempDir(), "approve.sh")
+	if err := os.WriteFile(script, []byte("#!/bin/sh\ntest \"$PIPESECRET_ITEM\" = test1 && echo allow\n"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	prompter, err := approval.NewCommandPrompter(script)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fixtures := maps.Clone(exampleFixtures)
+	fixtures["test2"] = fixtures["test1"]
+	k := startTestKit(t, rpc.LocalServerConfig{
+		Getter:   internal.NewFixtureItemGetterFromMap(fixtures),
+		Approver: approval.NewApprover(prompter, 10*time.Second),
+	})
+
+	for _, item := range []string{"test1", "test2"} {
+		err := k.run(t, &RunCmd{
+			Item:    []string{item},
+			Query:   defaultQuery,
+			Env:     map[string]string{"SECRET": "{{.password}}"},
+			Command: "true",
+		})
+		if allowed := err == nil; allowed != (item == "test1") {
+			t.Errorf("item=%s, err=%v", item, err)
+		}
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	auditLogger, err := audit.NewLogger(path, 1<<20, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer auditLogger.Close()
+	k := startTestKit(t, rpc.LocalServerConfig{
+		Getter: internal.NewFixtureItemGetterFromMap(exampleFixtures),
+		Audit:  auditLogger,
+	})
+
+	for _, item := range []string{"test1", "no_such_item"} {
+		k.run(t, &RunCmd{
+			Item:    []string{item},
+			Query:   defaultQuery,
+			Env:     map[string]string{"SECRET": "{{.password}}"},
+			Command: "true",
+		})
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "my_password1") {
+		t.Errorf("audit log must not contain secrets: %s", data)
+	}
+	var got []string
+	err = audit.Read(path, false, audit.Filter{Host: "fakehost"}, func(rec *audit.Record) error {
+		if rec.Peer == nil || rec.Peer.PID == 0 {
+			t.Errorf("peer is not recorded: %+v", rec)
+		}
+		got = append(got, rec.Item+":"+rec.Result+":"+rec.Reason)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"test1:allowed:", "no_such_item:error:item_not_found"}
+	if !slices.Equal(got, want) {
+		t.Errorf("records mismatch, got=%v, want=%v", got, want)
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	pol, err := policy.Parse([]byte(`
+default: allow
+deny_queries: ["."]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	k := startTestKit(t, rpc.LocalServerConfig{
+		Getter: internal.NewFixtureItemGetterFromMap(exampleFixtures),
+		Policy: pol,
+	})
+
+	for _, query := range []string{defaultQuery, ".", ".|.", "{fields}"} {
+		err := k.run(t, &RunCmd{
+			Item:    []string{"test1"},
+			Query:   query,
+			Env:     map[string]string{"SECRET": "{{.password}}"},
+			Command: "true",
+		})
+		if allowed := err == nil; allowed != (query == defaultQuery) {
+			t.Errorf("query=%s, err=%v", query, err)
+		}
+	}
+}
+
+func TestItemsQueryPolicy(t *testing.T) {
+	pol, err := policy.Parse([]byte(`
+default: allow
+deny_queries: ["."]
+rules:
+  - hosts: ["fakehost"]
+    items_queries: ['{title: $items.test1.title}', '$items']
+    effect: allow
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	k := startTestKit(t, rpc.LocalServerConfig{
+		Getter: internal.NewFixtureItemGetterFromMap(exampleFixtures),
+		Policy: pol,
+	})
+
+	testCases := []struct {
+		itemsQuery string
+		allow      bool
+	}{
+		{itemsQuery: `{title: $items.test1.title}`, allow: true},
+		// Allowed by items_queries, but the result is the whole item.
+		{itemsQuery: `$items`, allow: false},
+		// Not in items_queries. default: allow does not apply.
+		{itemsQuery: `$items.test1`, allow: false},
+	}
+	for _, tc := range testCases {
+		err := k.run(t, &RunCmd{
+			Item:       []string{"test1"},
+			ItemsQuery: tc.itemsQuery,
+			Env:        map[string]string{"SECRET": "{{.}}"},
+			Command:    "true",
+		})
+		if allowed := err == nil; allowed != tc.allow {
+			t.Errorf("itemsQuery=%s, err=%v", tc.itemsQuery, err)
+		}
+		var rpcErr *rpc.Error
+		if err != nil && (!errors.As(err, &rpcErr) || rpcErr.Code != rpc.CodePolicyDenied) {
+			t.Errorf("error mismatch, itemsQuery=%s, got=%v", tc.itemsQuery, err)
+		}
+	}
+}
+
+func TestRunErrors(t *testing.T) {
+	pol, err := policy.Parse([]byte(`
+default: allow
+rules:
+  - items: ["secret/*"]
+    effect: deny
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	k := startTestKit(t, rpc.LocalServerConfig{
+		Getter: internal.NewFixtureItemGetterFromMap(exampleFixtures),
+		Policy: pol,
+	})
+
+	testCases := []struct {
+		item         string
+		query        string
+		wantCode     int64
+		wantReason   string
+		wantExitCode int
+	}{
+		{item: "no_such_item", query: defaultQuery, wantCode: rpc.CodeItemNotFound, wantReason: "item_not_found", wantExitCode: 10},
+		{item: "test1", query: "{", wantCode: rpc.CodeQueryParse, wantReason: "query_parse", wantExitCode: 12},
+		{item: "test1", query: `error("boom")`, wantCode: rpc.CodeQueryRuntime, wantReason: "query_runtime", wantExitCode: 13},
+		{item: "secret/db", query: defaultQuery, wantCode: rpc.CodePolicyDenied, wantReason: "policy_denied", wantExitCode: 15},
+	}
+	for _, tc := range testCases {
+		err := k.run(t, &RunCmd{
+			Item:    []string{tc.item},
+			Query:   tc.query,
+			Env:     map[string]string{"SECRET": "{{.password}}"},
+			Command: "true",
+		})
+		var rpcErr *rpc.Error
+		if !errors.As(err, &rpcErr) {
+			t.Errorf("item=%s, query=%s, error type mismatch, got=%T (%v)", tc.item, tc.query, err, err)
+			continue
+		}
+		want := rpc.ErrorData{Reason: tc.wantReason, Host: "fakehost", Item: tc.item}
+		if rpcErr.Code != tc.wantCode || rpcErr.Data != want {
+			t.Errorf("item=%s, query=%s, got=(%d, %+v), want=(%d, %+v)", tc.item, tc.query, rpcErr.Code, rpcErr.Data, tc.wantCode, want)
+		}
+		if got := runExitCode(rpcErr); got != tc.wantExitCode {
+			t.Errorf("item=%s, query=%s, exit code mismatch, got=%d, want=%d", tc.item, tc.query, got, tc.wantExitCode)
+		}
+	}
+}
+
+func TestMultipleItems(t *testing.T) {
+	fixtures := maps.Clone(exampleFixtures)
+	fixtures["test2"] = json.RawMessage(`{"title":"test2","fields":[{"id":"username","value":"username2"},{"id":"password","value":"my_password2"}]}`)
+	auditPath := filepath.Join(t.TempDir(), "audit.jsonl")
+	auditLogger, err := audit.NewLogger(auditPath, 1<<20, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer auditLogger.Close()
+	k := startTestKit(t, rpc.LocalServerConfig{
+		Getter: internal.NewFixtureItemGetterFromMap(fixtures),
+		Audit:  auditLogger,
+	})
+
+	err = k.run(t, &RunCmd{
+		Item:    []string{"test1=db", "test2=api"},
+		Query:   defaultQuery,
+		Env:     map[string]string{"SECRET": "{{.db.password}}:{{.api.password}}"},
+		Command: "sh",
+		Args:    []string{"-c", `test "$SECRET" = my_password1:my_password2`},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = k.run(t, &RunCmd{
+		Item:       []string{"test1=db", "test2=api"},
+		ItemsQuery: `{dsn: "\($items.db.fields[] | select(.id == "username").value)@\($items.api.title)"}`,
+		Env:        map[string]string{"DSN": "{{.dsn}}"},
+		Command:    "sh",
+		Args:       []string{"-c", `test "$DSN" = username1@test2`},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = k.run(t, &RunCmd{
+		Item:    []string{"test1=db", "no_such_item=api"},
+		Query:   defaultQuery,
+		Env:     map[string]string{"SECRET": "{{.db.password}}"},
+		Command: "true",
+	})
+	var rpcErr *rpc.Error
+	if !errors.As(err, &rpcErr) || rpcErr.Code != rpc.CodeItemNotFound || rpcErr.Data.Item != "no_such_item" {
+		t.Errorf("error mismatch, got=%v", err)
+	}
+
+	var results []string
+	err = audit.Read(auditPath, false, audit.Filter{}, func(rec *audit.Record) error {
+		results = append(results, rec.Item+":"+rec.Result)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(results)
+	want := []string{
+		"no_such_item:error", "test1:allowed", "test1:allowed", "test1:error", "test2:allowed", "test2:allowed",
+	}
+	if !slices.Equal(results, want) {
+		t.Errorf("audit log mismatch, got=%v, want=%v", results, want)
+	}
+}
+
+func TestItemNameWithEquals(t *testing.T) {
+	fixtures := maps.Clone(exampleFixtures)
+	fixtures["team=dev/db"] = fixtures["test1"]
+	k := startTestKit(t, rpc.LocalServerConfig{
+		Getter: internal.NewFixtureItemGetterFromMap(fixtures),
+	})
+
+	// A single --item is the whole name.
+	err := k.run(t, &RunCmd{
+		Item:    []string{"team=dev/db"},
+		Query:   defaultQuery,
+		Env:     map[string]string{"SECRET": "{{.password}}"},
+		Command: "sh",
+		Args:    []string{"-c", `test "$SECRET" = my_password1`},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// With multiple --item, the last "=" separates the alias.
+	err = k.run(t, &RunCmd{
+		Item:    []string{"team=dev/db=db", "test1=api"},
+		Query:   defaultQuery,
+		Env:     map[string]string{"SECRET": "{{.db.password}}:{{.api.password}}"},
+		Command: "sh",
+		Args:    []string{"-c", `test "$SECRET" = my_password1:my_password1`},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// countingItemGetter counts requests for items to getter.
+type countingItemGetter struct {
+	getter internal.ItemGetter
+	calls  atomic.Int64
+}
+
+func (g *countingItemGetter) GetItem(ctx context.Context, itemName string) (string, error) {
+	g.calls.Add(1)
+	return g.getter.GetItem(ctx, itemName)
+}
+
+func TestItemCache(t *testing.T) {
+	backend := &countingItemGetter{getter: internal.NewFixtureItemGetterFromMap(exampleFixtures)}
+	cache, err := internal.NewItemCache(backend, internal.ItemCacheConfig{TTL: time.Hour, MaxSize: 1 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	auditPath := filepath.Join(t.TempDir(), "audit.jsonl")
+	auditLogger, err := audit.NewLogger(auditPath, 1<<20, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer auditLogger.Close()
+	k := startTestKit(t, rpc.LocalServerConfig{
+		Getter: cache,
+		Cache:  cache,
+		Audit:  auditLogger,
+	})
+
+	run := func() {
+		t.Helper()
+		err := k.run(t, &RunCmd{
+			Item:    []string{"test1"},
+			Query:   defaultQuery,
+			Env:     map[string]string{"SECRET": "{{.password}}"},
+			Command: "sh",
+			Args:    []string{"-c", `test "$SECRET" = my_password1`},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	run()
+	run()
+	if got := backend.calls.Load(); got != 1 {
+		t.Errorf("item should be cached, calls=%d", got)
+	}
+
+	n, err := rpc.Invalidate(context.Background(), k.SocketPath, 5*time.Second, []string{"test1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("invalidated count mismatch, got=%d, want=1", n)
+	}
+	run()
+	if got := backend.calls.Load(); got != 2 {
+		t.Errorf("item should be got after invalidated, calls=%d", got)
+	}
+
+	var invalidated []string
+	err = audit.Read(auditPath, false, audit.Filter{}, func(rec *audit.Record) error {
+		if rec.Action == audit.ActionInvalidate {
+			invalidated = append(invalidated, rec.Host+":"+rec.Item)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"fakehost:test1"}; !slices.Equal(invalidated, want) {
+		t.Errorf("audit log of invalidate mismatch, got=%v, want=%v", invalidated, want)
+	}
+}
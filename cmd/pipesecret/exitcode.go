@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/hnakamur/pipesecret/internal/rpc"
+	"github.com/hnakamur/pipesecret/internal/unixsocketrpc"
+)
+
+// runExitCodes maps error codes of getQueryItem to exit statuses of the run
+// subcommand. Other errors exit with the status 1.
+var runExitCodes = map[int64]int{
+	rpc.CodeItemNotFound:             10,
+	rpc.CodeAmbiguousItem:            11,
+	rpc.CodeQueryParse:               12,
+	rpc.CodeQueryRuntime:             13,
+	rpc.CodeQueryRejected:            14,
+	rpc.CodePolicyDenied:             15,
+	rpc.CodeApprovalDenied:           16,
+	rpc.CodeApprovalTimeout:          17,
+	rpc.CodeBackendNotSignedIn:       18,
+	rpc.CodeBackendUnavailable:       19,
+	unixsocketrpc.CodePeerNotAllowed: 20,
+}
+
+func (c *RunCmd) Help() string {
+	return `Exit status:
+
+	10  the item is not found
+	11  more than one item matches the item name
+	12  the query cannot be parsed
+	13  the query fails for the item
+	14  the query exceeds the limits of serve
+	15  the request is denied by the policy of serve
+	16  the request is denied on the local machine
+	17  the request is not approved in time on the local machine
+	18  the password manager on the local machine is not signed in or locked
+	19  the password manager on the local machine is unavailable
+	20  this process is not allowed to use remote-serve
+	1   other errors`
+}
+
+// runExitCode returns the exit status of the run subcommand for err.
+func runExitCode(err *rpc.Error) int {
+	if code, ok := runExitCodes[err.Code]; ok {
+		return code
+	}
+	return 1
+}
+
+// runErrorMessage returns the message for err which tells the user what to
+// do.
+func runErrorMessage(err *rpc.Error) string {
+	item := err.Data.Item
+	switch err.Code {
+	case rpc.CodeItemNotFound:
+		return fmt.Sprintf("item %q is not found in the password manager on the local machine; check the item name (%s)", item, err.Message)
+	case rpc.CodeAmbiguousItem:
+		return fmt.Sprintf("more than one item matches %q on the local machine; specify the item by ID or a unique name (%s)", item, err.Message)
+	case rpc.CodeQueryParse:
+		return fmt.Sprintf("failed to parse the query; check --query (%s)", err.Message)
+	case rpc.CodeQueryRuntime:
+		return fmt.Sprintf("the query failed for item %q; check --query and fields of the item (%s)", item, err.Message)
+	case rpc.CodeQueryRejected:
+		return fmt.Sprintf("the query for item %q exceeded the limits of serve; simplify --query (%s)", item, err.Message)
+	case rpc.CodePolicyDenied:
+		return fmt.Sprintf("getting item %q from host %q is denied by the policy of serve; ask the user of the local machine to allow it (%s)", item, err.Data.Host, err.Message)
+	case rpc.CodeApprovalDenied:
+		return fmt.Sprintf("getting item %q was denied on the local machine (%s)", item, err.Message)
+	case rpc.CodeApprovalTimeout:
+		return fmt.Sprintf("getting item %q was not approved in time on the local machine; answer the prompt of serve and retry (%s)", item, err.Message)
+	case rpc.CodeBackendNotSignedIn:
+		return fmt.Sprintf("the password manager on the local machine is not signed in or locked; sign in or unlock it and retry (%s)", err.Message)
+	case rpc.CodeBackendUnavailable:
+		return fmt.Sprintf("the password manager on the local machine is unavailable; check serve and retry (%s)", err.Message)
+	case unixsocketrpc.CodePeerNotAllowed:
+		return "this process is not allowed to use remote-serve; ask to add its user, group or executable with --allow-uid, --allow-gid or --allow-exe of remote-serve"
+	default:
+		return err.Message
+	}
+}
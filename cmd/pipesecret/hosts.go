@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/hnakamur/pipesecret/internal/rpc"
+)
+
+// hostsFileEntry is an entry in the file specified with --hosts-file.
+type hostsFileEntry struct {
+	Name    string `json:"name"`
+	Host    string `json:"host"`
+	SSH     string `json:"ssh"`
+	Command string `json:"command"`
+}
+
+// hostConfigs returns hosts specified with --host and --hosts-file.
+func (c *ServeCmd) hostConfigs() ([]rpc.HostConfig, error) {
+	var entries []hostsFileEntry
+	for _, host := range c.Host {
+		entries = append(entries, hostsFileEntry{Host: host})
+	}
+	if c.HostsFile != "" {
+		data, err := os.ReadFile(c.HostsFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read hosts file, err=%s", err)
+		}
+		var fileEntries []hostsFileEntry
+		if err := json.Unmarshal(data, &fileEntries); err != nil {
+			return nil, fmt.Errorf("failed to parse hosts file, err=%s", err)
+		}
+		entries = append(entries, fileEntries...)
+	}
+	if len(entries) == 0 {
+		return nil, errors.New("specify at least one host with --host or --hosts-file")
+	}
+
+	hosts := make([]rpc.HostConfig, 0, len(entries))
+	for _, e := range entries {
+		if e.Host == "" {
+			return nil, errors.New("host must not be empty in hosts file")
+		}
+		host := rpc.HostConfig{
+			Name:          e.Name,
+			SSHPath:       e.SSH,
+			Host:          e.Host,
+			RemoteCommand: e.Command,
+		}
+		if host.SSHPath == "" {
+			host.SSHPath = c.SSH
+		}
+		if host.RemoteCommand == "" {
+			host.RemoteCommand = c.Command
+		}
+		if host.RemoteCommand == "" {
+			return nil, fmt.Errorf("specify --command or command in hosts file for host %s", e.Host)
+		}
+		hosts = append(hosts, host)
+	}
+	return hosts, nil
+}
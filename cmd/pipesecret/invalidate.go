@@ -0,0 +1,25 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/hnakamur/pipesecret/internal/rpc"
+)
+
+type InvalidateCmd struct {
+	Item []string `sep:"none" help:"item name to remove from the cache. can be repeated. all items are removed if not specified"`
+
+	Socket         string        `group:"connect" required:"" default:"${default_socket_path}" env:"PIPESECRET_SOCKET" help:"unix socket path"`
+	ConnectTimeout time.Duration `group:"connect" default:"5s" help:"connect timeout"`
+}
+
+func (c *InvalidateCmd) Run(ctx context.Context) error {
+	n, err := rpc.Invalidate(ctx, c.Socket, c.ConnectTimeout, c.Item)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("invalidated %d items\n", n)
+	return nil
+}
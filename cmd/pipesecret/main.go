@@ -15,22 +15,34 @@ import (
 	"time"
 
 	"github.com/alecthomas/kong"
+	"github.com/hnakamur/pipesecret/internal"
+	"github.com/hnakamur/pipesecret/internal/approval"
+	"github.com/hnakamur/pipesecret/internal/audit"
+	"github.com/hnakamur/pipesecret/internal/policy"
+	"github.com/hnakamur/pipesecret/internal/redact"
 	"github.com/hnakamur/pipesecret/internal/rpc"
+	"github.com/hnakamur/pipesecret/internal/unixsocketrpc"
 	"golang.org/x/xerrors"
 )
 
+const defaultQuery = `{"username": .fields[] | select(.id == "username").value, "password": .fields[] | select(.id == "password").value}`
+
 var cli struct {
 	Debug bool `help:"Enable debug mode."`
 
 	Run         RunCmd         `cmd:"" help:"Run the specified command with injecting secrets. This subcommand is supposed to be executed on the remote server."`
 	RemoteServe RemoteServeCmd `cmd:"" help:"The remote server which is executed automatically by serve subcommand."`
 	Serve       ServeCmd       `cmd:"" help:"Run local server. This subcommand is supposed to be executed on the local machine."`
+	Invalidate  InvalidateCmd  `cmd:"" help:"Remove items from the item cache of serve. This subcommand is supposed to be executed on the remote server."`
+	Audit       AuditCmd       `cmd:"" help:"Show the audit log of serve. This subcommand is supposed to be executed on the local machine."`
+	Policy      PolicyCmd      `cmd:"" help:"Manage the access policy of serve. This subcommand is supposed to be executed on the local machine."`
 	Version     VersionCmd     `cmd:"" help:"Show version and exit."`
 }
 
 type RunCmd struct {
-	Item  string `group:"query" required:"" help:"Item name in password manager to get"`
-	Query string `group:"query" required:"" default:"{\"username\": .fields[] | select(.id == \"username\").value, \"password\": .fields[] | select(.id == \"password\").value}" env:"PIPESECRET_QUERY" help:"query string for gojq"`
+	Item       []string `group:"query" required:"" sep:"none" help:"Item name in password manager to get. can be repeated as name=alias to get multiple items in a request, and then the result for each item is referenced by the alias in templates. a single --item is always the whole name even if it contains =, and its alias for --items-query is the name. example: --item=app/db=db --item=app/api=api --env='DB_PASSWORD={{.db.password}};API_TOKEN={{.api.password}}'"`
+	Query      string   `group:"query" required:"" default:"${default_query}" env:"PIPESECRET_QUERY" help:"query string for gojq"`
+	ItemsQuery string   `group:"query" help:"query string for gojq run once for all items instead of --query. items are bound to $items whose keys are aliases, and the result is referenced in templates. if serve has a policy, the query must be in items_queries of a rule. example: --items-query='{dsn: \"\\($items.db.fields[] | select(.id == \"password\").value)@db\"}'"`
 
 	Stdin  string            `group:"inject" help:"inject secret to stdin if not empty. format: Go text/template string. example: {{.username}}{{\"\\n\"}}{{.password}}{{\"\\n\"}}"`
 	DirKey string            `group:"inject" help:"create temporary directory with random name for files. example: --dir-key=secret_dir --file='token.txt={{.username}};secret.txt={{.password}}' --env='TOKEN_FILE={{.secret_dir}}/token.txt;SECRET_FILE={{.secret_dir}}/secret.txt'"`
@@ -68,7 +80,7 @@ func (c *RunCmd) Run(ctx context.Context) (err error) {
 		return err
 	}
 
-	result, err := rpc.GetQueryItem(ctx, c.Socket, c.ConnectTimeout, c.Item, c.Query)
+	result, err := c.getQueryItems(ctx)
 	if err != nil {
 		return err
 	}
@@ -138,7 +150,7 @@ func (c *RunCmd) Run(ctx context.Context) (err error) {
 			if err != nil {
 				return err
 			}
-			slog.Debug("adding environment variable", "name", k, "value", v)
+			slog.Debug("adding environment variable", "name", k)
 			cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", k, v))
 		}
 
@@ -152,6 +164,46 @@ func (c *RunCmd) Run(ctx context.Context) (err error) {
 	return nil
 }
 
+// getQueryItems gets the items in --item. A single item without an alias is
+// got with getQueryItem, so that the result is not nested under the alias.
+func (c *RunCmd) getQueryItems(ctx context.Context) (any, error) {
+	items, err := c.itemQueries()
+	if err != nil {
+		return nil, err
+	}
+	if len(c.Item) == 1 && c.ItemsQuery == "" {
+		return rpc.GetQueryItem(ctx, c.Socket, c.ConnectTimeout, c.Item[0], c.Query)
+	}
+	return rpc.GetQueryItems(ctx, c.Socket, c.ConnectTimeout, items, c.ItemsQuery)
+}
+
+// itemQueries parses --item flags in the form of name or name=alias.
+// The alias defaults to the name. A single --item is not split at "=", so
+// that names containing "=" can be got.
+func (c *RunCmd) itemQueries() ([]rpc.ItemQuery, error) {
+	items := make([]rpc.ItemQuery, len(c.Item))
+	aliases := make(map[string]bool, len(c.Item))
+	for i, item := range c.Item {
+		name, alias := item, item
+		// Item names may contain "=", but aliases do not.
+		if j := strings.LastIndexByte(item, '='); j != -1 && len(c.Item) > 1 {
+			name, alias = item[:j], item[j+1:]
+		}
+		if name == "" || alias == "" {
+			return nil, fmt.Errorf("invalid --item %q, must be name or name=alias", item)
+		}
+		if aliases[alias] {
+			return nil, fmt.Errorf("duplicate alias %q in --item", alias)
+		}
+		aliases[alias] = true
+		items[i] = rpc.ItemQuery{Item: name, Alias: alias}
+		if c.ItemsQuery == "" {
+			items[i].Query = c.Query
+		}
+	}
+	return items, nil
+}
+
 func parseTemplate(tmpl string) (*template.Template, error) {
 	return template.New("").Parse(tmpl)
 }
@@ -183,11 +235,24 @@ func executeTemplate(tmpl *template.Template, values any) (string, error) {
 type RemoteServeCmd struct {
 	Socket    string        `group:"listen" required:"" default:"${default_socket_path}" help:"unix socket path"`
 	Heartbeat time.Duration `group:"pipe rpc" default:"5s" help:"heartbeat interval"`
+
+	AllowUID []uint32 `group:"peer" name:"allow-uid" help:"uid of users allowed to get items in addition to the user running remote-serve. can be repeated"`
+	AllowGID []uint32 `group:"peer" name:"allow-gid" help:"gid of groups allowed to get items. the primary group of the process is checked. can be repeated"`
+	AllowExe []string `group:"peer" name:"allow-exe" type:"path" help:"if specified, only processes of these executables can get items, in addition to the uid and gid check. can be repeated"`
 }
 
 func (c *RemoteServeCmd) Run(ctx context.Context) error {
 	slog.Debug("remote-serve", "socketPath", c.Socket)
-	s := rpc.NewRemoteServer(c.Socket, c.Heartbeat)
+	s := rpc.NewRemoteServer(rpc.RemoteServerConfig{
+		SocketPath: c.Socket,
+		Allowlist: unixsocketrpc.PeerAllowlist{
+			UIDs: c.AllowUID,
+			GIDs: c.AllowGID,
+			Exes: c.AllowExe,
+		},
+		HeartbeatInterval: c.Heartbeat,
+		Version:           Version(),
+	})
 	if err := s.Run(ctx, os.Stdout, os.Stdin); err != nil {
 		return err
 	}
@@ -195,14 +260,183 @@ func (c *RemoteServeCmd) Run(ctx context.Context) error {
 }
 
 type ServeCmd struct {
-	SSH     string `group:"pipe rpc" required:"" default:"ssh" env:"PIPESECRET_SSH" help:"ssh command"`
-	Host    string `group:"pipe rpc" required:"" env:"PIPESECRET_HOST" help:"destination hostname"`
-	Command string `group:"pipe rpc" required:"" env:"PIPESECRET_COMMAND" help:"command and arguements to execute on the destination host"`
-	Op      string `required:"" env:"PIPESECRET_OP" help:"path to 1Password CLI"`
+	SSH       string   `group:"pipe rpc" required:"" default:"ssh" env:"PIPESECRET_SSH" help:"ssh command"`
+	Host      []string `group:"pipe rpc" env:"PIPESECRET_HOST" help:"destination hostname. can be repeated to connect to multiple hosts"`
+	Command   string   `group:"pipe rpc" env:"PIPESECRET_COMMAND" help:"command and arguements to execute on the destination host"`
+	HostsFile string   `group:"pipe rpc" type:"path" env:"PIPESECRET_HOSTS_FILE" help:"path to a JSON file of hosts to connect to in addition to --host. example: [{\"name\": \"dev1\", \"host\": \"dev1.example.com\", \"ssh\": \"/usr/local/bin/ssh\", \"command\": \"pipesecret remote-serve\"}]. name, ssh and command are optional and default to host, --ssh and --command"`
+	Workers   int      `group:"pipe rpc" default:"4" env:"PIPESECRET_WORKERS" help:"number of requests handled concurrently per host"`
+
+	Reconnect           bool          `group:"reconnect" env:"PIPESECRET_RECONNECT" help:"restart ssh and remote-serve when ssh exits, with exponential backoff"`
+	ReconnectMinBackoff time.Duration `group:"reconnect" default:"1s" help:"initial delay before reconnecting"`
+	ReconnectMaxBackoff time.Duration `group:"reconnect" default:"1m" help:"maximum delay before reconnecting"`
+
+	Approval        string        `group:"approval" default:"none" enum:"none,tty,command" env:"PIPESECRET_APPROVAL" help:"ask before getting an item for each request (none, tty, command). tty asks on the terminal of serve, command runs --approval-command"`
+	ApprovalCommand string        `group:"approval" env:"PIPESECRET_APPROVAL_COMMAND" help:"command and arguments to ask approval. details of the request are passed in environment variables PIPESECRET_HOST, PIPESECRET_ITEM, PIPESECRET_QUERY, PIPESECRET_ITEMS_QUERY, PIPESECRET_PEER_UID, PIPESECRET_PEER_GID, PIPESECRET_PEER_PID, PIPESECRET_PEER_EXE and PIPESECRET_MESSAGE. the request is denied if it exits with non-zero status, otherwise the first line of stdout is the answer: allow, deny (or empty), or minutes to allow for"`
+	ApprovalTimeout time.Duration `group:"approval" default:"1m" env:"PIPESECRET_APPROVAL_TIMEOUT" help:"deny the request if not answered in this duration"`
+
+	QueryTimeout     time.Duration `group:"query" default:"1s" env:"PIPESECRET_QUERY_TIMEOUT" help:"maximum duration to run a query from remote hosts"`
+	QueryMaxSteps    int64         `group:"query" default:"1000000" env:"PIPESECRET_QUERY_MAX_STEPS" help:"maximum number of gojq instructions to run a query from remote hosts"`
+	QueryMaxOutput   int           `group:"query" default:"1048576" env:"PIPESECRET_QUERY_MAX_OUTPUT" help:"maximum size of a query result in bytes"`
+	QueryMaxValue    int           `group:"query" default:"1048576" env:"PIPESECRET_QUERY_MAX_VALUE" help:"maximum size of a value made by a query, such as a string concatenated by +, in bytes"`
+	QueryMaxMemoryMB int           `group:"query" name:"query-max-memory-mb" default:"0" env:"PIPESECRET_QUERY_MAX_MEMORY_MB" help:"maximum memory in megabytes to run a query from remote hosts. if positive, queries run in child processes which are stopped when they use more. 0 runs queries in the serve process bounded only by the other --query-* limits"`
+
+	CacheTTL       time.Duration            `group:"cache" env:"PIPESECRET_CACHE_TTL" help:"keep items in memory for this duration to get them without the backend. 0 disables the cache for items which do not match --cache-item-ttl. the cache does not protect items in memory of serve: they are not locked against swapping, and copies of them stay in memory until reused even after they are removed"`
+	CacheItemTTL   map[string]time.Duration `group:"cache" env:"PIPESECRET_CACHE_ITEM_TTL" help:"TTL for items matching patterns instead of --cache-ttl. the longest matching pattern is used, and 0 disables the cache. example: --cache-item-ttl='prod/*=0;dev/*=1h'"`
+	CacheMaxSizeMB int                      `group:"cache" name:"cache-max-size-mb" default:"4" help:"maximum total size of cached items in megabytes. least recently used items are removed"`
+
+	Policy string `group:"policy" type:"path" env:"PIPESECRET_POLICY" help:"path to the policy file which decides which hosts can get which items with which queries"`
+
+	AuditLog        string `group:"audit" default:"${default_audit_log}" env:"PIPESECRET_AUDIT_LOG" help:"path to the audit log of requests for items. secret values are never written. empty disables the audit log"`
+	AuditMaxSizeMB  int    `group:"audit" name:"audit-max-size-mb" default:"10" help:"rotate the audit log when it gets larger than this size in megabytes"`
+	AuditMaxBackups int    `group:"audit" default:"5" help:"number of rotated audit logs to keep. at least 1"`
+
+	Backend     string            `group:"backend" default:"1password" enum:"1password,1password-connect,bitwarden,pass,vault,keepass,sops,exec,fixture" env:"PIPESECRET_BACKEND" help:"password manager backend to get items from (1password, 1password-connect, bitwarden, pass, vault, keepass, sops, exec, fixture)"`
+	BackendExec string            `group:"backend" type:"path" env:"PIPESECRET_BACKEND_EXEC" help:"path to a backend plugin. if specified, --backend is ignored and the plugin is used as the default backend"`
+	Route       map[string]string `group:"backend" env:"PIPESECRET_ROUTE" help:"route items with a scheme prefix to backends. example: --route='op=1password;vault=vault;file=pass' routes vault://app/db to app/db in vault backend. items without a routed prefix go to the default backend"`
+
+	Fallback                []string `group:"fallback" env:"PIPESECRET_FALLBACK" help:"backends tried in order as the default backend instead of --backend. an item not found in a backend is looked up in the next one. example: --fallback=1password,vault"`
+	FallbackSkipUnavailable bool     `group:"fallback" env:"PIPESECRET_FALLBACK_SKIP_UNAVAILABLE" help:"try the next backend also when a backend is unavailable, instead of failing"`
+
+	Op              string        `group:"1password" default:"op" env:"PIPESECRET_OP" help:"path to 1Password CLI"`
+	OpSignin        bool          `group:"1password" env:"PIPESECRET_OP_SIGNIN" help:"when op is not signed in, for example the session has expired, run op signin on the terminal of serve and retry the request. remote run waits until signed in"`
+	OpSigninCommand string        `group:"1password" env:"PIPESECRET_OP_SIGNIN_COMMAND" help:"command and arguments to sign in instead of op signin. it runs on the terminal, and lines like export OP_SESSION_my=\"...\" in stdout set environment variables for op"`
+	OpSigninTimeout time.Duration `group:"1password" default:"2m" env:"PIPESECRET_OP_SIGNIN_TIMEOUT" help:"fail the request if not signed in within this duration"`
+
+	ConnectHost  string `group:"1password-connect" env:"OP_CONNECT_HOST" help:"URL of the 1Password Connect server"`
+	ConnectToken string `group:"1password-connect" env:"OP_CONNECT_TOKEN" help:"access token for the 1Password Connect server"`
+	ConnectVault string `group:"1password-connect" env:"PIPESECRET_CONNECT_VAULT" help:"vault title or ID used for item names without vault/ prefix"`
+
+	BW        string `group:"bitwarden" name:"bw" default:"bw" env:"PIPESECRET_BW" help:"path to Bitwarden CLI"`
+	BWSession string `group:"bitwarden" name:"bw-session" env:"BW_SESSION" help:"session key to unlock the Bitwarden vault"`
+
+	PassDir            string `group:"pass" type:"path" default:"~/.password-store" env:"PASSWORD_STORE_DIR" help:"password-store directory used by pass and gopass"`
+	PassDecryptCommand string `group:"pass" default:"gpg --quiet --batch --decrypt" env:"PIPESECRET_PASS_DECRYPT_COMMAND" help:"command and arguments to decrypt an entry. the path of the entry file is appended"`
+
+	VaultAddr      string `group:"vault" env:"VAULT_ADDR" help:"address of the Vault server"`
+	VaultToken     string `group:"vault" env:"VAULT_TOKEN" help:"token to access the Vault server"`
+	VaultNamespace string `group:"vault" env:"VAULT_NAMESPACE" help:"Vault namespace"`
+	VaultMount     string `group:"vault" default:"secret" env:"PIPESECRET_VAULT_MOUNT" help:"mount path of the KV secrets engine"`
+	VaultKVVersion int    `group:"vault" name:"vault-kv-version" default:"2" enum:"1,2" env:"PIPESECRET_VAULT_KV_VERSION" help:"version of the KV secrets engine (1, 2)"`
+
+	KeePassDB       string `group:"keepass" name:"keepass-db" type:"path" env:"PIPESECRET_KEEPASS_DB" help:"path to KeePass database file"`
+	KeePassKeyfile  string `group:"keepass" name:"keepass-keyfile" type:"path" env:"PIPESECRET_KEEPASS_KEYFILE" help:"path to key file to unlock the KeePass database"`
+	KeePassPassword bool   `group:"keepass" name:"keepass-password" default:"true" negatable:"" help:"read master password of the KeePass database from the terminal. --no-keepass-password can be used with --keepass-keyfile"`
+
+	SOPSFile    string `group:"sops" name:"sops-file" type:"path" env:"PIPESECRET_SOPS_FILE" help:"path to a SOPS encrypted YAML or JSON file, or an age encrypted file whose name ends with .age. each top-level key is an item"`
+	SOPS        string `group:"sops" name:"sops" default:"sops" env:"PIPESECRET_SOPS" help:"path to SOPS CLI"`
+	AgeIdentity string `group:"sops" type:"path" default:"~/.config/sops/age/keys.txt" env:"SOPS_AGE_KEY_FILE" help:"path to age identity file to decrypt the file"`
+
+	FixtureFile string `group:"fixture" type:"path" env:"PIPESECRET_FIXTURE_FILE" help:"path to a JSON file whose keys are item names and values are items. for tests and demos"`
+}
+
+func (c *ServeCmd) Help() string {
+	return `Status of hosts:
+
+	On unix, sending SIGUSR1 to serve logs the status of each host at the
+	info level: the state of the connection (connecting, connected, waiting
+	to reconnect or stopped) and since when, the number of connections and
+	requests, and the last error. A host is connected after remote-serve
+	initializes the connection, not when ssh starts. For example:
+
+	  kill -USR1 $(pgrep -f 'pipesecret serve')
+
+	The status is only available in these log lines. There is no command
+	to query it, and it is not available on Windows.`
 }
 
 func (c *ServeCmd) Run(ctx context.Context) error {
-	return rpc.RunLocalServer(ctx, c.SSH, c.Host, c.Command, c.Op)
+	hosts, err := c.hostConfigs()
+	if err != nil {
+		return err
+	}
+	if c.ReconnectMinBackoff <= 0 || c.ReconnectMaxBackoff < c.ReconnectMinBackoff {
+		return errors.New("--reconnect-min-backoff must be positive and not greater than --reconnect-max-backoff")
+	}
+	if c.QueryTimeout <= 0 || c.QueryMaxSteps <= 0 || c.QueryMaxOutput <= 0 || c.QueryMaxValue <= 0 {
+		return errors.New("--query-timeout, --query-max-steps, --query-max-output and --query-max-value must be positive")
+	}
+	var pol *policy.Policy
+	if c.Policy != "" {
+		pol, err = policy.Load(c.Policy)
+		if err != nil {
+			return err
+		}
+	}
+	approver, err := c.newApprover()
+	if err != nil {
+		return err
+	}
+	var auditLogger *audit.Logger
+	if c.AuditLog != "" {
+		if c.AuditMaxBackups < 1 {
+			return errors.New("--audit-max-backups must be at least 1")
+		}
+		auditLogger, err = audit.NewLogger(c.AuditLog, int64(c.AuditMaxSizeMB)<<20, c.AuditMaxBackups)
+		if err != nil {
+			return err
+		}
+		defer auditLogger.Close()
+	}
+	getter, err := c.newItemGetter(ctx)
+	if err != nil {
+		return err
+	}
+	var cache *internal.ItemCache
+	if c.CacheTTL > 0 || len(c.CacheItemTTL) > 0 {
+		if c.CacheMaxSizeMB <= 0 {
+			return errors.New("--cache-max-size-mb must be positive")
+		}
+		cache, err = internal.NewItemCache(getter, internal.ItemCacheConfig{
+			TTL:      c.CacheTTL,
+			ItemTTLs: c.CacheItemTTL,
+			MaxSize:  int64(c.CacheMaxSizeMB) << 20,
+		})
+		if err != nil {
+			return err
+		}
+		// Zero cached items on exit.
+		defer cache.Invalidate()
+		getter = cache
+	}
+	return rpc.RunLocalServer(ctx, rpc.LocalServerConfig{
+		Hosts:    hosts,
+		Getter:   getter,
+		Cache:    cache,
+		Policy:   pol,
+		Approver: approver,
+		QueryLimits: internal.QueryLimits{
+			Timeout:       c.QueryTimeout,
+			MaxSteps:      c.QueryMaxSteps,
+			MaxOutputSize: c.QueryMaxOutput,
+			MaxValueSize:  c.QueryMaxValue,
+			MaxMemory:     int64(c.QueryMaxMemoryMB) << 20,
+		},
+		Audit:      auditLogger,
+		Version:    Version(),
+		Workers:    c.Workers,
+		Reconnect:  c.Reconnect,
+		MinBackoff: c.ReconnectMinBackoff,
+		MaxBackoff: c.ReconnectMaxBackoff,
+	})
+}
+
+func (c *ServeCmd) newApprover() (*approval.Approver, error) {
+	var prompter approval.Prompter
+	switch c.Approval {
+	case "none":
+		return nil, nil
+	case "tty":
+		prompter = approval.NewTTYPrompter()
+	case "command":
+		var err error
+		prompter, err = approval.NewCommandPrompter(c.ApprovalCommand)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported approval: %s", c.Approval)
+	}
+	return approval.NewApprover(prompter, c.ApprovalTimeout), nil
 }
 
 type VersionCmd struct{}
@@ -220,12 +454,18 @@ func Version() string {
 }
 
 func main() {
+	// This process may be a child process to run a query for serve.
+	internal.RunQueryProcess()
+
 	slogLevel := new(slog.LevelVar)
-	logger := slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: slogLevel}))
+	// Mask secrets so that debug logs can be pasted into bug reports.
+	logger := slog.New(redact.NewHandler(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: slogLevel})))
 	slog.SetDefault(logger)
 
 	ctx := kong.Parse(&cli, kong.Vars{
 		"default_socket_path": "/tmp/pipesecret.sock",
+		"default_query":       defaultQuery,
+		"default_audit_log":   defaultAuditLogPath(),
 	})
 	if cli.Debug {
 		slogLevel.Set(slog.LevelDebug)
@@ -234,5 +474,10 @@ func main() {
 	// See https://github.com/alecthomas/kong/issues/48
 	ctx.BindTo(context.Background(), (*context.Context)(nil))
 	err := ctx.Run()
+	var rpcErr *rpc.Error
+	if errors.As(err, &rpcErr) {
+		ctx.Errorf("%s", runErrorMessage(rpcErr))
+		ctx.Exit(runExitCode(rpcErr))
+	}
 	ctx.FatalIfErrorf(err)
 }
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/hnakamur/pipesecret/internal/policy"
+)
+
+type PolicyCmd struct {
+	Test PolicyTestCmd `cmd:"" help:"Evaluate a hypothetical request with a policy file. Exits with non-zero status if denied."`
+}
+
+type PolicyTestCmd struct {
+	File       string   `type:"path" required:"" env:"PIPESECRET_POLICY" help:"path to the policy file"`
+	Host       string   `required:"" help:"remote host name of the request"`
+	Item       string   `required:"" help:"item name of the request"`
+	Query      string   `default:"${default_query}" help:"query of the request"`
+	ItemsQuery bool     `help:"the query is a query for all items given with --items-query of run"`
+	Tag        []string `help:"tags of the item. can be repeated"`
+}
+
+func (c *PolicyTestCmd) Run(ctx context.Context) error {
+	p, err := policy.Load(c.File)
+	if err != nil {
+		return err
+	}
+	d, err := p.Decide(policy.Request{
+		Host:       c.Host,
+		Item:       c.Item,
+		Query:      c.Query,
+		ItemsQuery: c.ItemsQuery,
+		Tags: func() ([]string, error) {
+			return c.Tag, nil
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if !d.Allow {
+		return fmt.Errorf("%w (%s)", policy.ErrDenied, d.Reason)
+	}
+	fmt.Printf("allowed (%s)\n", d.Reason)
+	return nil
+}
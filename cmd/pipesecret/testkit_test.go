@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/hnakamur/pipesecret/internal/rpc"
+	"github.com/hnakamur/pipesecret/internal/testkit"
+)
+
+func TestMain(m *testing.M) {
+	// The fake ssh runs remote-serve by calling main of this test binary.
+	testkit.Main(main)
+	os.Exit(m.Run())
+}
+
+// testKit is testkit.Kit with a method to run the run subcommand.
+type testKit struct {
+	*testkit.Kit
+}
+
+// startTestKit starts serve with cfg. See testkit.Start.
+func startTestKit(t *testing.T, cfg rpc.LocalServerConfig) *testKit {
+	t.Helper()
+	return &testKit{Kit: testkit.Start(t, cfg)}
+}
+
+// run runs the run subcommand against SocketPath if cmd.Socket is empty.
+func (k *testKit) run(t *testing.T, cmd *RunCmd) error {
+	t.Helper()
+
+	if cmd.Socket == "" {
+		cmd.Socket = k.SocketPath
+	}
+	if cmd.ConnectTimeout == 0 {
+		cmd.ConnectTimeout = 5 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	err := cmd.Run(ctx)
+	if errors.Is(err, context.DeadlineExceeded) {
+		t.Fatal("timeout running run subcommand")
+	}
+	return err
+}
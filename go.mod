@@ -3,15 +3,22 @@ module github.com/hnakamur/pipesecret
 go 1.24.4
 
 require (
+	filippo.io/age v1.2.1
+	github.com/GitRowin/orderedmapjson v0.5.0
 	github.com/alecthomas/kong v1.11.0
 	github.com/itchyny/gojq v0.12.17
+	github.com/tobischo/gokeepasslib/v3 v3.6.1
+	go.yaml.in/yaml/v3 v3.0.4
 	golang.org/x/exp/jsonrpc2 v0.0.0-20250620022241-b7579e27df2b
+	golang.org/x/sys v0.33.0
+	golang.org/x/term v0.32.0
 	golang.org/x/xerrors v0.0.0-20200804184101-5ec99f83aff1
 )
 
 require (
-	github.com/GitRowin/orderedmapjson v0.5.0 // indirect
 	github.com/elliotchance/orderedmap/v3 v3.1.0 // indirect
 	github.com/itchyny/timefmt-go v0.1.6 // indirect
+	github.com/tobischo/argon2 v0.1.0 // indirect
+	golang.org/x/crypto v0.31.0 // indirect
 	golang.org/x/exp/event v0.0.0-20220217172124-1812c5b45e43 // indirect
 )
@@ -0,0 +1,178 @@
+// Package approval asks a human on the local machine whether to allow
+// a request for an item from a remote host.
+package approval
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hnakamur/pipesecret/internal/unixsocketrpc"
+)
+
+var (
+	// ErrDenied is returned when the human denies the request.
+	ErrDenied = errors.New("request denied")
+	// ErrTimeout is returned when the human does not answer in time.
+	ErrTimeout = errors.New("approval timed out")
+)
+
+// Request is a request to be approved.
+type Request struct {
+	Host  string
+	Item  string
+	Query string
+	// ItemsQuery is true if Query is a query for all items of the request
+	// with whole items in $items, instead of a query for the item.
+	ItemsQuery bool
+	// Peer is the process which requested the item on the remote host.
+	// It is nil if unknown.
+	Peer *unixsocketrpc.Peer
+}
+
+// String returns a human readable description of the request.
+func (r Request) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "host:  %s\n", r.Host)
+	fmt.Fprintf(&b, "item:  %s\n", r.Item)
+	fmt.Fprintf(&b, "query: %s\n", r.Query)
+	if r.ItemsQuery {
+		fmt.Fprintf(&b, "       (query for all items, which gets whole items in $items)\n")
+	}
+	if r.Peer != nil {
+		fmt.Fprintf(&b, "peer:  uid=%d gid=%d pid=%d exe=%s\n", r.Peer.UID, r.Peer.GID, r.Peer.PID, r.Peer.Exe)
+	} else {
+		fmt.Fprintf(&b, "peer:  unknown\n")
+	}
+	return b.String()
+}
+
+// Decision is an answer of the human.
+type Decision struct {
+	Allow bool
+	// For is the duration in which the same requests are allowed without
+	// asking again. Zero means the request is allowed only once.
+	For time.Duration
+}
+
+// Prompter asks the human about a request.
+// Prompt must return when ctx is done.
+type Prompter interface {
+	Prompt(ctx context.Context, req Request) (Decision, error)
+}
+
+// Approver approves requests with a Prompter. It is shared among all remote
+// hosts, and asks one request at a time.
+type Approver struct {
+	prompter Prompter
+	timeout  time.Duration
+
+	// promptMu is held while asking, so that prompts are not mixed up.
+	promptMu sync.Mutex
+
+	mu     sync.Mutex
+	grants map[grantKey]time.Time
+}
+
+// grantKey is the key of requests allowed for a duration.
+// The same item with the same query from the same host is allowed.
+type grantKey struct {
+	host       string
+	item       string
+	query      string
+	itemsQuery bool
+}
+
+// NewApprover creates an Approver. If the human does not answer in timeout,
+// the request is denied with ErrTimeout.
+func NewApprover(prompter Prompter, timeout time.Duration) *Approver {
+	return &Approver{
+		prompter: prompter,
+		timeout:  timeout,
+		grants:   make(map[grantKey]time.Time),
+	}
+}
+
+// Approve returns nil if the request is allowed. It returns an error
+// wrapping ErrDenied or ErrTimeout if not.
+func (a *Approver) Approve(ctx context.Context, req Request) error {
+	key := grantKey{host: req.Host, item: req.Item, query: req.Query, itemsQuery: req.ItemsQuery}
+	if a.granted(key) {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, a.timeout)
+	defer cancel()
+	if err := a.lockPrompt(ctx); err != nil {
+		return err
+	}
+	defer a.promptMu.Unlock()
+
+	// The same request may have been allowed while waiting for another prompt.
+	if a.granted(key) {
+		return nil
+	}
+	decision, err := a.prompter.Prompt(ctx, req)
+	if err != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return fmt.Errorf("%w: no answer in %s", ErrTimeout, a.timeout)
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return fmt.Errorf("%w: failed to ask, err=%s", ErrDenied, err)
+	}
+	if !decision.Allow {
+		return fmt.Errorf("%w: item %s from host %s", ErrDenied, req.Item, req.Host)
+	}
+	if decision.For > 0 {
+		a.grant(key, time.Now().Add(decision.For))
+	}
+	return nil
+}
+
+// lockPrompt locks promptMu unless ctx is done first.
+func (a *Approver) lockPrompt(ctx context.Context) error {
+	lockedC := make(chan struct{})
+	go func() {
+		a.promptMu.Lock()
+		close(lockedC)
+	}()
+	select {
+	case <-lockedC:
+		return nil
+	case <-ctx.Done():
+		// Unlock after the goroutine gets the lock.
+		go func() {
+			<-lockedC
+			a.promptMu.Unlock()
+		}()
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return fmt.Errorf("%w: waited another prompt for %s", ErrTimeout, a.timeout)
+		}
+		return ctx.Err()
+	}
+}
+
+func (a *Approver) granted(key grantKey) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	expiry, ok := a.grants[key]
+	if !ok {
+		return false
+	}
+	if time.Now().After(expiry) {
+		delete(a.grants, key)
+		return false
+	}
+	return true
+}
+
+func (a *Approver) grant(key grantKey, expiry time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.grants[key] = expiry
+}
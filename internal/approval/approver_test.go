@@ -0,0 +1,145 @@
+package approval
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type stubPrompter struct {
+	decision Decision
+	calls    atomic.Int32
+}
+
+func (p *stubPrompter) Prompt(ctx context.Context, req Request) (Decision, error) {
+	p.calls.Add(1)
+	return p.decision, nil
+}
+
+type blockingPrompter struct{}
+
+func (blockingPrompter) Prompt(ctx context.Context, req Request) (Decision, error) {
+	<-ctx.Done()
+	return Decision{}, ctx.Err()
+}
+
+func TestApprover(t *testing.T) {
+	req := Request{Host: "dev1", Item: "item1", Query: ".password"}
+	testCases := []struct {
+		name      string
+		decision  Decision
+		wantErr   error
+		wantCalls int32
+	}{
+		{name: "allowOnce", decision: Decision{Allow: true}, wantCalls: 2},
+		{name: "allowFor", decision: Decision{Allow: true, For: time.Minute}, wantCalls: 1},
+		{name: "deny", decision: Decision{}, wantErr: ErrDenied, wantCalls: 2},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			prompter := &stubPrompter{decision: tc.decision}
+			a := NewApprover(prompter, time.Minute)
+			for range 2 {
+				if err := a.Approve(context.Background(), req); !errors.Is(err, tc.wantErr) {
+					t.Errorf("err mismatch, got=%v, want=%v", err, tc.wantErr)
+				}
+			}
+			if got := prompter.calls.Load(); got != tc.wantCalls {
+				t.Errorf("calls mismatch, got=%d, want=%d", got, tc.wantCalls)
+			}
+		})
+	}
+
+	t.Run("timeout", func(t *testing.T) {
+		a := NewApprover(blockingPrompter{}, 10*time.Millisecond)
+		if err := a.Approve(context.Background(), req); !errors.Is(err, ErrTimeout) {
+			t.Errorf("err mismatch, got=%v, want=%v", err, ErrTimeout)
+		}
+	})
+
+	t.Run("allowForOtherItem", func(t *testing.T) {
+		prompter := &stubPrompter{decision: Decision{Allow: true, For: time.Minute}}
+		a := NewApprover(prompter, time.Minute)
+		other := req
+		other.Item = "item2"
+		for _, r := range []Request{req, other} {
+			if err := a.Approve(context.Background(), r); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if got := prompter.calls.Load(); got != 2 {
+			t.Errorf("calls mismatch, got=%d, want=2", got)
+		}
+	})
+}
+
+func TestCommandPrompter(t *testing.T) {
+	testCases := []struct {
+		name   string
+		script string
+		want   Decision
+	}{
+		{name: "emptyOutput", script: "exit 0", want: Decision{}},
+		{name: "allow", script: "echo allow", want: Decision{Allow: true}},
+		{name: "allowFor", script: "echo 15", want: Decision{Allow: true, For: 15 * time.Minute}},
+		{name: "deny", script: "echo deny", want: Decision{}},
+		{name: "exitStatus", script: "exit 1", want: Decision{}},
+		{name: "env", script: `test "$PIPESECRET_HOST/$PIPESECRET_ITEM" = dev1/item1 && echo 1h`, want: Decision{Allow: true, For: time.Hour}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			script := filepath.Join(t.TempDir(), "approve.sh")
+			if err := os.WriteFile(script, []byte("#!/bin/sh\n"+tc.script+"\n"), 0o700); err != nil {
+				t.Fatal(err)
+			}
+			p, err := NewCommandPrompter(script)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := p.Prompt(context.Background(), Request{Host: "dev1", Item: "item1", Query: "."})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.want {
+				t.Errorf("decision mismatch, got=%+v, want=%+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestTTYPrompter(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	p := &ttyPrompter{open: func() (*os.File, io.Writer, error) {
+		return r, io.Discard, nil
+	}}
+	req := Request{Host: "dev1", Item: "item1", Query: "."}
+
+	// The read is stopped when no answer is given in time.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := p.Prompt(ctx, req); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err mismatch, got=%v, want=%v", err, context.DeadlineExceeded)
+	}
+
+	// The same reader reads the answer for the next prompt.
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		w.WriteString("maybe\n15\n")
+	}()
+	got, err := p.Prompt(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (Decision{Allow: true, For: 15 * time.Minute}); got != want {
+		t.Errorf("decision mismatch, got=%+v, want=%+v", got, want)
+	}
+}
@@ -0,0 +1,205 @@
+package approval
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hnakamur/pipesecret/internal/terminal"
+)
+
+// parseAnswer parses an answer of the human. An answer is one of
+// "y" (allow once), "n" (deny), a number of minutes to allow for, or
+// a duration such as "1h30m" to allow for. An empty answer denies, so that
+// the request is not allowed without an explicit answer.
+func parseAnswer(answer string) (Decision, error) {
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	switch answer {
+	case "y", "yes", "allow":
+		return Decision{Allow: true}, nil
+	case "", "n", "no", "deny":
+		return Decision{}, nil
+	}
+	if minutes, err := strconv.Atoi(answer); err == nil && minutes > 0 {
+		return Decision{Allow: true, For: time.Duration(minutes) * time.Minute}, nil
+	}
+	if d, err := time.ParseDuration(answer); err == nil && d > 0 {
+		return Decision{Allow: true, For: d}, nil
+	}
+	return Decision{}, fmt.Errorf("invalid answer: %q", answer)
+}
+
+type ttyPrompter struct {
+	// open opens the terminal for reading answers and writing prompts.
+	open func() (in *os.File, out io.Writer, err error)
+
+	// The fields below are accessed only while the terminal is locked.
+	in  *os.File
+	out io.Writer
+	// reqC requests the reader goroutine to read a line, and the line is
+	// sent to lineC.
+	reqC  chan struct{}
+	lineC chan ttyLine
+	// reading is true while a requested line is not received yet.
+	reading bool
+}
+
+// ttyLine is a line read from the terminal.
+type ttyLine struct {
+	line string
+	err  error
+	// at is when the line was read.
+	at time.Time
+}
+
+// NewTTYPrompter creates a Prompter which asks on the terminal of serve.
+func NewTTYPrompter() Prompter {
+	return &ttyPrompter{open: func() (*os.File, io.Writer, error) {
+		tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+		return tty, tty, err
+	}}
+}
+
+// start opens the terminal and starts the reader goroutine if not yet. The
+// terminal is kept open and the goroutine keeps running, since a blocked
+// read cannot be stopped if the terminal does not support deadlines. One
+// reader for all prompts does not take lines typed for later prompts.
+func (p *ttyPrompter) start() error {
+	if p.in != nil {
+		return nil
+	}
+	in, out, err := p.open()
+	if err != nil {
+		return fmt.Errorf("failed to open terminal, err=%s", err)
+	}
+	p.in, p.out = in, out
+	p.reqC = make(chan struct{}, 1)
+	p.lineC = make(chan ttyLine)
+	go func() {
+		r := bufio.NewReader(in)
+		for range p.reqC {
+			// Clear the deadline set to stop the previous read.
+			in.SetReadDeadline(time.Time{})
+			line, err := r.ReadString('\n')
+			p.lineC <- ttyLine{line: line, err: err, at: time.Now()}
+		}
+	}()
+	return nil
+}
+
+func (p *ttyPrompter) Prompt(ctx context.Context, req Request) (Decision, error) {
+	unlock, err := terminal.Lock(ctx)
+	if err != nil {
+		return Decision{}, err
+	}
+	defer unlock()
+
+	if err := p.start(); err != nil {
+		return Decision{}, err
+	}
+
+	startTime := time.Now()
+	fmt.Fprintf(p.out, "\npipesecret: allow this request?\n%s", req)
+	ask := true
+	for {
+		if ask {
+			fmt.Fprint(p.out, "answer y (allow once), minutes to allow for, or N (deny): ")
+			ask = false
+		}
+		if !p.reading {
+			p.reqC <- struct{}{}
+			p.reading = true
+		}
+		var res ttyLine
+		select {
+		case res = <-p.lineC:
+			p.reading = false
+		case <-ctx.Done():
+			fmt.Fprintln(p.out, "\npipesecret: no answer, denied")
+			// Stop the read. If the terminal does not support deadlines,
+			// the read continues, and the next prompt ignores the line.
+			p.in.SetReadDeadline(time.Now())
+			return Decision{}, ctx.Err()
+		}
+		if errors.Is(res.err, os.ErrDeadlineExceeded) || res.at.Before(startTime) {
+			// The read was stopped, or the line was typed for a previous
+			// prompt.
+			continue
+		}
+		if res.err != nil {
+			return Decision{}, fmt.Errorf("failed to read answer, err=%s", res.err)
+		}
+		decision, err := parseAnswer(res.line)
+		if err != nil {
+			fmt.Fprintln(p.out, err)
+			ask = true
+			continue
+		}
+		return decision, nil
+	}
+}
+
+type commandPrompter struct {
+	args []string
+}
+
+// NewCommandPrompter creates a Prompter which runs command to ask the human,
+// for example, a wrapper script of zenity. command is a command and arguments
+// separated by spaces.
+//
+// The command gets details of the request in the environment variables
+// PIPESECRET_HOST, PIPESECRET_ITEM, PIPESECRET_QUERY, PIPESECRET_ITEMS_QUERY
+// ("true" if the query is for all items), PIPESECRET_PEER_UID,
+// PIPESECRET_PEER_GID, PIPESECRET_PEER_PID, PIPESECRET_PEER_EXE, and
+// PIPESECRET_MESSAGE which is a human readable description of all of them.
+//
+// If the command exits with a non-zero status, the request is denied.
+// Otherwise, the first line of the standard output is the answer, which is
+// one of "allow", "deny", a number of minutes or a duration such as "1h" to
+// allow for. An empty output means "deny", so a command which only notifies
+// the human, such as notify-send, never allows requests.
+func NewCommandPrompter(command string) (Prompter, error) {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return nil, errors.New("approval command must not be empty")
+	}
+	return &commandPrompter{args: args}, nil
+}
+
+func (p *commandPrompter) Prompt(ctx context.Context, req Request) (Decision, error) {
+	cmd := exec.CommandContext(ctx, p.args[0], p.args[1:]...)
+	cmd.Env = append(os.Environ(),
+		"PIPESECRET_HOST="+req.Host,
+		"PIPESECRET_ITEM="+req.Item,
+		"PIPESECRET_QUERY="+req.Query,
+		"PIPESECRET_ITEMS_QUERY="+strconv.FormatBool(req.ItemsQuery),
+		"PIPESECRET_MESSAGE="+req.String(),
+	)
+	if req.Peer != nil {
+		cmd.Env = append(cmd.Env,
+			fmt.Sprintf("PIPESECRET_PEER_UID=%d", req.Peer.UID),
+			fmt.Sprintf("PIPESECRET_PEER_GID=%d", req.Peer.GID),
+			fmt.Sprintf("PIPESECRET_PEER_PID=%d", req.Peer.PID),
+			"PIPESECRET_PEER_EXE="+req.Peer.Exe,
+		)
+	}
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && ctx.Err() == nil {
+			return Decision{}, nil
+		}
+		return Decision{}, fmt.Errorf("failed to run approval command, err=%s", err)
+	}
+	line, _, _ := bytes.Cut(out, []byte("\n"))
+	return parseAnswer(string(line))
+}
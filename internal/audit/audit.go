@@ -0,0 +1,264 @@
+// Package audit writes and reads the audit log of requests for items on the
+// local machine. The audit log is a JSON lines file, and never contains
+// secret values.
+package audit
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hnakamur/pipesecret/internal"
+	"github.com/hnakamur/pipesecret/internal/approval"
+	"github.com/hnakamur/pipesecret/internal/policy"
+)
+
+// Results of requests.
+const (
+	ResultAllowed = "allowed"
+	ResultDenied  = "denied"
+	ResultError   = "error"
+)
+
+// ActionInvalidate is Record.Action for removing items from the item cache.
+const ActionInvalidate = "invalidate"
+
+// Record is a record in the audit log.
+type Record struct {
+	Time time.Time `json:"time"`
+	// Action is empty for getting an item, or ActionInvalidate.
+	Action string `json:"action,omitempty"`
+	Host   string `json:"host"`
+	// Peer is the process which requested the item on the remote host.
+	Peer *Peer  `json:"peer,omitempty"`
+	Item string `json:"item"`
+	// QuerySHA256 is the hash of the query. The query itself is not written
+	// since it may contain secrets.
+	QuerySHA256 string `json:"query_sha256"`
+	Result      string `json:"result"`
+	// Reason is the reason why the request is denied or failed.
+	Reason    string  `json:"reason,omitempty"`
+	LatencyMS float64 `json:"latency_ms"`
+}
+
+// Peer is the process which requested the item on the remote host.
+type Peer struct {
+	UID uint32 `json:"uid"`
+	GID uint32 `json:"gid"`
+	PID int32  `json:"pid"`
+	Exe string `json:"exe,omitempty"`
+}
+
+// HashQuery returns the hash of query for Record.QuerySHA256.
+func HashQuery(query string) string {
+	sum := sha256.Sum256([]byte(query))
+	return hex.EncodeToString(sum[:])
+}
+
+// Classify returns Result and Reason of Record for err returned from
+// handling a request. Error messages are not used as Reason, since they may
+// contain secret values, for example, an error of a query.
+func Classify(err error) (result, reason string) {
+	switch {
+	case err == nil:
+		return ResultAllowed, ""
+	case errors.Is(err, approval.ErrDenied),
+		errors.Is(err, internal.ErrBackendAuthorizationDismissed):
+		return ResultDenied, "approval_denied"
+	case errors.Is(err, approval.ErrTimeout):
+		return ResultDenied, "approval_timeout"
+	case errors.Is(err, policy.ErrDenied):
+		return ResultDenied, "policy_denied"
+	case errors.Is(err, internal.ErrItemNotFound):
+		return ResultError, "item_not_found"
+	case errors.Is(err, internal.ErrAmbiguousItem):
+		return ResultError, "ambiguous_item"
+	case errors.Is(err, internal.ErrBackendNotSignedIn):
+		return ResultError, "backend_not_signed_in"
+	case errors.Is(err, internal.ErrBackendUnavailable):
+		return ResultError, "backend_unavailable"
+	case errors.Is(err, internal.ErrQueryParse):
+		return ResultError, "query_parse"
+	case errors.Is(err, internal.ErrQueryRuntime):
+		return ResultError, "query_runtime"
+	case errors.Is(err, internal.ErrQueryRejected):
+		return ResultDenied, "query_rejected"
+	case errors.Is(err, context.Canceled):
+		return ResultError, "canceled"
+	default:
+		return ResultError, "error"
+	}
+}
+
+// Logger appends records to the audit log file, and rotates the file when it
+// gets larger than the maximum size.
+type Logger struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+// NewLogger opens the audit log file at path. When the file gets larger than
+// maxSize bytes, it is renamed to path.1, and path.1 is renamed to path.2,
+// and so on. Files after path.maxBackups are removed. maxBackups must be at
+// least 1, since the current file would be removed on rotation with 0.
+func NewLogger(path string, maxSize int64, maxBackups int) (*Logger, error) {
+	if maxBackups < 1 {
+		return nil, fmt.Errorf("the number of audit log backups must be at least 1: %d", maxBackups)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create audit log directory, err=%s", err)
+	}
+	l := &Logger{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *Logger) open() error {
+	file, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log, err=%s", err)
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to stat audit log, err=%s", err)
+	}
+	l.file = file
+	l.size = fi.Size()
+	return nil
+}
+
+// Log appends rec to the audit log.
+func (l *Logger) Log(rec Record) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.size > 0 && l.size+int64(len(line)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := l.file.Write(line)
+	l.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("failed to write audit log, err=%s", err)
+	}
+	return nil
+}
+
+func (l *Logger) rotate() error {
+	if err := l.file.Close(); err != nil {
+		return fmt.Errorf("failed to close audit log, err=%s", err)
+	}
+	if err := os.Remove(backupPath(l.path, l.maxBackups)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to remove old audit log, err=%s", err)
+	}
+	for i := l.maxBackups - 1; i >= 0; i-- {
+		err := os.Rename(backupPath(l.path, i), backupPath(l.path, i+1))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("failed to rotate audit log, err=%s", err)
+		}
+	}
+	return l.open()
+}
+
+// backupPath returns the path of the i-th backup. The 0-th is the current
+// file.
+func backupPath(path string, i int) string {
+	if i == 0 {
+		return path
+	}
+	return path + "." + strconv.Itoa(i)
+}
+
+func (l *Logger) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}
+
+// Filter selects records. Zero values match any record.
+type Filter struct {
+	Host   string
+	Item   string
+	Result string
+	Since  time.Time
+	Until  time.Time
+}
+
+func (f Filter) match(rec *Record) bool {
+	return (f.Host == "" || rec.Host == f.Host) &&
+		(f.Item == "" || rec.Item == f.Item) &&
+		(f.Result == "" || rec.Result == f.Result) &&
+		(f.Since.IsZero() || !rec.Time.Before(f.Since)) &&
+		(f.Until.IsZero() || rec.Time.Before(f.Until))
+}
+
+// Read calls fn with records matching filter in the audit log at path, from
+// the oldest to the newest. If rotated is true, rotated files are also read.
+func Read(path string, rotated bool, filter Filter, fn func(rec *Record) error) error {
+	paths := []string{path}
+	if rotated {
+		for i := 1; ; i++ {
+			p := backupPath(path, i)
+			if _, err := os.Stat(p); err != nil {
+				break
+			}
+			paths = append([]string{p}, paths...)
+		}
+	}
+	for _, p := range paths {
+		if err := readFile(p, filter, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readFile(path string, filter Filter, fn func(rec *Record) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log, err=%s", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		var rec Record
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return fmt.Errorf("failed to parse audit log, path=%s, line=%d, err=%s", path, lineNo, err)
+		}
+		if !filter.match(&rec) {
+			continue
+		}
+		if err := fn(&rec); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read audit log, err=%s", err)
+	}
+	return nil
+}
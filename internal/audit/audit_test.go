@@ -0,0 +1,113 @@
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/hnakamur/pipesecret/internal"
+	"github.com/hnakamur/pipesecret/internal/approval"
+)
+
+func TestLoggerRotate(t *testing.T) {
+	baseTime := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	newRecord := func(i int) Record {
+		return Record{
+			Time:        baseTime.Add(time.Duration(i) * time.Minute),
+			Host:        "dev1",
+			Item:        fmt.Sprintf("item%d", i),
+			QuerySHA256: HashQuery(".password"),
+			Result:      ResultAllowed,
+		}
+	}
+	line, err := json.Marshal(newRecord(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "audit", "audit.jsonl")
+	// A file holds 2 records.
+	l, err := NewLogger(path, int64(len(line)+1)*2, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range 7 {
+		if err := l.Log(newRecord(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path + ".3"); err == nil {
+		t.Errorf("too many backups are kept")
+	}
+
+	var items []string
+	err = Read(path, true, Filter{}, func(rec *Record) error {
+		items = append(items, rec.Item)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The oldest file with item0 and item1 has been removed.
+	if want := []string{"item2", "item3", "item4", "item5", "item6"}; !slices.Equal(items, want) {
+		t.Errorf("items mismatch, got=%v, want=%v", items, want)
+	}
+
+	// Rotating without backups would remove the current file.
+	if _, err := NewLogger(path, 1<<20, 0); err == nil {
+		t.Error("should fail without backups")
+	}
+}
+
+func TestFilter(t *testing.T) {
+	baseTime := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	rec := Record{Time: baseTime, Host: "dev1", Item: "item1", Result: ResultDenied}
+	testCases := []struct {
+		name   string
+		filter Filter
+		want   bool
+	}{
+		{name: "empty", filter: Filter{}, want: true},
+		{name: "host", filter: Filter{Host: "dev1"}, want: true},
+		{name: "otherHost", filter: Filter{Host: "dev2"}, want: false},
+		{name: "itemAndResult", filter: Filter{Item: "item1", Result: ResultDenied}, want: true},
+		{name: "otherResult", filter: Filter{Result: ResultAllowed}, want: false},
+		{name: "since", filter: Filter{Since: baseTime}, want: true},
+		{name: "until", filter: Filter{Until: baseTime}, want: false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.filter.match(&rec); got != tc.want {
+				t.Errorf("match mismatch, got=%v, want=%v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestClassify(t *testing.T) {
+	testCases := []struct {
+		err        error
+		wantResult string
+		wantReason string
+	}{
+		{err: nil, wantResult: ResultAllowed},
+		{err: fmt.Errorf("wrapped: %w", approval.ErrDenied), wantResult: ResultDenied, wantReason: "approval_denied"},
+		{err: internal.ErrBackendAuthorizationDismissed, wantResult: ResultDenied, wantReason: "approval_denied"},
+		{err: fmt.Errorf("%w: foo", internal.ErrItemNotFound), wantResult: ResultError, wantReason: "item_not_found"},
+		{err: fmt.Errorf("%w: vault is sealed", internal.ErrBackendNotSignedIn), wantResult: ResultError, wantReason: "backend_not_signed_in"},
+		{err: fmt.Errorf("failed to process query: secret"), wantResult: ResultError, wantReason: "error"},
+	}
+	for _, tc := range testCases {
+		result, reason := Classify(tc.err)
+		if result != tc.wantResult || reason != tc.wantReason {
+			t.Errorf("err=%v, got=(%s, %s), want=(%s, %s)", tc.err, result, reason, tc.wantResult, tc.wantReason)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+)
+
+type bitwardenItemGetter struct {
+	bwExePath string
+	session   string
+}
+
+// NewBitwardenItemGetter returns an ItemGetter which uses Bitwarden CLI.
+// If session is not empty, it is passed to bw as BW_SESSION, otherwise
+// bw uses BW_SESSION in the environment of this process.
+func NewBitwardenItemGetter(bwExePath, session string) (*bitwardenItemGetter, error) {
+	if _, err := exec.LookPath(bwExePath); err != nil {
+		return nil, fmt.Errorf("bw exe not found, err=%s", err)
+	}
+	return &bitwardenItemGetter{
+		bwExePath: bwExePath,
+		session:   session,
+	}, nil
+}
+
+func (g *bitwardenItemGetter) GetItem(ctx context.Context, itemName string) (string, error) {
+	cmd := exec.CommandContext(ctx, g.bwExePath, "get", "item", itemName, "--nointeraction")
+	if g.session != "" {
+		cmd.Env = append(cmd.Environ(), "BW_SESSION="+g.session)
+	}
+	output, err := cmd.Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) {
+			return "", fmt.Errorf("%w: failed to run bw, err=%s", ErrBackendUnavailable, err)
+		}
+		switch {
+		case bytes.HasPrefix(exitErr.Stderr, []byte("Not found.")):
+			return "", fmt.Errorf("%w: %s", ErrItemNotFound, itemName)
+		case bytes.HasPrefix(exitErr.Stderr, []byte("More than one result was found.")):
+			return "", fmt.Errorf("%w: more than one item matches %s, specify it with ID", ErrAmbiguousItem, itemName)
+		case bytes.HasPrefix(exitErr.Stderr, []byte("You are not logged in.")),
+			bytes.HasPrefix(exitErr.Stderr, []byte("Vault is locked.")):
+			return "", fmt.Errorf("%w: %s", ErrBackendNotSignedIn, bytes.TrimSpace(exitErr.Stderr))
+		}
+		return "", fmt.Errorf("failed to get item, err=%s", err)
+	}
+	item, err := convertBitwardenItem(output)
+	if err != nil {
+		return "", fmt.Errorf("failed to convert item, err=%s", err)
+	}
+	return item, nil
+}
+
+type bitwardenItem struct {
+	ID     string           `json:"id"`
+	Name   string           `json:"name"`
+	Notes  *string          `json:"notes"`
+	Login  *bitwardenLogin  `json:"login"`
+	Fields []bitwardenField `json:"fields"`
+}
+
+type bitwardenLogin struct {
+	Username *string `json:"username"`
+	Password *string `json:"password"`
+	TOTP     *string `json:"totp"`
+	URIs     []struct {
+		URI string `json:"uri"`
+	} `json:"uris"`
+}
+
+type bitwardenField struct {
+	Name  string  `json:"name"`
+	Value *string `json:"value"`
+	Type  int     `json:"type"`
+}
+
+// bitwardenFieldTypeHidden is the type of a hidden custom field.
+const bitwardenFieldTypeHidden = 1
+
+// convertBitwardenItem converts the output of "bw get item" to the item
+// JSON format of 1Password CLI. The login username and password become the
+// fields with the id "username" and "password", and custom fields become
+// fields whose id is the field name. Custom fields whose name is the id of
+// another field, such as "password", are skipped so that queries select only
+// one field by the id. The original item, including all custom fields, is
+// kept under the "bitwarden" key.
+func convertBitwardenItem(input []byte) (string, error) {
+	var item bitwardenItem
+	if err := json.Unmarshal(input, &item); err != nil {
+		return "", err
+	}
+	var raw any
+	if err := json.Unmarshal(input, &raw); err != nil {
+		return "", err
+	}
+
+	fields := []itemField{}
+	var urls []map[string]string
+	if item.Login != nil {
+		if item.Login.Username != nil {
+			fields = append(fields, itemField{
+				ID:      "username",
+				Type:    "STRING",
+				Purpose: "USERNAME",
+				Label:   "username",
+				Value:   *item.Login.Username,
+			})
+		}
+		if item.Login.Password != nil {
+			fields = append(fields, itemField{
+				ID:      "password",
+				Type:    "CONCEALED",
+				Purpose: "PASSWORD",
+				Label:   "password",
+				Value:   *item.Login.Password,
+			})
+		}
+		if item.Login.TOTP != nil {
+			fields = append(fields, itemField{
+				ID:    "totp",
+				Type:  "OTP",
+				Label: "totp",
+				Value: *item.Login.TOTP,
+			})
+		}
+		for _, u := range item.Login.URIs {
+			urls = append(urls, map[string]string{"href": u.URI})
+		}
+	}
+	if item.Notes != nil {
+		fields = append(fields, itemField{
+			ID:      "notesPlain",
+			Type:    "STRING",
+			Purpose: "NOTES",
+			Label:   "notesPlain",
+			Value:   *item.Notes,
+		})
+	}
+	ids := make(map[string]bool, len(fields))
+	for _, f := range fields {
+		ids[f.ID] = true
+	}
+	for _, f := range item.Fields {
+		if ids[f.Name] {
+			continue
+		}
+		typ := "STRING"
+		if f.Type == bitwardenFieldTypeHidden {
+			typ = "CONCEALED"
+		}
+		field := itemField{
+			ID:    f.Name,
+			Type:  typ,
+			Label: f.Name,
+		}
+		if f.Value != nil {
+			field.Value = *f.Value
+		}
+		fields = append(fields, field)
+	}
+
+	converted := map[string]any{
+		"id":        item.ID,
+		"title":     item.Name,
+		"fields":    fields,
+		"bitwarden": raw,
+	}
+	if len(urls) > 0 {
+		converted["urls"] = urls
+	}
+	output, err := json.Marshal(converted)
+	if err != nil {
+		return "", err
+	}
+	return string(output), nil
+}
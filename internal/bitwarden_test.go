@@ -0,0 +1,75 @@
+package internal
+
+import (
+	"context"
+	"testing"
+)
+
+const exampleBitwardenItem = `{
+  "object": "item",
+  "id": "id1",
+  "organizationId": null,
+  "folderId": null,
+  "type": 1,
+  "reprompt": 0,
+  "name": "test1",
+  "notes": "my note",
+  "favorite": false,
+  "fields": [
+    {"name": "api_key", "value": "my_api_key1", "type": 1, "linkedId": null},
+    {"name": "password", "value": "custom_password1", "type": 0, "linkedId": null}
+  ],
+  "login": {
+    "uris": [{"match": null, "uri": "https://example.com"}],
+    "username": "username1",
+    "password": "my_password1",
+    "totp": null,
+    "passwordRevisionDate": null
+  },
+  "collectionIds": [],
+  "revisionDate": "2025-06-20T10:46:56.000Z",
+  "creationDate": "2025-06-20T10:46:56.000Z",
+  "deletedDate": null
+}`
+
+func TestConvertBitwardenItem(t *testing.T) {
+	item, err := convertBitwardenItem([]byte(exampleBitwardenItem))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		query string
+		want  string
+	}{
+		{
+			query: `{"username": .fields[] | select(.id == "username").value, "password": .fields[] | select(.id == "password").value}`,
+			want:  canonicalizeJSON(t, `{"username":"username1","password":"my_password1"}`),
+		},
+		{
+			query: `.fields[] | select(.id == "api_key") | [.type, .value]`,
+			want:  canonicalizeJSON(t, `["CONCEALED","my_api_key1"]`),
+		},
+		{
+			query: `.fields[] | select(.purpose == "NOTES").value`,
+			want:  canonicalizeJSON(t, `"my note"`),
+		},
+		{
+			query: `[.title, .urls[0].href, .bitwarden.login.username]`,
+			want:  canonicalizeJSON(t, `["test1","https://example.com","username1"]`),
+		},
+		{
+			query: `[(.fields[] | select(.id == "password").value), .bitwarden.fields[1].value]`,
+			want:  canonicalizeJSON(t, `["my_password1","custom_password1"]`),
+		},
+	}
+	for _, tc := range testCases {
+		got, err := runQuery(context.Background(), tc.query, item, DefaultQueryLimits)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tc.want {
+			t.Errorf("result mismatch, query=%s, got=%s, want=%s", tc.query, got, tc.want)
+		}
+	}
+}
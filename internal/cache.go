@@ -0,0 +1,227 @@
+package internal
+
+import (
+	"cmp"
+	"container/list"
+	"context"
+	"fmt"
+	"path"
+	"slices"
+	"sync"
+	"time"
+)
+
+// ItemCacheConfig is the configuration of ItemCache.
+type ItemCacheConfig struct {
+	// TTL is the duration to keep an item in the cache. 0 disables caching
+	// items which do not match ItemTTLs.
+	TTL time.Duration
+	// ItemTTLs maps patterns of item names to TTLs used instead of TTL.
+	// Patterns are matched with path.Match. If more than one pattern
+	// matches, the longest one is used. 0 disables caching matched items.
+	ItemTTLs map[string]time.Duration
+	// MaxSize is the maximum total size of cached items in bytes. The least
+	// recently used items are evicted to keep it.
+	MaxSize int64
+}
+
+// ItemCache is an ItemGetter which keeps items got from another ItemGetter
+// in memory. Concurrent requests for the same item share one request to
+// the ItemGetter, which is cancelled when all of them are cancelled. Errors
+// are not cached.
+//
+// ItemCache does not protect items in memory. They are not locked against
+// swapping, and they are not erased reliably. Cached items are zeroed when
+// they are expired, evicted or invalidated, but the strings got from the
+// backend and returned from GetItem are copies which cannot be zeroed, and
+// stay in memory until the garbage collector reuses it.
+type ItemCache struct {
+	getter   ItemGetter
+	ttl      time.Duration
+	patterns []string
+	itemTTLs map[string]time.Duration
+	maxSize  int64
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+	size    int64
+	flights map[string]*cacheFlight
+	// gen is incremented on Invalidate, so that items got before that are
+	// not cached.
+	gen uint64
+}
+
+type cacheEntry struct {
+	name  string
+	item  []byte
+	timer *time.Timer
+}
+
+type cacheFlight struct {
+	done chan struct{}
+	item string
+	err  error
+	// waiters is the number of GetItem calls waiting for the item.
+	// ItemCache.mu must be held to access it.
+	waiters int
+	cancel  context.CancelFunc
+}
+
+// NewItemCache returns an ItemCache for getter.
+func NewItemCache(getter ItemGetter, cfg ItemCacheConfig) (*ItemCache, error) {
+	patterns := make([]string, 0, len(cfg.ItemTTLs))
+	for pattern := range cfg.ItemTTLs {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid item pattern %q for cache TTL, err=%s", pattern, err)
+		}
+		patterns = append(patterns, pattern)
+	}
+	// Longer patterns first, so that the first match is the most specific.
+	slices.SortFunc(patterns, func(a, b string) int {
+		if len(a) != len(b) {
+			return len(b) - len(a)
+		}
+		return cmp.Compare(a, b)
+	})
+	return &ItemCache{
+		getter:   getter,
+		ttl:      cfg.TTL,
+		patterns: patterns,
+		itemTTLs: cfg.ItemTTLs,
+		maxSize:  cfg.MaxSize,
+		entries:  make(map[string]*list.Element),
+		lru:      list.New(),
+		flights:  make(map[string]*cacheFlight),
+	}, nil
+}
+
+// itemTTL returns the TTL for the item.
+func (c *ItemCache) itemTTL(itemName string) time.Duration {
+	for _, pattern := range c.patterns {
+		if ok, _ := path.Match(pattern, itemName); ok {
+			return c.itemTTLs[pattern]
+		}
+	}
+	return c.ttl
+}
+
+func (c *ItemCache) GetItem(ctx context.Context, itemName string) (string, error) {
+	ttl := c.itemTTL(itemName)
+	if ttl <= 0 {
+		return c.getter.GetItem(ctx, itemName)
+	}
+
+	c.mu.Lock()
+	if elem, ok := c.entries[itemName]; ok {
+		c.lru.MoveToFront(elem)
+		// The string is a copy which is not zeroed with the entry.
+		item := string(elem.Value.(*cacheEntry).item)
+		c.mu.Unlock()
+		return item, nil
+	}
+	f, ok := c.flights[itemName]
+	if !ok {
+		// The item is got until all requests waiting it are done, not
+		// only the first one.
+		fetchCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		f = &cacheFlight{done: make(chan struct{}), cancel: cancel}
+		c.flights[itemName] = f
+		go c.fetch(fetchCtx, itemName, ttl, c.gen, f)
+	}
+	f.waiters++
+	c.mu.Unlock()
+
+	select {
+	case <-f.done:
+		return f.item, f.err
+	case <-ctx.Done():
+		c.mu.Lock()
+		f.waiters--
+		if f.waiters == 0 && c.flights[itemName] == f {
+			// Later requests start another request to the ItemGetter.
+			delete(c.flights, itemName)
+			f.cancel()
+		}
+		c.mu.Unlock()
+		return "", ctx.Err()
+	}
+}
+
+func (c *ItemCache) fetch(ctx context.Context, itemName string, ttl time.Duration, gen uint64, f *cacheFlight) {
+	f.item, f.err = c.getter.GetItem(ctx, itemName)
+	f.cancel()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.flights[itemName] != f {
+		// All requests waiting the item were cancelled.
+		close(f.done)
+		return
+	}
+	delete(c.flights, itemName)
+	// Close done after the item is cached, so that the item is cached when
+	// GetItem returns.
+	defer close(f.done)
+	if f.err != nil || gen != c.gen || int64(len(f.item)) > c.maxSize {
+		return
+	}
+	entry := &cacheEntry{name: itemName, item: []byte(f.item)}
+	elem := c.lru.PushFront(entry)
+	c.entries[itemName] = elem
+	c.size += int64(len(entry.item))
+	entry.timer = time.AfterFunc(ttl, func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		// The entry may have been removed and the item may have been
+		// cached again.
+		if c.entries[itemName] == elem {
+			c.remove(elem)
+		}
+	})
+	for c.size > c.maxSize {
+		c.remove(c.lru.Back())
+	}
+}
+
+// remove removes the entry in elem and zeroes the item. c.mu must be held.
+func (c *ItemCache) remove(elem *list.Element) {
+	entry := elem.Value.(*cacheEntry)
+	entry.timer.Stop()
+	c.lru.Remove(elem)
+	delete(c.entries, entry.name)
+	c.size -= int64(len(entry.item))
+	clear(entry.item)
+}
+
+// Invalidate removes items from the cache, or all items if itemNames is
+// empty, and returns the number of removed items. Items being got now are
+// not cached. IDs cached by the ItemGetter are forgotten too.
+func (c *ItemCache) Invalidate(itemNames ...string) int {
+	forgetIDs(c.getter)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	n := 0
+	if len(itemNames) == 0 {
+		for c.lru.Len() > 0 {
+			c.remove(c.lru.Back())
+			n++
+		}
+		return n
+	}
+	for _, name := range itemNames {
+		if elem, ok := c.entries[name]; ok {
+			c.remove(elem)
+			n++
+		}
+	}
+	return n
+}
+
+// forgetIDs calls ForgetIDs if getter implements IDForgetter.
+func forgetIDs(getter ItemGetter) {
+	if f, ok := getter.(IDForgetter); ok {
+		f.ForgetIDs()
+	}
+}
@@ -0,0 +1,226 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingItemGetter counts requests for items. If release is not nil,
+// requests wait it to be closed.
+type countingItemGetter struct {
+	calls   atomic.Int64
+	release chan struct{}
+}
+
+func (g *countingItemGetter) GetItem(ctx context.Context, itemName string) (string, error) {
+	n := g.calls.Add(1)
+	if g.release != nil {
+		<-g.release
+	}
+	if itemName == "no_such_item" {
+		return "", fmt.Errorf("%w: %s", ErrItemNotFound, itemName)
+	}
+	return fmt.Sprintf(`{"item":%q,"call":%d}`, itemName, n), nil
+}
+
+func TestItemCache(t *testing.T) {
+	getter := &countingItemGetter{}
+	cache, err := NewItemCache(getter, ItemCacheConfig{
+		TTL: time.Hour,
+		ItemTTLs: map[string]time.Duration{
+			"short/*":       50 * time.Millisecond,
+			"short/nocache": 0,
+		},
+		MaxSize: 1 << 20,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	get := func(itemName string) string {
+		t.Helper()
+		item, err := cache.GetItem(ctx, itemName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return item
+	}
+
+	if got, want := get("test1"), get("test1"); got != want {
+		t.Errorf("item should be cached, got=%s, want=%s", got, want)
+	}
+	if got, want := get("short/nocache"), get("short/nocache"); got == want {
+		t.Errorf("item should not be cached, got=%s", got)
+	}
+	short := get("short/test1")
+	if got := get("short/test1"); got != short {
+		t.Errorf("item should be cached before TTL, got=%s, want=%s", got, short)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if got := get("short/test1"); got == short {
+		t.Errorf("item should be expired after TTL, got=%s", got)
+	}
+
+	for range 2 {
+		if _, err := cache.GetItem(ctx, "no_such_item"); err == nil {
+			t.Fatal("should fail for an item which does not exist")
+		}
+	}
+	calls := getter.calls.Load()
+	if got, want := cache.Invalidate("test1", "no_such_item"), 1; got != want {
+		t.Errorf("invalidated count mismatch, got=%d, want=%d", got, want)
+	}
+	get("test1")
+	if got, want := getter.calls.Load(), calls+1; got != want {
+		t.Errorf("item should be got after invalidated, calls=%d, want=%d", got, want)
+	}
+	if got, want := cache.Invalidate(), 2; got != want {
+		t.Errorf("invalidated count mismatch, got=%d, want=%d", got, want)
+	}
+}
+
+func TestItemCacheMaxSize(t *testing.T) {
+	getter := &countingItemGetter{}
+	item, err := getter.GetItem(context.Background(), "test1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The cache holds 2 items.
+	cache, err := NewItemCache(getter, ItemCacheConfig{TTL: time.Hour, MaxSize: int64(len(item)) * 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for _, name := range []string{"test1", "test2", "test1", "test3"} {
+		if _, err := cache.GetItem(ctx, name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cache.mu.Lock()
+	evicted := cache.entries["test2"] == nil
+	buf := cache.entries["test1"].Value.(*cacheEntry).item
+	if !evicted || cache.entries["test3"] == nil {
+		t.Errorf("least recently used item should be evicted, entries=%d", len(cache.entries))
+	}
+	cache.mu.Unlock()
+	cache.Invalidate()
+	for _, b := range buf {
+		if b != 0 {
+			t.Fatalf("item should be zeroed after invalidated, got=%q", buf)
+		}
+	}
+}
+
+func TestItemCacheSingleFlight(t *testing.T) {
+	getter := &countingItemGetter{release: make(chan struct{})}
+	cache, err := NewItemCache(getter, ItemCacheConfig{TTL: time.Hour, MaxSize: 1 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const n = 10
+	items := make([]string, n)
+	var wg sync.WaitGroup
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			item, err := cache.GetItem(context.Background(), "test1")
+			if err != nil {
+				t.Error(err)
+			}
+			items[i] = item
+		}()
+	}
+	// Invalidating while the item is being got must not cache it.
+	for getter.calls.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	cache.Invalidate()
+	close(getter.release)
+	wg.Wait()
+
+	if got := getter.calls.Load(); got != 1 {
+		t.Errorf("concurrent requests should share one request, calls=%d", got)
+	}
+	for i := range items {
+		if items[i] != items[0] {
+			t.Errorf("item mismatch, got=%s, want=%s", items[i], items[0])
+		}
+	}
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if len(cache.entries) != 0 {
+		t.Error("item got before invalidated should not be cached")
+	}
+}
+
+// blockingItemGetter blocks until ctx is done, and sends the error of ctx to
+// errC.
+type blockingItemGetter struct {
+	started chan struct{}
+	errC    chan error
+}
+
+func (g *blockingItemGetter) GetItem(ctx context.Context, itemName string) (string, error) {
+	g.started <- struct{}{}
+	<-ctx.Done()
+	g.errC <- ctx.Err()
+	return "", ctx.Err()
+}
+
+func TestItemCacheCancel(t *testing.T) {
+	getter := &blockingItemGetter{started: make(chan struct{}, 2), errC: make(chan error, 2)}
+	cache, err := NewItemCache(getter, ItemCacheConfig{TTL: time.Hour, MaxSize: 1 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx1, cancel1 := context.WithCancel(context.Background())
+	ctx2, cancel2 := context.WithCancel(context.Background())
+	errC := make(chan error, 2)
+	go func() {
+		_, err := cache.GetItem(ctx1, "test1")
+		errC <- err
+	}()
+	<-getter.started
+	go func() {
+		_, err := cache.GetItem(ctx2, "test1")
+		errC <- err
+	}()
+	for {
+		cache.mu.Lock()
+		waiters := cache.flights["test1"].waiters
+		cache.mu.Unlock()
+		if waiters == 2 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// The request to the getter continues while another request waits.
+	cancel1()
+	if err := <-errC; !errors.Is(err, context.Canceled) {
+		t.Errorf("err mismatch, got=%v, want=%v", err, context.Canceled)
+	}
+	select {
+	case err := <-getter.errC:
+		t.Fatalf("request should not be cancelled while another request waits, err=%v", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	cancel2()
+	if err := <-errC; !errors.Is(err, context.Canceled) {
+		t.Errorf("err mismatch, got=%v, want=%v", err, context.Canceled)
+	}
+	select {
+	case <-getter.errC:
+	case <-time.After(10 * time.Second):
+		t.Fatal("request should be cancelled when all requests are cancelled")
+	}
+}
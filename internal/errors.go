@@ -0,0 +1,29 @@
+package internal
+
+import "errors"
+
+var (
+	// ErrItemNotFound is returned by an ItemGetter when the backend does not
+	// have the item.
+	ErrItemNotFound = errors.New("item not found")
+
+	// ErrAmbiguousItem is returned by an ItemGetter when more than one item
+	// matches the item name.
+	ErrAmbiguousItem = errors.New("ambiguous item")
+
+	// ErrBackendNotSignedIn is returned by an ItemGetter when the backend
+	// needs to be signed in or unlocked, or the credential for the backend
+	// is invalid or expired.
+	ErrBackendNotSignedIn = errors.New("backend not signed in")
+
+	// ErrBackendAuthorizationDismissed is returned by an ItemGetter when the
+	// human dismissed the authorization prompt of the backend, for example,
+	// the prompt of the 1Password desktop app. It is a denial by the human,
+	// so the ItemGetter must not sign in again.
+	ErrBackendAuthorizationDismissed = errors.New("backend authorization dismissed")
+
+	// ErrBackendUnavailable is returned by an ItemGetter when the backend
+	// cannot be used now, for example, the CLI is not installed or the server
+	// is not reachable.
+	ErrBackendUnavailable = errors.New("backend unavailable")
+)
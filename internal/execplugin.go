@@ -0,0 +1,162 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"slices"
+	"strings"
+)
+
+// An exec plugin is an external program which acts as an ItemGetter.
+// It allows to add a secret store without changing pipesecret.
+//
+// The plugin is executed as "<plugin> <method>" for each request.
+// The request is written to the stdin of the plugin as a JSON object,
+// and the plugin must write a response to the stdout as a JSON object and
+// exit with the status 0. The stderr of the plugin is used in the error
+// message if the plugin exits with a non-zero status.
+//
+// The "capabilities" method is called once when the plugin is set up.
+//
+//	request:  {"protocol_version": 1}
+//	response: {"protocol_version": 1, "methods": ["get"]}
+//
+// The "get" method is called for each item.
+//
+//	request:  {"protocol_version": 1, "item": "item name"}
+//	response: {"item": {...}}
+//
+// The item should be an object in the item JSON format of 1Password CLI,
+// so that the default query of the run subcommand works.
+//
+// A plugin reports an error with a response like below. See the
+// ExecPluginError* constants for codes.
+//
+//	{"error": {"code": "not_found", "message": "item not found: foo"}}
+const ExecPluginProtocolVersion = 1
+
+// Error codes of exec plugins.
+const (
+	ExecPluginErrorNotFound    = "not_found"
+	ExecPluginErrorAmbiguous   = "ambiguous"
+	ExecPluginErrorNotSignedIn = "not_signed_in"
+	ExecPluginErrorUnavailable = "unavailable"
+	ExecPluginErrorInternal    = "internal"
+)
+
+type execPluginItemGetter struct {
+	pluginPath string
+}
+
+type execPluginRequest struct {
+	ProtocolVersion int    `json:"protocol_version"`
+	Item            string `json:"item,omitempty"`
+}
+
+type execPluginResponse struct {
+	ProtocolVersion int              `json:"protocol_version,omitempty"`
+	Methods         []string         `json:"methods,omitempty"`
+	Item            json.RawMessage  `json:"item,omitempty"`
+	Error           *ExecPluginError `json:"error,omitempty"`
+}
+
+// ExecPluginError is an error reported by an exec plugin.
+type ExecPluginError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *ExecPluginError) Error() string {
+	return fmt.Sprintf("plugin error, code=%s, message=%s", e.Code, e.Message)
+}
+
+// Unwrap returns ErrItemNotFound, ErrAmbiguousItem, ErrBackendNotSignedIn or
+// ErrBackendUnavailable for corresponding codes so that callers can check
+// them with errors.Is.
+func (e *ExecPluginError) Unwrap() error {
+	switch e.Code {
+	case ExecPluginErrorNotFound:
+		return ErrItemNotFound
+	case ExecPluginErrorAmbiguous:
+		return ErrAmbiguousItem
+	case ExecPluginErrorNotSignedIn:
+		return ErrBackendNotSignedIn
+	case ExecPluginErrorUnavailable:
+		return ErrBackendUnavailable
+	default:
+		return nil
+	}
+}
+
+// NewExecPluginItemGetter returns an ItemGetter which executes the plugin
+// at pluginPath. It calls the capabilities method of the plugin to check
+// the plugin supports the protocol.
+func NewExecPluginItemGetter(ctx context.Context, pluginPath string) (*execPluginItemGetter, error) {
+	if _, err := exec.LookPath(pluginPath); err != nil {
+		return nil, fmt.Errorf("plugin exe not found, err=%s", err)
+	}
+	g := &execPluginItemGetter{
+		pluginPath: pluginPath,
+	}
+
+	resp, err := g.call(ctx, "capabilities", execPluginRequest{
+		ProtocolVersion: ExecPluginProtocolVersion,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get plugin capabilities, err=%s", err)
+	}
+	if resp.ProtocolVersion != ExecPluginProtocolVersion {
+		return nil, fmt.Errorf("unsupported plugin protocol version: %d", resp.ProtocolVersion)
+	}
+	if !slices.Contains(resp.Methods, "get") {
+		return nil, errors.New("plugin does not support get method")
+	}
+	return g, nil
+}
+
+func (g *execPluginItemGetter) GetItem(ctx context.Context, itemName string) (string, error) {
+	resp, err := g.call(ctx, "get", execPluginRequest{
+		ProtocolVersion: ExecPluginProtocolVersion,
+		Item:            itemName,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to get item, err=%w", err)
+	}
+	if len(resp.Item) == 0 || resp.Item[0] != '{' {
+		return "", errors.New("plugin returned an item which is not a JSON object")
+	}
+	return string(resp.Item), nil
+}
+
+func (g *execPluginItemGetter) call(ctx context.Context, method string, req execPluginRequest) (*execPluginResponse, error) {
+	input, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := exec.CommandContext(ctx, g.pluginPath, method)
+	cmd.Stdin = bytes.NewReader(input)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) {
+			return nil, fmt.Errorf("%w: failed to run plugin, err=%s", ErrBackendUnavailable, err)
+		}
+		return nil, fmt.Errorf("plugin failed, err=%s, stderr=%s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	var resp execPluginResponse
+	if err := json.Unmarshal(output, &resp); err != nil {
+		return nil, fmt.Errorf("failed to parse plugin response, err=%s", err)
+	}
+	if resp.Error != nil {
+		return nil, resp.Error
+	}
+	return &resp, nil
+}
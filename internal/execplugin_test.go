@@ -0,0 +1,70 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const examplePluginScript = `#!/bin/sh
+req=$(cat)
+case "$1" in
+capabilities)
+  echo '{"protocol_version":1,"methods":["get"]}'
+  ;;
+get)
+  case "$req" in
+  *'"item":"test1"'*)
+    echo '{"item":{"title":"test1","fields":[{"id":"username","label":"username","value":"username1"},{"id":"password","label":"password","value":"my_password1"}]}}'
+    ;;
+  *)
+    echo '{"error":{"code":"not_found","message":"item not found"}}'
+    ;;
+  esac
+  ;;
+*)
+  echo "unknown method: $1" >&2
+  exit 1
+  ;;
+esac
+`
+
+func TestExecPluginItemGetter(t *testing.T) {
+	pluginPath := filepath.Join(t.TempDir(), "pipesecret-backend-test")
+	if err := os.WriteFile(pluginPath, []byte(examplePluginScript), 0o700); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	getter, err := NewExecPluginItemGetter(ctx, pluginPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	item, err := getter.GetItem(ctx, "test1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := `{"username": .fields[] | select(.id == "username").value, "password": .fields[] | select(.id == "password").value}`
+	got, err := runQuery(context.Background(), query, item, DefaultQueryLimits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := canonicalizeJSON(t, `{"username":"username1","password":"my_password1"}`); got != want {
+		t.Errorf("result mismatch, got=%s, want=%s", got, want)
+	}
+
+	_, err = getter.GetItem(ctx, "no_such_item")
+	var pluginErr *ExecPluginError
+	if !errors.As(err, &pluginErr) {
+		t.Fatalf("error type mismatch, got=%T, want=%T", err, pluginErr)
+	}
+	if got, want := pluginErr.Code, ExecPluginErrorNotFound; got != want {
+		t.Errorf("error code mismatch, got=%s, want=%s", got, want)
+	}
+	if !errors.Is(err, ErrItemNotFound) {
+		t.Errorf("error should be ErrItemNotFound, got=%v", err)
+	}
+}
@@ -0,0 +1,53 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+type fallbackItemGetter struct {
+	getters         []ItemGetter
+	skipUnavailable bool
+}
+
+// NewFallbackItemGetter returns an ItemGetter which tries getters in order
+// and returns the item from the first getter which has it.
+//
+// When a getter returns ErrItemNotFound, the next getter is tried.
+// When a getter returns ErrBackendUnavailable, the next getter is tried if
+// skipUnavailable is true, otherwise the error is returned. Other errors are
+// returned without trying the rest of getters. When ctx is done, ctx.Err() is
+// returned without trying the rest of getters, since getters may return
+// ErrBackendUnavailable for requests cancelled by ctx.
+func NewFallbackItemGetter(getters []ItemGetter, skipUnavailable bool) *fallbackItemGetter {
+	return &fallbackItemGetter{
+		getters:         getters,
+		skipUnavailable: skipUnavailable,
+	}
+}
+
+func (g *fallbackItemGetter) GetItem(ctx context.Context, itemName string) (string, error) {
+	var unavailableErrs []error
+	for _, getter := range g.getters {
+		item, err := getter.GetItem(ctx, itemName)
+		switch {
+		case err == nil:
+			return item, nil
+		case ctx.Err() != nil:
+			return "", ctx.Err()
+		case errors.Is(err, ErrItemNotFound):
+			continue
+		case errors.Is(err, ErrBackendUnavailable) && g.skipUnavailable:
+			unavailableErrs = append(unavailableErrs, err)
+			continue
+		default:
+			return "", err
+		}
+	}
+	// If some backends were unavailable, they might have the item.
+	if len(unavailableErrs) > 0 {
+		return "", fmt.Errorf("item not found in available backends: %w", errors.Join(unavailableErrs...))
+	}
+	return "", fmt.Errorf("%w in any backend: %s", ErrItemNotFound, itemName)
+}
@@ -0,0 +1,73 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+type errItemGetter struct {
+	err error
+}
+
+func (g *errItemGetter) GetItem(ctx context.Context, itemName string) (string, error) {
+	return "", fmt.Errorf("%w: %s", g.err, itemName)
+}
+
+func TestFallbackItemGetter(t *testing.T) {
+	notFound := &errItemGetter{err: ErrItemNotFound}
+	unavailable := &errItemGetter{err: ErrBackendUnavailable}
+	other := &errItemGetter{err: errors.New("other error")}
+	found := &stubItemGetter{name: "found"}
+
+	testCases := []struct {
+		getters         []ItemGetter
+		skipUnavailable bool
+		want            string
+		wantErr         error
+	}{
+		{getters: []ItemGetter{notFound, found}, want: `{"backend":"found","item":"test1"}`},
+		{getters: []ItemGetter{notFound, notFound}, wantErr: ErrItemNotFound},
+		{getters: []ItemGetter{unavailable, found}, wantErr: ErrBackendUnavailable},
+		{getters: []ItemGetter{unavailable, found}, skipUnavailable: true, want: `{"backend":"found","item":"test1"}`},
+		{getters: []ItemGetter{unavailable, notFound}, skipUnavailable: true, wantErr: ErrBackendUnavailable},
+		{getters: []ItemGetter{other, found}, skipUnavailable: true, wantErr: other.err},
+	}
+	for i, tc := range testCases {
+		getter := NewFallbackItemGetter(tc.getters, tc.skipUnavailable)
+		got, err := getter.GetItem(context.Background(), "test1")
+		if tc.wantErr != nil {
+			if !errors.Is(err, tc.wantErr) {
+				t.Errorf("error mismatch, i=%d, got=%v, want=%v", i, err, tc.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tc.want {
+			t.Errorf("result mismatch, i=%d, got=%s, want=%s", i, got, tc.want)
+		}
+	}
+}
+
+// cancelItemGetter cancels the request and returns ErrBackendUnavailable like
+// HTTP backends do for cancelled requests.
+type cancelItemGetter struct {
+	cancel context.CancelFunc
+}
+
+func (g *cancelItemGetter) GetItem(ctx context.Context, itemName string) (string, error) {
+	g.cancel()
+	return "", fmt.Errorf("%w: %s", ErrBackendUnavailable, ctx.Err())
+}
+
+func TestFallbackItemGetterCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	getter := NewFallbackItemGetter([]ItemGetter{&cancelItemGetter{cancel: cancel}, &stubItemGetter{name: "found"}}, true)
+	if _, err := getter.GetItem(ctx, "test1"); !errors.Is(err, context.Canceled) {
+		t.Errorf("error mismatch, got=%v, want=%v", err, context.Canceled)
+	}
+}
@@ -0,0 +1,43 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+type fixtureItemGetter struct {
+	items map[string]json.RawMessage
+}
+
+// NewFixtureItemGetter returns an ItemGetter which reads items from a JSON
+// file whose keys are item names and whose values are items. It is meant
+// for tests and demos without a password manager.
+func NewFixtureItemGetter(path string) (*fixtureItemGetter, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read fixture file, err=%s", err)
+	}
+	var items map[string]json.RawMessage
+	if err := json.Unmarshal(data, &items); err != nil {
+		return nil, fmt.Errorf("failed to parse fixture file, err=%s", err)
+	}
+	return NewFixtureItemGetterFromMap(items), nil
+}
+
+// NewFixtureItemGetterFromMap returns an ItemGetter which returns items in
+// the map.
+func NewFixtureItemGetterFromMap(items map[string]json.RawMessage) *fixtureItemGetter {
+	return &fixtureItemGetter{
+		items: items,
+	}
+}
+
+func (g *fixtureItemGetter) GetItem(ctx context.Context, itemName string) (string, error) {
+	item, ok := g.items[itemName]
+	if !ok {
+		return "", fmt.Errorf("%w: %s", ErrItemNotFound, itemName)
+	}
+	return string(item), nil
+}
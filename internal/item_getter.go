@@ -2,23 +2,63 @@ package internal
 
 import (
 	"context"
-
-	"golang.org/x/exp/jsonrpc2"
-	errors "golang.org/x/xerrors"
+	"maps"
+	"slices"
+	"strings"
 )
 
 type ItemGetter interface {
 	GetItem(ctx context.Context, itemName string) (string, error)
 }
 
-func GetQueryItem(ctx context.Context, getter ItemGetter, itemName, query string) (string, error) {
-	item, err := getter.GetItem(ctx, itemName)
-	if err != nil {
-		return "", errors.Errorf("%w: %s", jsonrpc2.ErrInvalidRequest, err)
+// IDForgetter is implemented by ItemGetters which cache IDs of item names.
+// ItemCache.Invalidate calls ForgetIDs of its ItemGetter, so that renamed
+// items can be got with new names after invalidating the cache.
+type IDForgetter interface {
+	ForgetIDs()
+}
+
+// itemField is a field in the item JSON format of "op item get --format json".
+// Other backends convert their items to this format, so that the default
+// query of the run subcommand works regardless of the backend.
+type itemField struct {
+	ID      string `json:"id"`
+	Type    string `json:"type,omitempty"`
+	Purpose string `json:"purpose,omitempty"`
+	Label   string `json:"label"`
+	Value   any    `json:"value,omitempty"`
+}
+
+// mapToItemFields converts key-value pairs of a secret to fields sorted by
+// the key. Keys "username" and "password" are given the same type and purpose
+// as those of 1Password login items.
+func mapToItemFields(m map[string]any) []itemField {
+	fields := []itemField{}
+	for _, key := range slices.Sorted(maps.Keys(m)) {
+		field := itemField{
+			ID:    key,
+			Type:  "STRING",
+			Label: key,
+			Value: m[key],
+		}
+		switch strings.ToLower(key) {
+		case "username":
+			field.Purpose = "USERNAME"
+		case "password":
+			field.Type = "CONCEALED"
+			field.Purpose = "PASSWORD"
+		}
+		fields = append(fields, field)
 	}
-	result, err := runQuery(query, item)
+	return fields
+}
+
+// GetQueryItem gets the item and returns the result of query for the item.
+// The query is run in a restricted environment bound by limits.
+func GetQueryItem(ctx context.Context, getter ItemGetter, itemName, query string, limits QueryLimits) (string, error) {
+	item, err := getter.GetItem(ctx, itemName)
 	if err != nil {
-		return "", errors.Errorf("%w: %s", jsonrpc2.ErrInvalidRequest, err)
+		return "", err
 	}
-	return result, nil
+	return runQuery(ctx, query, item, limits)
 }
@@ -4,9 +4,12 @@ import (
 	"encoding/json"
 	"log/slog"
 
+	"github.com/hnakamur/pipesecret/internal/redact"
 	"golang.org/x/exp/jsonrpc2"
 )
 
+// DebugMarshalMessage logs a JSON-RPC message as JSON with secret values
+// such as results of responses masked.
 type DebugMarshalMessage struct {
 	Msg jsonrpc2.Message
 }
@@ -14,13 +17,13 @@ type DebugMarshalMessage struct {
 func (m DebugMarshalMessage) LogValue() slog.Value {
 	jsonBytes, err := jsonrpc2.EncodeMessage(m.Msg)
 	if err != nil {
-		panic(err)
+		return slog.StringValue("failed to encode message: " + err.Error())
 	}
 
 	var obj any
 	if err := json.Unmarshal(jsonBytes, &obj); err != nil {
-		panic(err)
+		return slog.StringValue("failed to decode message: " + err.Error())
 	}
 
-	return slog.AnyValue(obj)
+	return slog.AnyValue(redact.Value(obj))
 }
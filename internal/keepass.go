@@ -0,0 +1,216 @@
+package internal
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/tobischo/gokeepasslib/v3"
+)
+
+type keePassItemGetter struct {
+	entries []keePassEntry
+}
+
+type keePassEntry struct {
+	path  string
+	title string
+	item  string
+}
+
+// NewKeePassItemGetter returns an ItemGetter which reads entries from
+// a KeePass database file. The database is decrypted only once here and
+// the entries are kept in memory, so changes to the file after this are
+// not reflected.
+//
+// If keyfilePath is empty, the database is unlocked with password only.
+// If both password and keyfilePath are specified, both are used.
+// If only keyfilePath is specified, the key file only is used.
+func NewKeePassItemGetter(dbPath, password, keyfilePath string) (*keePassItemGetter, error) {
+	var credentials *gokeepasslib.DBCredentials
+	switch {
+	case keyfilePath == "":
+		credentials = gokeepasslib.NewPasswordCredentials(password)
+	case password == "":
+		var err error
+		credentials, err = gokeepasslib.NewKeyCredentials(keyfilePath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read keyfile, err=%s", err)
+		}
+	default:
+		var err error
+		credentials, err = gokeepasslib.NewPasswordAndKeyCredentials(password, keyfilePath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read keyfile, err=%s", err)
+		}
+	}
+
+	file, err := os.Open(dbPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open keepass database, err=%s", err)
+	}
+	defer file.Close()
+
+	db := gokeepasslib.NewDatabase()
+	db.Credentials = credentials
+	if err := gokeepasslib.NewDecoder(file).Decode(db); err != nil {
+		return nil, fmt.Errorf("failed to decode keepass database, err=%s", err)
+	}
+	if err := db.UnlockProtectedEntries(); err != nil {
+		return nil, fmt.Errorf("failed to unlock protected entries, err=%s", err)
+	}
+
+	g := &keePassItemGetter{}
+	var recycleBinUUID *gokeepasslib.UUID
+	if meta := db.Content.Meta; meta != nil && meta.RecycleBinEnabled.Bool {
+		recycleBinUUID = &meta.RecycleBinUUID
+	}
+	for _, root := range db.Content.Root.Groups {
+		// Paths do not include the name of the root group like keepassxc-cli.
+		if err := g.addGroup(db, &root, "", recycleBinUUID); err != nil {
+			return nil, err
+		}
+	}
+	return g, nil
+}
+
+func (g *keePassItemGetter) addGroup(db *gokeepasslib.Database, group *gokeepasslib.Group, groupPath string, recycleBinUUID *gokeepasslib.UUID) error {
+	if recycleBinUUID != nil && group.UUID.Compare(*recycleBinUUID) {
+		return nil
+	}
+	for i := range group.Entries {
+		entry := &group.Entries[i]
+		path := groupPath + entry.GetTitle()
+		item, err := convertKeePassEntry(db, entry, path)
+		if err != nil {
+			return fmt.Errorf("failed to convert entry %s, err=%s", path, err)
+		}
+		g.entries = append(g.entries, keePassEntry{
+			path:  path,
+			title: entry.GetTitle(),
+			item:  item,
+		})
+	}
+	for i := range group.Groups {
+		subgroup := &group.Groups[i]
+		if err := g.addGroup(db, subgroup, groupPath+subgroup.Name+"/", recycleBinUUID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetItem returns the entry whose path is itemName. If no entry has
+// the path, it returns the entry whose title is itemName if the title is
+// unique in the database.
+func (g *keePassItemGetter) GetItem(ctx context.Context, itemName string) (string, error) {
+	var found []*keePassEntry
+	for i := range g.entries {
+		entry := &g.entries[i]
+		if entry.path == itemName {
+			return entry.item, nil
+		}
+		if entry.title == itemName {
+			found = append(found, entry)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return "", fmt.Errorf("%w: %s", ErrItemNotFound, itemName)
+	case 1:
+		return found[0].item, nil
+	default:
+		paths := make([]string, len(found))
+		for i, entry := range found {
+			paths[i] = entry.path
+		}
+		return "", fmt.Errorf("%w: more than one item matches %s, specify one of paths: %s",
+			ErrAmbiguousItem, itemName, strings.Join(paths, ", "))
+	}
+}
+
+// convertKeePassEntry converts an entry to the item JSON format of
+// 1Password CLI. Attachments are put in the "attachments" array with
+// base64 encoded contents.
+func convertKeePassEntry(db *gokeepasslib.Database, entry *gokeepasslib.Entry, path string) (string, error) {
+	uuid, err := entry.UUID.MarshalText()
+	if err != nil {
+		return "", err
+	}
+
+	fields := []itemField{}
+	var urls []map[string]string
+	for _, v := range entry.Values {
+		field := itemField{
+			ID:    v.Key,
+			Type:  "STRING",
+			Label: v.Key,
+			Value: v.Value.Content,
+		}
+		if v.Value.Protected.Bool {
+			field.Type = "CONCEALED"
+		}
+		switch v.Key {
+		case "Title":
+			continue
+		case "UserName":
+			field.ID = "username"
+			field.Purpose = "USERNAME"
+		case "Password":
+			field.ID = "password"
+			field.Type = "CONCEALED"
+			field.Purpose = "PASSWORD"
+		case "URL":
+			field.ID = "url"
+			if v.Value.Content != "" {
+				urls = append(urls, map[string]string{"href": v.Value.Content})
+			}
+		case "Notes":
+			field.ID = "notesPlain"
+			field.Purpose = "NOTES"
+		}
+		fields = append(fields, field)
+	}
+
+	attachments := []map[string]any{}
+	for _, ref := range entry.Binaries {
+		binary := ref.Find(db)
+		if binary == nil {
+			return "", fmt.Errorf("attachment not found: %s", ref.Name)
+		}
+		content, err := binary.GetContentBytes()
+		if err != nil {
+			return "", fmt.Errorf("failed to read attachment %s, err=%s", ref.Name, err)
+		}
+		attachments = append(attachments, map[string]any{
+			"name":           ref.Name,
+			"size":           len(content),
+			"content_base64": base64.StdEncoding.EncodeToString(content),
+		})
+	}
+
+	var tags []string
+	for _, tag := range strings.FieldsFunc(entry.Tags, func(r rune) bool { return r == ';' || r == ',' }) {
+		tags = append(tags, strings.TrimSpace(tag))
+	}
+
+	converted := map[string]any{
+		"id":          string(uuid),
+		"title":       entry.GetTitle(),
+		"path":        path,
+		"tags":        tags,
+		"fields":      fields,
+		"attachments": attachments,
+	}
+	if len(urls) > 0 {
+		converted["urls"] = urls
+	}
+	output, err := json.Marshal(converted)
+	if err != nil {
+		return "", err
+	}
+	return string(output), nil
+}
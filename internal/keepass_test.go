@@ -0,0 +1,131 @@
+package internal
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/tobischo/gokeepasslib/v3"
+	w "github.com/tobischo/gokeepasslib/v3/wrappers"
+)
+
+func TestKeePassItemGetter(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test.kdbx")
+	writeKeePassFixture(t, dbPath, "master_password1")
+
+	if _, err := NewKeePassItemGetter(dbPath, "wrong_password", ""); err == nil {
+		t.Fatal("should fail with wrong password")
+	}
+	getter, err := NewKeePassItemGetter(dbPath, "master_password1", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		itemName string
+		query    string
+		want     string
+	}{
+		{
+			itemName: "web/test1",
+			query:    `{"username": .fields[] | select(.id == "username").value, "password": .fields[] | select(.id == "password").value}`,
+			want:     canonicalizeJSON(t, `{"username":"username1","password":"my_password1"}`),
+		},
+		{
+			itemName: "test1",
+			query:    `[.path, (.fields[] | select(.id == "api_key") | .type, .value), .tags]`,
+			want:     canonicalizeJSON(t, `["web/test1","CONCEALED","my_api_key1",["ci","web"]]`),
+		},
+		{
+			itemName: "test1",
+			query:    `.attachments[0] | [.name, (.content_base64 | @base64d)]`,
+			want:     canonicalizeJSON(t, `["cert.pem","my_cert1"]`),
+		},
+		{
+			itemName: "db/test2",
+			query:    `.fields[] | select(.id == "password").value`,
+			want:     canonicalizeJSON(t, `"my_password2"`),
+		},
+	}
+	for _, tc := range testCases {
+		item, err := getter.GetItem(context.Background(), tc.itemName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := runQuery(context.Background(), tc.query, item, DefaultQueryLimits)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tc.want {
+			t.Errorf("result mismatch, itemName=%s, query=%s, got=%s, want=%s",
+				tc.itemName, tc.query, got, tc.want)
+		}
+	}
+
+	// "dup" is the title of two entries, so it is ambiguous.
+	for _, itemName := range []string{"no_such_item", "dup"} {
+		if _, err := getter.GetItem(context.Background(), itemName); err == nil {
+			t.Errorf("should fail for itemName=%s", itemName)
+		}
+	}
+}
+
+func writeKeePassFixture(t *testing.T, dbPath, password string) {
+	t.Helper()
+
+	newValue := func(key, value string, protected bool) gokeepasslib.ValueData {
+		return gokeepasslib.ValueData{
+			Key:   key,
+			Value: gokeepasslib.V{Content: value, Protected: w.NewBoolWrapper(protected)},
+		}
+	}
+
+	db := gokeepasslib.NewDatabase(gokeepasslib.WithDatabaseKDBXVersion4())
+	db.Content.Meta.DatabaseName = "test"
+	db.Credentials = gokeepasslib.NewPasswordCredentials(password)
+
+	cert := db.AddBinary([]byte("my_cert1"))
+	entry1 := gokeepasslib.NewEntry()
+	entry1.Tags = "ci;web"
+	entry1.Values = []gokeepasslib.ValueData{
+		newValue("Title", "test1", false),
+		newValue("UserName", "username1", false),
+		newValue("Password", "my_password1", true),
+		newValue("api_key", "my_api_key1", true),
+	}
+	entry1.Binaries = []gokeepasslib.BinaryReference{cert.CreateReference("cert.pem")}
+	dup1 := gokeepasslib.NewEntry()
+	dup1.Values = []gokeepasslib.ValueData{newValue("Title", "dup", false)}
+	web := gokeepasslib.NewGroup()
+	web.Name = "web"
+	web.Entries = []gokeepasslib.Entry{entry1, dup1}
+
+	entry2 := gokeepasslib.NewEntry()
+	entry2.Values = []gokeepasslib.ValueData{
+		newValue("Title", "test2", false),
+		newValue("Password", "my_password2", true),
+	}
+	dup2 := gokeepasslib.NewEntry()
+	dup2.Values = []gokeepasslib.ValueData{newValue("Title", "dup", false)}
+	dbGroup := gokeepasslib.NewGroup()
+	dbGroup.Name = "db"
+	dbGroup.Entries = []gokeepasslib.Entry{entry2, dup2}
+
+	root := gokeepasslib.NewGroup()
+	root.Name = "Root"
+	root.Groups = []gokeepasslib.Group{web, dbGroup}
+	db.Content.Root = &gokeepasslib.RootData{Groups: []gokeepasslib.Group{root}}
+
+	if err := db.LockProtectedEntries(); err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.Create(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if err := gokeepasslib.NewEncoder(file).Encode(db); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -1,29 +1,212 @@
 package internal
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"os"
 	"os/exec"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hnakamur/pipesecret/internal/terminal"
 )
 
+// OnePasswordSignIn is the configuration to sign in to 1Password again on
+// the terminal of serve when op is not signed in, for example, the session
+// has expired.
+type OnePasswordSignIn struct {
+	// Command is the command and arguments to sign in. If empty,
+	// "op signin" is used. It runs with the terminal as stdin and stderr,
+	// and lines like `export OP_SESSION_my="..."` in stdout set
+	// environment variables for op.
+	Command []string
+	// Timeout is the maximum duration to wait for signing in.
+	Timeout time.Duration
+}
+
 type onePasswordItemGetter struct {
 	opExePath string
+	signIn    *OnePasswordSignIn
+	// ttyPath is the path of the terminal to sign in.
+	ttyPath string
+
+	// signInC is a semaphore to sign in one at a time.
+	signInC chan struct{}
+	mu      sync.Mutex
+	// env is environment variables for op set by signing in.
+	env []string
+	// signInGen is incremented after signing in, so that requests which
+	// failed before that retry without signing in again.
+	signInGen uint64
 }
 
-func NewOnePasswordItemGetter(opExePath string) (*onePasswordItemGetter, error) {
+// NewOnePasswordItemGetter returns an ItemGetter which runs the 1Password CLI
+// at opExePath. If signIn is not nil, it signs in again and retries
+// a request which failed because op is not signed in.
+func NewOnePasswordItemGetter(opExePath string, signIn *OnePasswordSignIn) (*onePasswordItemGetter, error) {
 	if _, err := exec.LookPath(opExePath); err != nil {
 		return nil, fmt.Errorf("op exe not found, err=%s", err)
 	}
 	return &onePasswordItemGetter{
 		opExePath: opExePath,
+		signIn:    signIn,
+		ttyPath:   "/dev/tty",
+		signInC:   make(chan struct{}, 1),
 	}, nil
 }
 
 func (g *onePasswordItemGetter) GetItem(ctx context.Context, itemName string) (string, error) {
+	g.mu.Lock()
+	gen := g.signInGen
+	g.mu.Unlock()
+
+	item, err := g.getItem(ctx, itemName)
+	if g.signIn == nil || !errors.Is(err, ErrBackendNotSignedIn) {
+		return item, err
+	}
+	if err := g.signInAgain(ctx, gen, err); err != nil {
+		return "", err
+	}
+	return g.getItem(ctx, itemName)
+}
+
+func (g *onePasswordItemGetter) getItem(ctx context.Context, itemName string) (string, error) {
 	cmd := exec.CommandContext(ctx, g.opExePath, "item", "get", itemName, "--format", "json")
+	g.mu.Lock()
+	if len(g.env) > 0 {
+		cmd.Env = append(cmd.Environ(), g.env...)
+	}
+	g.mu.Unlock()
 	output, err := cmd.Output()
 	if err != nil {
-		return "", fmt.Errorf("failed to get item, err=%s", err)
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) {
+			return "", fmt.Errorf("%w: failed to run op, err=%s", ErrBackendUnavailable, err)
+		}
+		return "", classifyOnePasswordError(itemName, exitErr)
 	}
 	return string(output), nil
 }
+
+// onePasswordLockedRegexp matches messages of op when the desktop app or the
+// account is locked.
+var onePasswordLockedRegexp = regexp.MustCompile(`(?i)\b(1password|app|account) is locked\b`)
+
+// classifyOnePasswordError returns an error for stderr of op which exited
+// with a non-zero status.
+func classifyOnePasswordError(itemName string, exitErr *exec.ExitError) error {
+	stderr := string(bytes.TrimSpace(exitErr.Stderr))
+	lower := strings.ToLower(stderr)
+	switch {
+	case strings.Contains(stderr, "isn't an item"):
+		return fmt.Errorf("%w: %s", ErrItemNotFound, itemName)
+	case strings.Contains(stderr, "More than one item matches"):
+		return fmt.Errorf("%w: more than one item matches %s, specify it with ID", ErrAmbiguousItem, itemName)
+	case strings.Contains(lower, "session expired"):
+		return fmt.Errorf("%w: 1Password session expired, stderr=%s", ErrBackendNotSignedIn, stderr)
+	case strings.Contains(lower, "authorization prompt dismissed"):
+		return fmt.Errorf("%w: 1Password authorization prompt was dismissed", ErrBackendAuthorizationDismissed)
+	case strings.Contains(lower, "not currently signed in"),
+		strings.Contains(lower, "not signed in"):
+		return fmt.Errorf("%w: 1Password CLI is not signed in, stderr=%s", ErrBackendNotSignedIn, stderr)
+	case onePasswordLockedRegexp.MatchString(stderr):
+		return fmt.Errorf("%w: 1Password is locked, stderr=%s", ErrBackendNotSignedIn, stderr)
+	}
+	return fmt.Errorf("failed to get item, err=%s, stderr=%s", exitErr, stderr)
+}
+
+// signInAgain signs in on the terminal unless signed in after gen. cause is
+// the error of the request which needs signing in.
+func (g *onePasswordItemGetter) signInAgain(ctx context.Context, gen uint64, cause error) error {
+	select {
+	case g.signInC <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { <-g.signInC }()
+
+	g.mu.Lock()
+	signedIn := g.signInGen != gen
+	g.mu.Unlock()
+	if signedIn {
+		// Another request has signed in while waiting.
+		return nil
+	}
+
+	env, err := g.runSignIn(ctx, cause)
+	if err != nil {
+		return fmt.Errorf("%w: failed to sign in to 1Password, err=%s", ErrBackendNotSignedIn, err)
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.env = mergeEnv(g.env, env)
+	g.signInGen++
+	return nil
+}
+
+func (g *onePasswordItemGetter) runSignIn(ctx context.Context, cause error) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, g.signIn.Timeout)
+	defer cancel()
+	unlock, err := terminal.Lock(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("terminal is used by another prompt, err=%s", err)
+	}
+	defer unlock()
+
+	tty, err := os.OpenFile(g.ttyPath, os.O_RDWR, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open terminal, err=%s", err)
+	}
+	defer tty.Close()
+
+	args := g.signIn.Command
+	if len(args) == 0 {
+		args = []string{g.opExePath, "signin"}
+	}
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stdin = tty
+	cmd.Stderr = tty
+	fmt.Fprintf(tty, "\npipesecret: %s\npipesecret: running %q to sign in again\n", cause, strings.Join(args, " "))
+	output, err := cmd.Output()
+	if err != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return nil, fmt.Errorf("not signed in within %s", g.signIn.Timeout)
+		}
+		return nil, err
+	}
+	return parseSessionExports(output), nil
+}
+
+var sessionExportRegexp = regexp.MustCompile(`^export (OP_SESSION_\w+)="?([^"]*)"?$`)
+
+// parseSessionExports returns environment variables in lines like
+// `export OP_SESSION_my="..."` which "op signin" writes. Other lines are
+// ignored. Signing in with the desktop app integration writes nothing.
+func parseSessionExports(output []byte) []string {
+	var env []string
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		if m := sessionExportRegexp.FindStringSubmatch(strings.TrimSpace(scanner.Text())); m != nil {
+			env = append(env, m[1]+"="+m[2])
+		}
+	}
+	return env
+}
+
+// mergeEnv returns env with variables in added, which replace variables of
+// the same names in env.
+func mergeEnv(env, added []string) []string {
+	merged := slices.DeleteFunc(slices.Clone(env), func(kv string) bool {
+		name, _, _ := strings.Cut(kv, "=")
+		return slices.ContainsFunc(added, func(a string) bool {
+			return strings.HasPrefix(a, name+"=")
+		})
+	})
+	return append(merged, added...)
+}
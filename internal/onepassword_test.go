@@ -0,0 +1,164 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hnakamur/pipesecret/internal/terminal"
+)
+
+// exampleOpScript is a fake op which is signed in when OP_SESSION_my is set.
+// signin appends a line to the file in $SIGNIN_LOG.
+const exampleOpScript = `#!/bin/sh
+case "$1" in
+item)
+  if [ "$OP_SESSION_my" != "token1" ]; then
+    echo '[ERROR] 2025/01/01 00:00:00 You are not currently signed in. Please run "op signin --help" for instructions' >&2
+    exit 1
+  fi
+  case "$3" in
+  test1)
+    echo '{"title":"test1","fields":[{"id":"password","label":"password","value":"my_password1"}]}'
+    ;;
+  *)
+    echo "[ERROR] 2025/01/01 00:00:00 \"$3\" isn't an item. Specify the item with its UUID, name, or domain." >&2
+    exit 1
+    ;;
+  esac
+  ;;
+signin)
+  echo signin >> "$SIGNIN_LOG"
+  echo 'export OP_SESSION_my="token1"'
+  echo '# This command is meant to be used with your shell'"'"'s eval function.'
+  ;;
+esac
+`
+
+func newTestOnePasswordItemGetter(t *testing.T, signIn *OnePasswordSignIn) (*onePasswordItemGetter, string) {
+	t.Helper()
+	dir := t.TempDir()
+	opPath := filepath.Join(dir, "op")
+	if err := os.WriteFile(opPath, []byte(exampleOpScript), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	signInLog := filepath.Join(dir, "signin.log")
+	t.Setenv("SIGNIN_LOG", signInLog)
+	t.Setenv("OP_SESSION_my", "")
+	g, err := NewOnePasswordItemGetter(opPath, signIn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.ttyPath = os.DevNull
+	return g, signInLog
+}
+
+func TestOnePasswordItemGetterNotSignedIn(t *testing.T) {
+	g, _ := newTestOnePasswordItemGetter(t, nil)
+	_, err := g.GetItem(context.Background(), "test1")
+	if !errors.Is(err, ErrBackendNotSignedIn) {
+		t.Errorf("error mismatch, got=%v, want=%v", err, ErrBackendNotSignedIn)
+	}
+}
+
+func TestOnePasswordItemGetterSignIn(t *testing.T) {
+	g, signInLog := newTestOnePasswordItemGetter(t, &OnePasswordSignIn{Timeout: 10 * time.Second})
+	ctx := context.Background()
+
+	const n = 5
+	var wg sync.WaitGroup
+	for range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			item, err := g.GetItem(ctx, "test1")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if !strings.Contains(item, "my_password1") {
+				t.Errorf("unexpected item, got=%s", item)
+			}
+		}()
+	}
+	wg.Wait()
+
+	log, err := os.ReadFile(signInLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Count(string(log), "signin"); got != 1 {
+		t.Errorf("concurrent requests should sign in once, got=%d", got)
+	}
+
+	if _, err := g.GetItem(ctx, "no_such_item"); !errors.Is(err, ErrItemNotFound) {
+		t.Errorf("error mismatch, got=%v, want=%v", err, ErrItemNotFound)
+	}
+}
+
+func TestOnePasswordItemGetterSignInFailed(t *testing.T) {
+	g, _ := newTestOnePasswordItemGetter(t, &OnePasswordSignIn{
+		Command: []string{"false"},
+		Timeout: 10 * time.Second,
+	})
+	_, err := g.GetItem(context.Background(), "test1")
+	if !errors.Is(err, ErrBackendNotSignedIn) {
+		t.Errorf("error mismatch, got=%v, want=%v", err, ErrBackendNotSignedIn)
+	}
+}
+
+func TestOnePasswordItemGetterSignInWaitsTerminal(t *testing.T) {
+	g, _ := newTestOnePasswordItemGetter(t, &OnePasswordSignIn{Timeout: 50 * time.Millisecond})
+	// Another prompt, for example an approval prompt, uses the terminal.
+	unlock, err := terminal.Lock(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = g.GetItem(context.Background(), "test1")
+	if !errors.Is(err, ErrBackendNotSignedIn) {
+		t.Errorf("error mismatch, got=%v, want=%v", err, ErrBackendNotSignedIn)
+	}
+	unlock()
+
+	if _, err := g.GetItem(context.Background(), "test1"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestClassifyOnePasswordError(t *testing.T) {
+	testCases := []struct {
+		stderr string
+		want   error
+	}{
+		{stderr: `[ERROR] "test1" isn't an item.`, want: ErrItemNotFound},
+		{stderr: `[ERROR] More than one item matches "test1".`, want: ErrAmbiguousItem},
+		{stderr: `[ERROR] You are not currently signed in.`, want: ErrBackendNotSignedIn},
+		{stderr: `[ERROR] error initializing client: Your session expired.`, want: ErrBackendNotSignedIn},
+		{stderr: `[ERROR] error initializing client: authorization prompt dismissed, please try again`, want: ErrBackendAuthorizationDismissed},
+		{stderr: `[ERROR] 1Password is locked.`, want: ErrBackendNotSignedIn},
+		{stderr: `[ERROR] connecting to desktop app: 1Password app is locked`, want: ErrBackendNotSignedIn},
+		{stderr: `[ERROR] database is locked by another process`, want: nil},
+	}
+	for _, tc := range testCases {
+		g, _ := newTestOnePasswordItemGetter(t, nil)
+		script := "#!/bin/sh\ncat >&2 <<'EOF'\n" + tc.stderr + "\nEOF\nexit 1\n"
+		if err := os.WriteFile(g.opExePath, []byte(script), 0o700); err != nil {
+			t.Fatal(err)
+		}
+		_, err := g.GetItem(context.Background(), "test1")
+		if tc.want == nil {
+			if err == nil || errors.Is(err, ErrBackendNotSignedIn) {
+				t.Errorf("should be another error for %q, got=%v", tc.stderr, err)
+			}
+			continue
+		}
+		if !errors.Is(err, tc.want) {
+			t.Errorf("error mismatch for %q, got=%v, want=%v", tc.stderr, err, tc.want)
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+type onePasswordConnectItemGetter struct {
+	host         string
+	token        string
+	defaultVault string
+	httpClient   *http.Client
+
+	mu       sync.Mutex
+	vaultIDs map[string]string
+	itemIDs  map[onePasswordConnectItemKey]string
+}
+
+type onePasswordConnectItemKey struct {
+	vaultID string
+	title   string
+}
+
+// onePasswordIDRegexp matches IDs of vaults and items in 1Password.
+var onePasswordIDRegexp = regexp.MustCompile(`^[a-z0-9]{26}$`)
+
+// NewOnePasswordConnectItemGetter returns an ItemGetter which gets items
+// from a 1Password Connect server with the REST API.
+//
+// An item name is "vault/item" or "item". For the latter, defaultVault is
+// used as the vault. Both vault and item can be a title or an ID. Mappings
+// from titles to IDs are cached. They are looked up again once when the item
+// is not found with cached IDs, and forgotten by ForgetIDs.
+func NewOnePasswordConnectItemGetter(host, token, defaultVault string, httpClient *http.Client) (*onePasswordConnectItemGetter, error) {
+	if host == "" {
+		return nil, errors.New("1Password Connect host must not be empty")
+	}
+	if _, err := url.Parse(host); err != nil {
+		return nil, fmt.Errorf("invalid 1Password Connect host, err=%s", err)
+	}
+	if token == "" {
+		return nil, errors.New("1Password Connect token must not be empty")
+	}
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return &onePasswordConnectItemGetter{
+		host:         strings.TrimRight(host, "/"),
+		token:        token,
+		defaultVault: defaultVault,
+		httpClient:   httpClient,
+		vaultIDs:     make(map[string]string),
+		itemIDs:      make(map[onePasswordConnectItemKey]string),
+	}, nil
+}
+
+func (g *onePasswordConnectItemGetter) GetItem(ctx context.Context, itemName string) (string, error) {
+	vault, title, found := strings.Cut(itemName, "/")
+	if !found {
+		if g.defaultVault == "" {
+			return "", fmt.Errorf("item name must be vault/item since default vault is not configured: %s", itemName)
+		}
+		vault, title = g.defaultVault, itemName
+	}
+
+	vaultID, cached, err := g.resolveVaultID(ctx, vault)
+	if err != nil {
+		return "", err
+	}
+	item, err := g.getItemInVault(ctx, vaultID, title)
+	if errors.Is(err, ErrItemNotFound) && cached {
+		// The vault may have been renamed, or deleted and recreated.
+		g.forgetVaultID(vault)
+		if vaultID, _, err = g.resolveVaultID(ctx, vault); err != nil {
+			return "", err
+		}
+		item, err = g.getItemInVault(ctx, vaultID, title)
+	}
+	return item, err
+}
+
+func (g *onePasswordConnectItemGetter) getItemInVault(ctx context.Context, vaultID, title string) (string, error) {
+	itemID, cached, err := g.resolveItemID(ctx, vaultID, title)
+	if err != nil {
+		return "", err
+	}
+	body, err := g.get(ctx, "/v1/vaults/"+url.PathEscape(vaultID)+"/items/"+url.PathEscape(itemID), nil)
+	if errors.Is(err, ErrItemNotFound) && cached {
+		// The item may have been deleted and recreated with the same title.
+		g.forgetItemID(vaultID, title)
+		if itemID, _, err = g.resolveItemID(ctx, vaultID, title); err != nil {
+			return "", err
+		}
+		body, err = g.get(ctx, "/v1/vaults/"+url.PathEscape(vaultID)+"/items/"+url.PathEscape(itemID), nil)
+	}
+	if err != nil {
+		return "", err
+	}
+	return string(body), nil
+}
+
+func (g *onePasswordConnectItemGetter) resolveVaultID(ctx context.Context, vault string) (vaultID string, cached bool, err error) {
+	if onePasswordIDRegexp.MatchString(vault) {
+		return vault, false, nil
+	}
+	g.mu.Lock()
+	vaultID, ok := g.vaultIDs[vault]
+	g.mu.Unlock()
+	if ok {
+		return vaultID, true, nil
+	}
+
+	vaultID, err = g.findID(ctx, "/v1/vaults", "name", vault)
+	if err != nil {
+		return "", false, fmt.Errorf("failed to resolve vault %s: %w", vault, err)
+	}
+	g.mu.Lock()
+	g.vaultIDs[vault] = vaultID
+	g.mu.Unlock()
+	return vaultID, false, nil
+}
+
+func (g *onePasswordConnectItemGetter) resolveItemID(ctx context.Context, vaultID, title string) (itemID string, cached bool, err error) {
+	if onePasswordIDRegexp.MatchString(title) {
+		return title, false, nil
+	}
+	key := onePasswordConnectItemKey{vaultID: vaultID, title: title}
+	g.mu.Lock()
+	itemID, ok := g.itemIDs[key]
+	g.mu.Unlock()
+	if ok {
+		return itemID, true, nil
+	}
+
+	itemID, err = g.findID(ctx, "/v1/vaults/"+url.PathEscape(vaultID)+"/items", "title", title)
+	if err != nil {
+		return "", false, err
+	}
+	g.mu.Lock()
+	g.itemIDs[key] = itemID
+	g.mu.Unlock()
+	return itemID, false, nil
+}
+
+func (g *onePasswordConnectItemGetter) forgetItemID(vaultID, title string) {
+	g.mu.Lock()
+	delete(g.itemIDs, onePasswordConnectItemKey{vaultID: vaultID, title: title})
+	g.mu.Unlock()
+}
+
+func (g *onePasswordConnectItemGetter) forgetVaultID(vault string) {
+	g.mu.Lock()
+	delete(g.vaultIDs, vault)
+	g.mu.Unlock()
+}
+
+// ForgetIDs forgets all cached IDs of vaults and items.
+func (g *onePasswordConnectItemGetter) ForgetIDs() {
+	g.mu.Lock()
+	clear(g.vaultIDs)
+	clear(g.itemIDs)
+	g.mu.Unlock()
+}
+
+// findID returns the ID of the only object whose attribute is value in
+// the list at path.
+func (g *onePasswordConnectItemGetter) findID(ctx context.Context, path, attr, value string) (string, error) {
+	escaped := strings.ReplaceAll(strings.ReplaceAll(value, `\`, `\\`), `"`, `\"`)
+	query := url.Values{"filter": {fmt.Sprintf(`%s eq "%s"`, attr, escaped)}}
+	body, err := g.get(ctx, path, query)
+	if err != nil {
+		return "", err
+	}
+	var objects []struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal(body, &objects); err != nil {
+		return "", fmt.Errorf("failed to parse response, err=%s", err)
+	}
+	switch len(objects) {
+	case 0:
+		return "", fmt.Errorf("%w: %s", ErrItemNotFound, value)
+	case 1:
+		return objects[0].ID, nil
+	default:
+		return "", fmt.Errorf("%w: more than one object has %s %s, specify it with ID", ErrAmbiguousItem, attr, value)
+	}
+}
+
+func (g *onePasswordConnectItemGetter) get(ctx context.Context, path string, query url.Values) ([]byte, error) {
+	reqURL := g.host + path
+	if len(query) > 0 {
+		reqURL += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, reqURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request, err=%s", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+g.token)
+	resp, err := g.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to send request to 1Password Connect, err=%s", ErrBackendUnavailable, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response from 1Password Connect, err=%s", err)
+	}
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, fmt.Errorf("%w: %s", ErrItemNotFound, path)
+	case resp.StatusCode == http.StatusUnauthorized:
+		return nil, fmt.Errorf("%w: the access token may be invalid or expired, message=%s", ErrBackendNotSignedIn, onePasswordConnectError(body))
+	case resp.StatusCode >= http.StatusInternalServerError:
+		return nil, fmt.Errorf("%w: status=%d, body=%s", ErrBackendUnavailable, resp.StatusCode, onePasswordConnectError(body))
+	case resp.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("failed to request to 1Password Connect, status=%d, message=%s", resp.StatusCode, onePasswordConnectError(body))
+	}
+	return body, nil
+}
+
+func onePasswordConnectError(body []byte) string {
+	var resp struct {
+		Message string `json:"message"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil || resp.Message == "" {
+		return string(body)
+	}
+	return resp.Message
+}
@@ -0,0 +1,136 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestOnePasswordConnectItemGetter(t *testing.T) {
+	const (
+		vaultID = "vaultid1vaultid1vaultid1vv"
+		itemID  = "itemid1itemid1itemid1itemi"
+	)
+	var lookups atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token1" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"status":401,"message":"Invalid token signature"}`))
+			return
+		}
+		filter := r.URL.Query().Get("filter")
+		switch r.URL.Path {
+		case "/v1/vaults":
+			lookups.Add(1)
+			if filter == `name eq "Private"` {
+				w.Write([]byte(`[{"id":"` + vaultID + `","name":"Private"}]`))
+			} else {
+				w.Write([]byte(`[]`))
+			}
+		case "/v1/vaults/" + vaultID + "/items":
+			lookups.Add(1)
+			if filter == `title eq "test1"` {
+				w.Write([]byte(`[{"id":"` + itemID + `","title":"test1"}]`))
+			} else {
+				w.Write([]byte(`[]`))
+			}
+		case "/v1/vaults/" + vaultID + "/items/" + itemID:
+			w.Write([]byte(exampleItem))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"status":404,"message":"Not found"}`))
+		}
+	}))
+	defer ts.Close()
+
+	getter, err := NewOnePasswordConnectItemGetter(ts.URL, "token1", "Private", ts.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := `{"username": .fields[] | select(.id == "username").value, "password": .fields[] | select(.id == "password").value}`
+	want := canonicalizeJSON(t, `{"username":"username1","password":"my_password1"}`)
+	for _, itemName := range []string{"Private/test1", "test1", vaultID + "/" + itemID} {
+		item, err := getter.GetItem(context.Background(), itemName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := runQuery(context.Background(), query, item, DefaultQueryLimits)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("result mismatch, itemName=%s, got=%s, want=%s", itemName, got, want)
+		}
+	}
+	// The vault and the item are looked up only once thanks to the cache.
+	if got, want := lookups.Load(), int32(2); got != want {
+		t.Errorf("lookup count mismatch, got=%d, want=%d", got, want)
+	}
+
+	for _, itemName := range []string{"Private/no_such_item", "NoSuchVault/test1"} {
+		if _, err := getter.GetItem(context.Background(), itemName); !errors.Is(err, ErrItemNotFound) {
+			t.Errorf("error should be ErrItemNotFound, itemName=%s, got=%v", itemName, err)
+		}
+	}
+}
+
+func TestOnePasswordConnectItemGetterRefresh(t *testing.T) {
+	const itemID = "itemid1itemid1itemid1itemi"
+	var (
+		vaultID atomic.Value
+		lookups atomic.Int32
+	)
+	vaultID.Store("vaultid1vaultid1vaultid1vv")
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := vaultID.Load().(string)
+		switch r.URL.Path {
+		case "/v1/vaults":
+			lookups.Add(1)
+			w.Write([]byte(`[{"id":"` + id + `","name":"Private"}]`))
+		case "/v1/vaults/" + id + "/items":
+			lookups.Add(1)
+			w.Write([]byte(`[{"id":"` + itemID + `","title":"test1"}]`))
+		case "/v1/vaults/" + id + "/items/" + itemID:
+			w.Write([]byte(exampleItem))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"status":404,"message":"Not found"}`))
+		}
+	}))
+	defer ts.Close()
+
+	getter, err := NewOnePasswordConnectItemGetter(ts.URL, "token1", "", ts.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	getItem := func(getter ItemGetter, wantLookups int32) {
+		t.Helper()
+		lookups.Store(0)
+		if _, err := getter.GetItem(context.Background(), "op://Private/test1"); err != nil {
+			t.Fatal(err)
+		}
+		if got := lookups.Load(); got != wantLookups {
+			t.Errorf("lookup count mismatch, got=%d, want=%d", got, wantLookups)
+		}
+	}
+
+	router := NewRouterItemGetter(map[string]ItemGetter{"op": getter}, nil)
+	getItem(router, 2)
+	// The vault was recreated with a new ID, so the cached vault ID is
+	// refreshed on the miss.
+	vaultID.Store("vaultid2vaultid2vaultid2vv")
+	getItem(router, 2)
+	getItem(router, 0)
+
+	// Invalidating the cache makes the getter forget the IDs.
+	cache, err := NewItemCache(router, ItemCacheConfig{TTL: time.Hour, MaxSize: 1 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.Invalidate("op://Private/test1")
+	getItem(cache, 2)
+}
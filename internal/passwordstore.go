@@ -0,0 +1,149 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+type passwordStoreItemGetter struct {
+	storeDir string
+	// storeRoot is storeDir with symlinks resolved.
+	storeRoot      string
+	decryptCmdArgs []string
+}
+
+// NewPasswordStoreItemGetter returns an ItemGetter which reads items from
+// a password-store directory used by pass and gopass.
+// decryptCommand is a command and arguments separated by spaces, and the path
+// of an encrypted file is appended to it. The command must write the decrypted
+// content to the stdout. Symlinks in the store can point only to files in
+// the store.
+func NewPasswordStoreItemGetter(storeDir, decryptCommand string) (*passwordStoreItemGetter, error) {
+	if fi, err := os.Stat(storeDir); err != nil {
+		return nil, fmt.Errorf("password store not found, err=%s", err)
+	} else if !fi.IsDir() {
+		return nil, fmt.Errorf("password store is not a directory: %s", storeDir)
+	}
+	storeRoot, err := filepath.EvalSymlinks(storeDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve password store path, err=%s", err)
+	}
+	args := strings.Fields(decryptCommand)
+	if len(args) == 0 {
+		return nil, errors.New("decrypt command must not be empty")
+	}
+	if _, err := exec.LookPath(args[0]); err != nil {
+		return nil, fmt.Errorf("decrypt command not found, err=%s", err)
+	}
+	return &passwordStoreItemGetter{
+		storeDir:       storeDir,
+		storeRoot:      storeRoot,
+		decryptCmdArgs: args,
+	}, nil
+}
+
+func (g *passwordStoreItemGetter) GetItem(ctx context.Context, itemName string) (string, error) {
+	// itemName comes from the remote server, so we must not allow it to
+	// point to files outside of the store.
+	if !filepath.IsLocal(itemName) {
+		return "", fmt.Errorf("invalid item name: %s", itemName)
+	}
+	filename, err := filepath.EvalSymlinks(filepath.Join(g.storeDir, itemName+".gpg"))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return "", fmt.Errorf("%w: %s", ErrItemNotFound, itemName)
+		}
+		return "", fmt.Errorf("failed to stat item file, err=%s", err)
+	}
+	// Symlinks in the store must not point to files outside of the store
+	// either.
+	if rel, err := filepath.Rel(g.storeRoot, filename); err != nil || !filepath.IsLocal(rel) {
+		return "", fmt.Errorf("invalid item name: %s", itemName)
+	}
+
+	args := append(g.decryptCmdArgs[1:len(g.decryptCmdArgs):len(g.decryptCmdArgs)], filename)
+	cmd := exec.CommandContext(ctx, g.decryptCmdArgs[0], args...)
+	output, err := cmd.Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) {
+			return "", fmt.Errorf("%w: failed to run decrypt command, err=%s", ErrBackendUnavailable, err)
+		}
+		return "", fmt.Errorf("failed to decrypt item, err=%s", err)
+	}
+	item, err := convertPasswordStoreEntry(itemName, output)
+	if err != nil {
+		return "", fmt.Errorf("failed to convert item, err=%s", err)
+	}
+	return item, nil
+}
+
+// convertPasswordStoreEntry converts a decrypted entry of password-store to
+// the item JSON format of 1Password CLI.
+//
+// The first line of an entry is the password, and the following lines in
+// the "key: value" format become fields whose id is the key. The keys "user"
+// and "login" are treated as "username". Other lines are put together in
+// the "notesPlain" field.
+func convertPasswordStoreEntry(itemName string, content []byte) (string, error) {
+	lines := strings.Split(string(bytes.TrimRight(content, "\n")), "\n")
+	fields := []itemField{
+		{
+			ID:      "password",
+			Type:    "CONCEALED",
+			Purpose: "PASSWORD",
+			Label:   "password",
+			Value:   strings.TrimSuffix(lines[0], "\r"),
+		},
+	}
+	var notes []string
+	for _, line := range lines[1:] {
+		line = strings.TrimSuffix(line, "\r")
+		key, value, found := strings.Cut(line, ":")
+		key = strings.TrimSpace(key)
+		if !found || key == "" || strings.ContainsAny(key, " \t") {
+			notes = append(notes, line)
+			continue
+		}
+		value = strings.TrimSpace(value)
+
+		field := itemField{
+			ID:    key,
+			Type:  "STRING",
+			Label: key,
+			Value: value,
+		}
+		switch strings.ToLower(key) {
+		case "username", "user", "login":
+			field.ID = "username"
+			field.Purpose = "USERNAME"
+		}
+		fields = append(fields, field)
+	}
+	if len(notes) > 0 {
+		fields = append(fields, itemField{
+			ID:      "notesPlain",
+			Type:    "STRING",
+			Purpose: "NOTES",
+			Label:   "notesPlain",
+			Value:   strings.Join(notes, "\n"),
+		})
+	}
+
+	output, err := json.Marshal(map[string]any{
+		"title":  itemName,
+		"fields": fields,
+	})
+	if err != nil {
+		return "", err
+	}
+	return string(output), nil
+}
@@ -0,0 +1,77 @@
+package internal
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPasswordStoreItemGetter(t *testing.T) {
+	storeDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(storeDir, "web"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	entry := "my_password1\nuser: username1\nurl: https://example.com\nsome notes\n"
+	if err := os.WriteFile(filepath.Join(storeDir, "web", "test1.gpg"), []byte(entry), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Use cat instead of gpg since the entry is not encrypted.
+	getter, err := NewPasswordStoreItemGetter(storeDir, "cat")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	item, err := getter.GetItem(context.Background(), "web/test1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		query string
+		want  string
+	}{
+		{
+			query: `{"username": .fields[] | select(.id == "username").value, "password": .fields[] | select(.id == "password").value}`,
+			want:  canonicalizeJSON(t, `{"username":"username1","password":"my_password1"}`),
+		},
+		{
+			query: `[.title, (.fields[] | select(.id == "url").value), (.fields[] | select(.purpose == "NOTES").value)]`,
+			want:  canonicalizeJSON(t, `["web/test1","https://example.com","some notes"]`),
+		},
+	}
+	for _, tc := range testCases {
+		got, err := runQuery(context.Background(), tc.query, item, DefaultQueryLimits)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tc.want {
+			t.Errorf("result mismatch, query=%s, got=%s, want=%s", tc.query, got, tc.want)
+		}
+	}
+
+	// A symlink in the store to a file in the store is allowed, but one to
+	// a file outside of the store is not.
+	if err := os.Symlink(filepath.Join(storeDir, "web", "test1.gpg"), filepath.Join(storeDir, "link.gpg")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := getter.GetItem(context.Background(), "link"); err != nil {
+		t.Errorf("should get item via symlink in the store, err=%v", err)
+	}
+	outside := filepath.Join(t.TempDir(), "outside.gpg")
+	if err := os.WriteFile(outside, []byte("outside_password\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(storeDir, "escape.gpg")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Dir(outside), filepath.Join(storeDir, "escapedir")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, itemName := range []string{"no_such_item", "../test1", "/etc/passwd", "escape", "escapedir/outside"} {
+		if _, err := getter.GetItem(context.Background(), itemName); err == nil {
+			t.Errorf("should fail for itemName=%s", itemName)
+		}
+	}
+}
@@ -6,92 +6,233 @@ import (
 	"fmt"
 	"io"
 	"log/slog"
+	"sync"
 	"time"
 
 	"github.com/hnakamur/pipesecret/internal/jsonrpc2debug"
 	"golang.org/x/exp/jsonrpc2"
 )
 
+// cancelRequestMethod is the method of a notification which the client
+// sends to cancel a request in flight.
+const cancelRequestMethod = "$/cancelRequest"
+
+type cancelRequestParams struct {
+	ID int64 `json:"id"`
+}
+
+// heartbeatMethod is the method of requests which the client sends
+// periodically to check that the server is alive.
+const heartbeatMethod = "heartbeat"
+
+// maxMissedHeartbeats is the number of heartbeat requests without responses
+// after which the client considers the connection broken.
+const maxMissedHeartbeats = 3
+
 type Client struct {
 	framer            jsonrpc2.Framer
 	requestC          <-chan RequestQueueItem
 	heartbeatInterval time.Duration
+
+	mu      sync.Mutex
+	pending map[int64]pendingRequest
+
+	cancelC chan int64
+	doneC   chan struct{}
 }
 
+// RequestQueueItem is a request to be sent to the server.
+// The response is sent to ResultC, which must be buffered so that Client
+// never blocks even if nobody receives the response.
+//
+// When Context is done before the response arrives, the client sends
+// a cancel request notification to the server and drops the response.
+// Context may be nil.
 type RequestQueueItem struct {
+	Context context.Context
 	Request *jsonrpc2.Request
 	ResultC chan *jsonrpc2.Response
 }
 
+type pendingRequest struct {
+	origReqID jsonrpc2.ID
+	method    string
+	resultC   chan *jsonrpc2.Response
+}
+
 func NewClient(framer jsonrpc2.Framer, requestC <-chan RequestQueueItem, heartbeatInterval time.Duration) *Client {
 	return &Client{
 		framer:            framer,
 		requestC:          requestC,
 		heartbeatInterval: heartbeatInterval,
+		pending:           make(map[int64]pendingRequest),
+		cancelC:           make(chan int64),
+		doneC:             make(chan struct{}),
 	}
 }
 
+// Run sends requests from requestC and heartbeat requests to out, and
+// receives responses from in. Multiple requests can be in flight at the same
+// time, and responses are matched to requests by ID.
 func (c *Client) Run(ctx context.Context, out io.Writer, in io.Reader) error {
 	logger := slog.Default().With("program", "remote-serve")
 
 	w := c.framer.Writer(out)
 	r := c.framer.Reader(in)
+
+	readErrC := make(chan error, 1)
+	go func() {
+		readErrC <- c.readResponses(ctx, r)
+	}()
+	defer c.failPending(errors.New("pipe client exited"))
+	defer close(c.doneC)
+
+	ticker := time.NewTicker(c.heartbeatInterval)
+	defer ticker.Stop()
 	reqID := int64(0)
 	for {
 		select {
 		case <-ctx.Done():
 			logger.DebugContext(ctx, "pipeClient received ctx.Done, exiting")
 			return nil
-		case <-time.After(c.heartbeatInterval):
+		case err := <-readErrC:
+			return err
+		case id := <-c.cancelC:
+			notify, err := jsonrpc2.NewNotification(cancelRequestMethod, cancelRequestParams{ID: id})
+			if err != nil {
+				return err
+			}
+			if _, err := w.Write(ctx, notify); err != nil {
+				return err
+			}
+			logger.DebugContext(ctx, "pipeClient sent cancel request", "id", id)
+		case <-ticker.C:
+			if n := c.pendingHeartbeats(); n >= maxMissedHeartbeats {
+				return fmt.Errorf("no response for %d heartbeat requests", n)
+			}
 			reqID++
 			req := &jsonrpc2.Request{
 				ID:     jsonrpc2.Int64ID(reqID),
-				Method: "heartbeat",
+				Method: heartbeatMethod,
 			}
+			c.addPending(reqID, pendingRequest{method: req.Method})
 			if _, err := w.Write(ctx, req); err != nil {
 				return err
 			}
 			logger.DebugContext(ctx, "pipeClient sent heartbeat request", "req",
 				jsonrpc2debug.DebugMarshalMessage{Msg: req})
-			respMsg, _, err := r.Read(ctx)
-			if err != nil {
-				return err
-			}
-			resp, ok := respMsg.(*jsonrpc2.Response)
-			if !ok {
-				return errors.New("expected a jsonrpc2 response")
-			}
-			logger.DebugContext(ctx, "pipeClient received heartbeat request", "resp",
-				jsonrpc2debug.DebugMarshalMessage{Msg: resp})
 		case origReq := <-c.requestC:
 			origReqID := origReq.Request.ID
 			reqID++
-			// We need to create a new request instead of reusing origReq.request here.
+			// We need to create a new request instead of reusing origReq.request here
+			// since IDs from multiple unix socket clients may collide.
 			req := &jsonrpc2.Request{
 				ID:     jsonrpc2.Int64ID(reqID),
 				Method: origReq.Request.Method,
 				Params: origReq.Request.Params,
 			}
+			c.addPending(reqID, pendingRequest{
+				origReqID: origReqID,
+				method:    req.Method,
+				resultC:   origReq.ResultC,
+			})
+			if origReq.Context != nil {
+				c.cancelOnDone(origReq.Context, reqID)
+			}
 			if _, err := w.Write(ctx, req); err != nil {
 				return err
 			}
 			logger.DebugContext(ctx, "pipeClient written request",
 				"request", jsonrpc2debug.DebugMarshalMessage{Msg: req},
 				"origReqID", fmt.Sprintf("%v", origReqID.Raw()))
+		}
+	}
+}
 
-			respMsg, _, err := r.Read(ctx)
-			if err != nil {
-				return err
-			}
-			resp, ok := respMsg.(*jsonrpc2.Response)
-			if !ok {
-				return errors.New("expected a jsonrpc2 response")
-			}
-			logger.DebugContext(ctx, "pipeClient received response", "resp",
+func (c *Client) readResponses(ctx context.Context, r jsonrpc2.Reader) error {
+	logger := slog.Default().With("program", "remote-serve")
+
+	for {
+		respMsg, _, err := r.Read(ctx)
+		if err != nil {
+			return err
+		}
+		resp, ok := respMsg.(*jsonrpc2.Response)
+		if !ok {
+			return errors.New("expected a jsonrpc2 response")
+		}
+		id, ok := resp.ID.Raw().(int64)
+		if !ok {
+			return fmt.Errorf("unexpected response ID: %v", resp.ID.Raw())
+		}
+		p, ok := c.removePending(id)
+		if !ok {
+			logger.DebugContext(ctx, "pipeClient ignored response for unknown request", "resp",
 				jsonrpc2debug.DebugMarshalMessage{Msg: resp})
-			resp.ID = origReqID
-			origReq.ResultC <- resp
-			logger.DebugContext(ctx, "pipeClient esnt response to resultC")
+			continue
+		}
+		logger.DebugContext(ctx, "pipeClient received response", "method", p.method, "resp",
+			jsonrpc2debug.DebugMarshalMessage{Msg: resp})
+		if p.resultC != nil {
+			resp.ID = p.origReqID
+			p.resultC <- resp
+		}
+	}
+}
+
+// cancelOnDone arranges to cancel the request with id when ctx is done.
+func (c *Client) cancelOnDone(ctx context.Context, id int64) {
+	context.AfterFunc(ctx, func() {
+		if _, ok := c.removePending(id); !ok {
+			// The response has already arrived.
+			return
+		}
+		select {
+		case c.cancelC <- id:
+		case <-c.doneC:
+		}
+	})
+}
+
+func (c *Client) addPending(id int64, p pendingRequest) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pending[id] = p
+}
+
+func (c *Client) removePending(id int64) (pendingRequest, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	p, ok := c.pending[id]
+	if ok {
+		delete(c.pending, id)
+	}
+	return p, ok
+}
+
+// pendingHeartbeats returns the number of heartbeat requests waiting
+// responses.
+func (c *Client) pendingHeartbeats() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for _, p := range c.pending {
+		if p.method == heartbeatMethod {
+			n++
+		}
+	}
+	return n
+}
+
+// failPending sends an error response for each pending request, so that
+// callers waiting responses do not wait forever.
+func (c *Client) failPending(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for id, p := range c.pending {
+		delete(c.pending, id)
+		if p.resultC != nil {
+			p.resultC <- &jsonrpc2.Response{ID: p.origReqID, Error: err}
 		}
 	}
 }
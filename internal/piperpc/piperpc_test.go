@@ -0,0 +1,215 @@
+package piperpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"golang.org/x/exp/jsonrpc2"
+)
+
+func TestConcurrentRequests(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	releaseSlow := make(chan struct{})
+	handler := func(ctx context.Context, req *jsonrpc2.Request) (any, error) {
+		switch req.Method {
+		case "slow":
+			select {
+			case <-releaseSlow:
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+			return "slow done", nil
+		case "fast":
+			return "fast done", nil
+		case "heartbeat":
+			return "ack", nil
+		default:
+			return nil, jsonrpc2.ErrNotHandled
+		}
+	}
+
+	// The client writes requests to reqW and reads responses from respR.
+	reqR, reqW := io.Pipe()
+	respR, respW := io.Pipe()
+	server := NewServer(jsonrpc2.RawFramer(), jsonrpc2.HandlerFunc(handler), 2)
+	go server.Run(ctx, reqR, respW)
+
+	requestC := make(chan RequestQueueItem)
+	client := NewClient(jsonrpc2.RawFramer(), requestC, time.Hour)
+	go client.Run(ctx, reqW, respR)
+
+	send := func(id int64, method string) chan *jsonrpc2.Response {
+		resultC := make(chan *jsonrpc2.Response, 1)
+		requestC <- RequestQueueItem{
+			Request: &jsonrpc2.Request{ID: jsonrpc2.Int64ID(id), Method: method},
+			ResultC: resultC,
+		}
+		return resultC
+	}
+	wait := func(resultC chan *jsonrpc2.Response, wantID int64, want string) {
+		t.Helper()
+		select {
+		case resp := <-resultC:
+			if resp.Error != nil {
+				t.Fatal(resp.Error)
+			}
+			if got := resp.ID.Raw(); got != wantID {
+				t.Errorf("response ID mismatch, got=%v, want=%d", got, wantID)
+			}
+			var got string
+			if err := json.Unmarshal(resp.Result, &got); err != nil {
+				t.Fatal(err)
+			}
+			if got != want {
+				t.Errorf("result mismatch, got=%s, want=%s", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout waiting response for %s", want)
+		}
+	}
+
+	slowC := send(100, "slow")
+	fastC := send(200, "fast")
+	// The fast request must not wait for the slow one.
+	wait(fastC, 200, "fast done")
+	close(releaseSlow)
+	wait(slowC, 100, "slow done")
+}
+
+func TestCancelRequest(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	startedC := make(chan struct{})
+	cancelledC := make(chan struct{})
+	handler := func(ctx context.Context, req *jsonrpc2.Request) (any, error) {
+		close(startedC)
+		<-ctx.Done()
+		close(cancelledC)
+		return nil, ctx.Err()
+	}
+
+	reqR, reqW := io.Pipe()
+	respR, respW := io.Pipe()
+	server := NewServer(jsonrpc2.RawFramer(), jsonrpc2.HandlerFunc(handler), 1)
+	go server.Run(ctx, reqR, respW)
+
+	requestC := make(chan RequestQueueItem)
+	client := NewClient(jsonrpc2.RawFramer(), requestC, time.Hour)
+	go client.Run(ctx, reqW, respR)
+
+	reqCtx, cancelReq := context.WithCancel(ctx)
+	resultC := make(chan *jsonrpc2.Response, 1)
+	requestC <- RequestQueueItem{
+		Context: reqCtx,
+		Request: &jsonrpc2.Request{ID: jsonrpc2.Int64ID(1), Method: "slow"},
+		ResultC: resultC,
+	}
+	select {
+	case <-startedC:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting handler to start")
+	}
+	cancelReq()
+	select {
+	case <-cancelledC:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting handler to be cancelled")
+	}
+}
+
+// errWriter fails to write.
+type errWriter struct{}
+
+var errWrite = errors.New("write failed")
+
+func (errWriter) Write(p []byte) (int, error) { return 0, errWrite }
+
+func TestServerWriteError(t *testing.T) {
+	handler := func(ctx context.Context, req *jsonrpc2.Request) (any, error) {
+		return "ok", nil
+	}
+	reqR, reqW := io.Pipe()
+	defer reqW.Close()
+	server := NewServer(jsonrpc2.RawFramer(), jsonrpc2.HandlerFunc(handler), 1)
+	errC := make(chan error, 1)
+	go func() {
+		errC <- server.Run(context.Background(), reqR, errWriter{})
+	}()
+
+	req := &jsonrpc2.Request{ID: jsonrpc2.Int64ID(1), Method: "fast"}
+	if _, err := jsonrpc2.RawFramer().Writer(reqW).Write(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	// No more requests arrive, so Run must not wait for them.
+	select {
+	case err := <-errC:
+		if !errors.Is(err, errWrite) {
+			t.Errorf("error mismatch, got=%v, want=%v", err, errWrite)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting server to exit")
+	}
+}
+
+func TestMissedHeartbeats(t *testing.T) {
+	// The server never responds.
+	respR, respW := io.Pipe()
+	defer respW.Close()
+	requestC := make(chan RequestQueueItem)
+	client := NewClient(jsonrpc2.RawFramer(), requestC, 10*time.Millisecond)
+	errC := make(chan error, 1)
+	go func() {
+		errC <- client.Run(context.Background(), io.Discard, respR)
+	}()
+
+	select {
+	case err := <-errC:
+		if err == nil {
+			t.Error("should fail when heartbeats are not responded")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting client to exit")
+	}
+}
+
+func TestHeartbeatWithBusyWorkers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	handler := func(ctx context.Context, req *jsonrpc2.Request) (any, error) {
+		if req.Method == heartbeatMethod {
+			return "ack", nil
+		}
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	reqR, reqW := io.Pipe()
+	respR, respW := io.Pipe()
+	server := NewServer(jsonrpc2.RawFramer(), jsonrpc2.HandlerFunc(handler), 1)
+	go server.Run(ctx, reqR, respW)
+
+	requestC := make(chan RequestQueueItem)
+	client := NewClient(jsonrpc2.RawFramer(), requestC, 10*time.Millisecond)
+	errC := make(chan error, 1)
+	go func() {
+		errC <- client.Run(ctx, reqW, respR)
+	}()
+
+	// The only worker is busy, but heartbeats are responded.
+	requestC <- RequestQueueItem{
+		Request: &jsonrpc2.Request{ID: jsonrpc2.Int64ID(1), Method: "slow"},
+		ResultC: make(chan *jsonrpc2.Response, 1),
+	}
+	select {
+	case err := <-errC:
+		t.Fatalf("client should not exit, err=%v", err)
+	case <-time.After(500 * time.Millisecond):
+	}
+}
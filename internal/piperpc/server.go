@@ -2,34 +2,84 @@ package piperpc
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"log/slog"
+	"sync"
 
 	"github.com/hnakamur/pipesecret/internal/jsonrpc2debug"
 	"golang.org/x/exp/jsonrpc2"
+	"golang.org/x/xerrors"
 )
 
 type Server struct {
 	framer  jsonrpc2.Framer
 	handler jsonrpc2.Handler
+	workers int
 }
 
-func NewServer(framer jsonrpc2.Framer, handler jsonrpc2.Handler) *Server {
+// NewServer returns a server which handles up to workers requests
+// concurrently. Requests received while all workers are busy wait in a queue.
+func NewServer(framer jsonrpc2.Framer, handler jsonrpc2.Handler, workers int) *Server {
 	return &Server{
 		framer:  framer,
 		handler: handler,
+		workers: max(workers, 1),
 	}
 }
 
 func (c *Server) Run(ctx context.Context, in io.Reader, out io.Writer) error {
 	logger := slog.Default().With("subcommand", "serve")
 
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	// Cancel requests in flight when the pipe is closed, before waiting them.
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
 	r := c.framer.Reader(in)
 	w := c.framer.Writer(out)
+	var writeMu sync.Mutex
+	var inflight sync.Map // map[int64]context.CancelFunc
+
+	// Messages are read in another goroutine, so that Run returns when
+	// a worker fails to write a response even if the read is blocked. The
+	// goroutine exits when in is closed.
+	type readResult struct {
+		msg jsonrpc2.Message
+		err error
+	}
+	readC := make(chan readResult)
+	go func() {
+		for {
+			logger.DebugContext(ctx, "reading message")
+			msg, _, err := r.Read(ctx)
+			select {
+			case readC <- readResult{msg: msg, err: err}:
+			case <-ctx.Done():
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	sem := make(chan struct{}, c.workers)
 	for {
-		logger.DebugContext(ctx, "reading message")
-		reqMsg, _, err := r.Read(ctx)
+		var res readResult
+		select {
+		case res = <-readC:
+		case <-ctx.Done():
+			// A worker failed to write a response.
+			if cause := context.Cause(ctx); !errors.Is(cause, context.Canceled) {
+				return cause
+			}
+			return ctx.Err()
+		}
+		reqMsg, err := res.msg, res.err
 		if err != nil {
 			if errors.Is(err, io.EOF) {
 				logger.DebugContext(ctx, "piperpc.Server received EOF, exiting")
@@ -44,16 +94,71 @@ func (c *Server) Run(ctx context.Context, in io.Reader, out io.Writer) error {
 		logger.DebugContext(ctx, "pipeServer read request", "req",
 			jsonrpc2debug.DebugMarshalMessage{Msg: req})
 
-		result, resultErr := c.handler.Handle(ctx, req)
-		respMsg, err := jsonrpc2.NewResponse(req.ID, result, resultErr)
-		if err != nil {
-			return err
+		if !req.IsCall() {
+			if req.Method == cancelRequestMethod {
+				var params cancelRequestParams
+				if err := json.Unmarshal(req.Params, &params); err != nil {
+					return err
+				}
+				if cancelReq, ok := inflight.LoadAndDelete(params.ID); ok {
+					logger.DebugContext(ctx, "pipeServer cancelling request", "id", params.ID)
+					cancelReq.(context.CancelFunc)()
+				}
+			}
+			continue
 		}
-
-		if _, err := w.Write(ctx, respMsg); err != nil {
-			return err
+		id, ok := req.ID.Raw().(int64)
+		if !ok {
+			return fmt.Errorf("unexpected request ID: %v", req.ID.Raw())
 		}
-		logger.DebugContext(ctx, "pipeServer written response", "resp",
-			jsonrpc2debug.DebugMarshalMessage{Msg: respMsg})
+		reqCtx, cancelReq := context.WithCancel(ctx)
+		inflight.Store(id, cancelReq)
+
+		// Reading is not blocked by busy workers, so the queue of requests is
+		// goroutines waiting for sem.
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() {
+				inflight.Delete(id)
+				cancelReq()
+			}()
+			// Heartbeats do not wait for busy workers, so that the client
+			// does not consider the connection broken while workers wait
+			// for the human, for example.
+			if req.Method != heartbeatMethod {
+				select {
+				case sem <- struct{}{}:
+				case <-reqCtx.Done():
+					return
+				}
+				defer func() { <-sem }()
+			}
+
+			result, resultErr := c.handler.Handle(reqCtx, req)
+			if errors.Is(resultErr, jsonrpc2.ErrNotHandled) {
+				resultErr = xerrors.Errorf("%w: %q", jsonrpc2.ErrMethodNotFound, req.Method)
+			}
+			if reqCtx.Err() != nil && ctx.Err() == nil {
+				// The client has cancelled the request and does not wait the response.
+				logger.DebugContext(ctx, "pipeServer dropped response for cancelled request", "id", id)
+				return
+			}
+			respMsg, err := jsonrpc2.NewResponse(req.ID, result, resultErr)
+			if err != nil {
+				cancel(err)
+				return
+			}
+
+			writeMu.Lock()
+			_, err = w.Write(ctx, respMsg)
+			writeMu.Unlock()
+			if err != nil {
+				cancel(err)
+				return
+			}
+			logger.DebugContext(ctx, "pipeServer written response", "resp",
+				jsonrpc2debug.DebugMarshalMessage{Msg: respMsg})
+		}()
 	}
 }
@@ -0,0 +1,386 @@
+// Package policy decides which remote hosts may get which items with which
+// queries on the local machine.
+//
+// A policy file is YAML (or JSON) like:
+//
+//	# The decision when no rule matches. allow or deny. Defaults to deny.
+//	default: deny
+//	# Queries which are never allowed even if a rule allows. This is
+//	# a best-effort blocklist, see below.
+//	deny_queries:
+//	  - "."
+//	rules:
+//	  # build01 may read only the password of items tagged ci.
+//	  - hosts: ["build01"]
+//	    tags: ["ci"]
+//	    queries: ['.fields[] | select(.id == "password").value']
+//	    effect: allow
+//	  - hosts: ["dev*"]
+//	    items: ["dev/*"]
+//	    effect: allow
+//	  # deploy01 may build a DSN from items with a query for all items.
+//	  - hosts: ["deploy01"]
+//	    items: ["app/*"]
+//	    items_queries: ['"\($items.db.fields[0].value)@db"']
+//	    effect: allow
+//
+// Rules are evaluated in order and the first matching rule decides.
+// A rule matches a request when all of the specified conditions match.
+// hosts and items are glob patterns of path.Match. tags matches items which
+// have any of the tags. queries matches queries which are the same as any
+// of them after normalizing spaces.
+//
+// items matches the item name in the request, which is not unique: the same
+// item may be requested by its ID, or by another name which the backend
+// resolves to it. After the request is allowed, deny rules are checked
+// again with the title and "vault/title" of the got item, see
+// CheckResolved. So deny rules with items also hold for other names, but
+// allow rules with items do not keep other names out. Use them with
+// default deny.
+//
+// A query for all items (run with --items-query) gets whole items in $items,
+// so it is allowed only by an allow rule with items_queries which has the
+// query, even if default is allow. queries of rules are not used for it.
+//
+// deny_queries cannot block all queries which return the whole item, since
+// there are countless equivalent queries, for example ".|.", "[.]" and
+// "{fields}". Use queries in allow rules with default deny to allow only
+// known queries. In addition, a result which contains all fields of the item
+// is denied unless allow_whole_item is true. It is a heuristic against
+// dumping whole items by mistake, not enforcement, since a query can
+// return all fields in another form, for example {a: .fields}.
+package policy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/itchyny/gojq"
+	"go.yaml.in/yaml/v3"
+)
+
+// ErrDenied is returned when a request is denied by the policy.
+var ErrDenied = errors.New("denied by policy")
+
+const (
+	effectAllow = "allow"
+	effectDeny  = "deny"
+)
+
+// Policy is a parsed policy file.
+type Policy struct {
+	Default     string   `yaml:"default"`
+	DenyQueries []string `yaml:"deny_queries"`
+	// AllowWholeItem disables CheckResult.
+	AllowWholeItem bool   `yaml:"allow_whole_item"`
+	Rules          []Rule `yaml:"rules"`
+}
+
+// Rule is a rule in the policy. Empty conditions match any request.
+type Rule struct {
+	Hosts   []string `yaml:"hosts"`
+	Items   []string `yaml:"items"`
+	Tags    []string `yaml:"tags"`
+	Queries []string `yaml:"queries"`
+	// ItemsQueries are queries for all items which the rule allows. An allow
+	// rule without them does not match requests with a query for all items.
+	ItemsQueries []string `yaml:"items_queries"`
+	Effect       string   `yaml:"effect"`
+}
+
+// Request is a request to be decided.
+type Request struct {
+	Host  string
+	Item  string
+	Query string
+	// ItemsQuery is true if Query is a query for all items of the request
+	// with items in $items, instead of a query for the item.
+	ItemsQuery bool
+	// Tags returns tags of the item. It is called only if a rule with tags
+	// is evaluated, since getting the item may be slow.
+	Tags func() ([]string, error)
+}
+
+// Decision is the result of Decide.
+type Decision struct {
+	Allow bool
+	// Reason describes which rule decided.
+	Reason string
+}
+
+// Load reads the policy file at path.
+func Load(path string) (*Policy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read policy file, err=%s", err)
+	}
+	return Parse(data)
+}
+
+// Parse parses data of a policy file.
+func Parse(data []byte) (*Policy, error) {
+	var p Policy
+	if err := yaml.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("failed to parse policy file, err=%s", err)
+	}
+	if p.Default == "" {
+		p.Default = effectDeny
+	}
+	if p.Default != effectAllow && p.Default != effectDeny {
+		return nil, fmt.Errorf("default must be allow or deny: %q", p.Default)
+	}
+	for i, q := range p.DenyQueries {
+		p.DenyQueries[i] = normalizeQuery(q)
+	}
+	for i := range p.Rules {
+		r := &p.Rules[i]
+		if r.Effect != effectAllow && r.Effect != effectDeny {
+			return nil, fmt.Errorf("effect of rule %d must be allow or deny: %q", i+1, r.Effect)
+		}
+		for _, pattern := range slices.Concat(r.Hosts, r.Items) {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("invalid pattern in rule %d: %q", i+1, pattern)
+			}
+		}
+		for j, q := range r.Queries {
+			r.Queries[j] = normalizeQuery(q)
+		}
+		for j, q := range r.ItemsQueries {
+			r.ItemsQueries[j] = normalizeQuery(q)
+		}
+	}
+	return &p, nil
+}
+
+// normalizeQuery returns query formatted by gojq, so that queries which
+// differ only in spaces are the same. query is returned as is if it is not
+// a valid query.
+func normalizeQuery(query string) string {
+	q, err := gojq.Parse(query)
+	if err != nil {
+		return query
+	}
+	return q.String()
+}
+
+// Decide decides whether req is allowed.
+func (p *Policy) Decide(req Request) (Decision, error) {
+	query := normalizeQuery(req.Query)
+	if slices.Contains(p.DenyQueries, query) {
+		return Decision{Reason: fmt.Sprintf("query %q is in deny_queries", req.Query)}, nil
+	}
+
+	tags := &lazyTags{get: req.Tags}
+	for i, r := range p.Rules {
+		if !matchAny(r.Hosts, req.Host) || !matchAny(r.Items, req.Item) {
+			continue
+		}
+		if !r.matchQuery(req, query) {
+			continue
+		}
+		if ok, err := r.matchTags(tags); err != nil {
+			return Decision{}, err
+		} else if !ok {
+			continue
+		}
+		return Decision{
+			Allow:  r.Effect == effectAllow,
+			Reason: fmt.Sprintf("rule %d", i+1),
+		}, nil
+	}
+	if req.ItemsQuery {
+		return Decision{Reason: "query for all items is not in items_queries of any rule"}, nil
+	}
+	return Decision{Allow: p.Default == effectAllow, Reason: "default"}, nil
+}
+
+// matchQuery returns whether the rule matches the normalized query of req.
+func (r *Rule) matchQuery(req Request, query string) bool {
+	if !req.ItemsQuery {
+		return len(r.Queries) == 0 || slices.Contains(r.Queries, query)
+	}
+	if r.Effect == effectDeny {
+		// Deny rules without items_queries match any query for all items,
+		// to be on the safe side.
+		return len(r.ItemsQueries) == 0 || slices.Contains(r.ItemsQueries, query)
+	}
+	return slices.Contains(r.ItemsQueries, query)
+}
+
+// lazyTags gets tags of the item at most once, and only when needed.
+type lazyTags struct {
+	get    func() ([]string, error)
+	tags   []string
+	loaded bool
+}
+
+// matchTags returns whether the item has any of the tags of the rule.
+func (r *Rule) matchTags(t *lazyTags) (bool, error) {
+	if len(r.Tags) == 0 {
+		return true, nil
+	}
+	if !t.loaded {
+		var err error
+		if t.tags, err = t.get(); err != nil {
+			return false, err
+		}
+		t.loaded = true
+	}
+	return slices.ContainsFunc(r.Tags, func(tag string) bool { return slices.Contains(t.tags, tag) }), nil
+}
+
+// Check returns an error wrapping ErrDenied if req is not allowed.
+func (p *Policy) Check(req Request) error {
+	d, err := p.Decide(req)
+	if err != nil {
+		return err
+	}
+	if !d.Allow {
+		return fmt.Errorf("%w: item %s from host %s (%s)", ErrDenied, req.Item, req.Host, d.Reason)
+	}
+	return nil
+}
+
+// CheckResolved returns an error wrapping ErrDenied if any deny rule
+// matches req with one of names as the item, regardless of the order of
+// rules. names are the names of the got item, see ItemNames. It is called
+// after Check allows req, so that a deny rule cannot be bypassed by
+// requesting the item by its ID or another name. Allow rules are not
+// evaluated for names.
+func (p *Policy) CheckResolved(req Request, names []string) error {
+	query := normalizeQuery(req.Query)
+	tags := &lazyTags{get: req.Tags}
+	for i, r := range p.Rules {
+		// Deny rules without items do not depend on names, and were
+		// evaluated by Check.
+		if r.Effect != effectDeny || len(r.Items) == 0 {
+			continue
+		}
+		if !matchAny(r.Hosts, req.Host) || !r.matchQuery(req, query) {
+			continue
+		}
+		j := slices.IndexFunc(names, func(name string) bool { return matchAny(r.Items, name) })
+		if j == -1 {
+			continue
+		}
+		if ok, err := r.matchTags(tags); err != nil {
+			return err
+		} else if !ok {
+			continue
+		}
+		return fmt.Errorf("%w: item %s as %s from host %s (rule %d)", ErrDenied, req.Item, names[j], req.Host, i+1)
+	}
+	return nil
+}
+
+// CheckResult returns an error wrapping ErrDenied if result of a query
+// contains all fields of item, unless AllowWholeItem is true. item and
+// result are JSON, and result may be a sequence of JSON values.
+//
+// It is a heuristic against dumping the whole item by mistake, not
+// enforcement. It catches queries which return all fields as they are in
+// forms which deny_queries misses, such as "[.]", but not the ones which
+// rebuild or convert fields, such as {a: .fields} or @base64.
+func (p *Policy) CheckResult(itemName, item, result string) error {
+	if p.AllowWholeItem {
+		return nil
+	}
+	var obj struct {
+		Fields []any `json:"fields"`
+	}
+	if err := json.Unmarshal([]byte(item), &obj); err != nil || len(obj.Fields) == 0 {
+		return nil
+	}
+	var values []any
+	dec := json.NewDecoder(strings.NewReader(result))
+	for {
+		var v any
+		if err := dec.Decode(&v); err != nil {
+			break
+		}
+		values = append(values, v)
+	}
+	for _, field := range obj.Fields {
+		if !slices.ContainsFunc(values, func(v any) bool { return containsValue(v, field) }) {
+			return nil
+		}
+	}
+	// Do not include result in the message since it contains secrets.
+	return fmt.Errorf("%w: result for item %s contains all fields of the item", ErrDenied, itemName)
+}
+
+// containsValue returns whether v is want or contains want in an array or
+// an object at any depth.
+func containsValue(v, want any) bool {
+	if reflect.DeepEqual(v, want) {
+		return true
+	}
+	switch v := v.(type) {
+	case []any:
+		return slices.ContainsFunc(v, func(e any) bool { return containsValue(e, want) })
+	case map[string]any:
+		for _, e := range v {
+			if containsValue(e, want) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matchAny returns whether name matches any of patterns. It returns true if
+// patterns is empty.
+func matchAny(patterns []string, name string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// ItemNames returns names of item JSON for CheckResolved: the "title" field,
+// and "vault/title" if the item has the "vault" field with "name" like
+// 1Password items.
+func ItemNames(item string) ([]string, error) {
+	var obj struct {
+		Title string `json:"title"`
+		Vault struct {
+			Name string `json:"name"`
+		} `json:"vault"`
+	}
+	if err := json.Unmarshal([]byte(item), &obj); err != nil {
+		// Do not include item in the message since it contains secrets.
+		return nil, errors.New("failed to parse title of item")
+	}
+	var names []string
+	if obj.Title != "" {
+		names = append(names, obj.Title)
+		if obj.Vault.Name != "" {
+			names = append(names, obj.Vault.Name+"/"+obj.Title)
+		}
+	}
+	return names, nil
+}
+
+// ItemTags returns tags in the "tags" field of item JSON. 1Password and
+// KeePass items have it.
+func ItemTags(item string) ([]string, error) {
+	var obj struct {
+		Tags []string `json:"tags"`
+	}
+	if err := json.Unmarshal([]byte(item), &obj); err != nil {
+		// Do not include item in the message since it contains secrets.
+		return nil, errors.New("failed to parse tags of item")
+	}
+	return obj.Tags, nil
+}
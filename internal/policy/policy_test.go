@@ -0,0 +1,273 @@
+package policy
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/itchyny/gojq"
+)
+
+const testPolicy = `
+default: deny
+deny_queries:
+  - "."
+rules:
+  - hosts: ["build01"]
+    tags: ["ci"]
+    queries: ['.fields[] | select(.id == "password").value']
+    effect: allow
+  - hosts: ["dev*"]
+    items: ["secret/*"]
+    effect: deny
+  - hosts: ["dev1"]
+    items_queries: ['{dsn: $items.db.title}']
+    effect: allow
+  - hosts: ["dev*"]
+    effect: allow
+`
+
+func TestDecide(t *testing.T) {
+	p, err := Parse([]byte(testPolicy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		name  string
+		req   Request
+		tags  []string
+		allow bool
+	}{
+		{
+			name:  "ciPassword",
+			req:   Request{Host: "build01", Item: "deploy", Query: `.fields[]|select(.id=="password").value`},
+			tags:  []string{"ci"},
+			allow: true,
+		},
+		{
+			name:  "ciOtherQuery",
+			req:   Request{Host: "build01", Item: "deploy", Query: `.fields`},
+			tags:  []string{"ci"},
+			allow: false,
+		},
+		{
+			// deny_queries does not catch it, but the queries allowlist does.
+			name:  "ciIdentityBypass",
+			req:   Request{Host: "build01", Item: "deploy", Query: `.|.`},
+			tags:  []string{"ci"},
+			allow: false,
+		},
+		{
+			name:  "notTaggedCI",
+			req:   Request{Host: "build01", Item: "deploy", Query: `.fields[] | select(.id == "password").value`},
+			allow: false,
+		},
+		{
+			name:  "identityQuery",
+			req:   Request{Host: "dev1", Item: "foo", Query: ` . `},
+			allow: false,
+		},
+		{
+			name:  "devDeniedItem",
+			req:   Request{Host: "dev1", Item: "secret/foo", Query: `.fields`},
+			allow: false,
+		},
+		{
+			name:  "devAllowed",
+			req:   Request{Host: "dev2", Item: "foo", Query: `.fields`},
+			allow: true,
+		},
+		{
+			name:  "itemsQueryAllowed",
+			req:   Request{Host: "dev1", Item: "foo", Query: `{dsn:$items.db.title}`, ItemsQuery: true},
+			allow: true,
+		},
+		{
+			// dev2 matches only the rule without items_queries.
+			name:  "itemsQueryNotInItemsQueries",
+			req:   Request{Host: "dev2", Item: "foo", Query: `{dsn: $items.db.title}`, ItemsQuery: true},
+			allow: false,
+		},
+		{
+			name:  "itemsQueryDeniedItem",
+			req:   Request{Host: "dev1", Item: "secret/foo", Query: `{dsn: $items.db.title}`, ItemsQuery: true},
+			allow: false,
+		},
+		{
+			name:  "default",
+			req:   Request{Host: "prod1", Item: "foo", Query: `.fields`},
+			allow: false,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.req.Tags = func() ([]string, error) { return tc.tags, nil }
+			err := p.Check(tc.req)
+			if allowed := err == nil; allowed != tc.allow {
+				t.Errorf("allow mismatch, got=%v, want=%v, err=%v", allowed, tc.allow, err)
+			}
+			if err != nil && !errors.Is(err, ErrDenied) {
+				t.Errorf("err should wrap ErrDenied, err=%v", err)
+			}
+		})
+	}
+}
+
+func TestDecideTagsNotLoaded(t *testing.T) {
+	p, err := Parse([]byte(testPolicy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := Request{
+		Host:  "dev1",
+		Item:  "foo",
+		Query: ".fields",
+		Tags: func() ([]string, error) {
+			t.Error("tags should not be loaded when no rule with tags is evaluated")
+			return nil, nil
+		},
+	}
+	if err := p.Check(req); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestParseError(t *testing.T) {
+	testCases := []string{
+		`default: maybe`,
+		`rules: [{effect: permit}]`,
+		`rules: [{hosts: ["["], effect: allow}]`,
+	}
+	for _, data := range testCases {
+		if _, err := Parse([]byte(data)); err == nil {
+			t.Errorf("should fail for %s", data)
+		}
+	}
+}
+
+func TestItemTags(t *testing.T) {
+	tags, err := ItemTags(`{"title": "foo", "tags": ["ci", "prod"], "fields": []}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tags) != 2 || tags[0] != "ci" || tags[1] != "prod" {
+		t.Errorf("tags mismatch, got=%v", tags)
+	}
+}
+
+func TestCheckResolved(t *testing.T) {
+	p, err := Parse([]byte(testPolicy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		name  string
+		req   Request
+		names []string
+		allow bool
+	}{
+		{
+			// The item ID is allowed by the last rule, but the item is
+			// secret/foo.
+			name:  "deniedByVaultTitle",
+			req:   Request{Host: "dev1", Item: "xyz123", Query: `.fields`},
+			names: []string{"foo", "secret/foo"},
+			allow: false,
+		},
+		{
+			name:  "otherVault",
+			req:   Request{Host: "dev1", Item: "xyz123", Query: `.fields`},
+			names: []string{"foo", "dev/foo"},
+			allow: true,
+		},
+		{
+			name:  "otherHost",
+			req:   Request{Host: "build01", Item: "xyz123", Query: `.fields`},
+			names: []string{"foo", "secret/foo"},
+			allow: true,
+		},
+		{
+			name:  "noNames",
+			req:   Request{Host: "dev1", Item: "xyz123", Query: `.fields`},
+			allow: true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.req.Tags = func() ([]string, error) { return nil, nil }
+			err := p.CheckResolved(tc.req, tc.names)
+			if allowed := err == nil; allowed != tc.allow {
+				t.Errorf("allow mismatch, got=%v, want=%v, err=%v", allowed, tc.allow, err)
+			}
+			if err != nil && !errors.Is(err, ErrDenied) {
+				t.Errorf("err should wrap ErrDenied, err=%v", err)
+			}
+		})
+	}
+}
+
+func TestItemNames(t *testing.T) {
+	names, err := ItemNames(`{"id": "xyz123", "title": "foo", "vault": {"id": "v1", "name": "secret"}, "fields": []}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 2 || names[0] != "foo" || names[1] != "secret/foo" {
+		t.Errorf("names mismatch, got=%v", names)
+	}
+}
+
+func TestCheckResult(t *testing.T) {
+	const item = `{"title": "foo", "fields": [{"id": "username", "value": "user1"}, {"id": "password", "value": "my_password1"}]}`
+	var input any
+	if err := json.Unmarshal([]byte(item), &input); err != nil {
+		t.Fatal(err)
+	}
+	run := func(query string) string {
+		t.Helper()
+		q, err := gojq.Parse(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var b strings.Builder
+		iter := q.Run(input)
+		for {
+			v, ok := iter.Next()
+			if !ok {
+				break
+			}
+			if err, ok := v.(error); ok {
+				t.Fatal(err)
+			}
+			data, err := json.Marshal(v)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b.Write(data)
+			b.WriteByte('\n')
+		}
+		return b.String()
+	}
+
+	p, err := Parse([]byte(testPolicy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Queries which return the whole item in other forms than "." are not
+	// blocked by deny_queries, but by the result check.
+	for _, query := range []string{`.`, `.|.`, `[.]`, `{fields}`, `. as $x|$x`, `.fields`, `.fields[]`} {
+		if err := p.CheckResult("foo", item, run(query)); !errors.Is(err, ErrDenied) {
+			t.Errorf("result of %s should be denied, err=%v", query, err)
+		}
+	}
+	for _, query := range []string{`{"username": .fields[] | select(.id == "username").value, "password": .fields[] | select(.id == "password").value}`, `.fields[0]`} {
+		if err := p.CheckResult("foo", item, run(query)); err != nil {
+			t.Errorf("result of %s should be allowed, err=%v", query, err)
+		}
+	}
+
+	p.AllowWholeItem = true
+	if err := p.CheckResult("foo", item, run(`.`)); err != nil {
+		t.Errorf("whole item should be allowed with allow_whole_item, err=%v", err)
+	}
+}
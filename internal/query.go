@@ -1,48 +1,232 @@
 package internal
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/itchyny/gojq"
 )
 
-func runQuery(query, input string) (string, error) {
-	q, err := gojq.Parse(query)
+var (
+	// ErrQueryParse is returned when a query cannot be parsed or compiled.
+	ErrQueryParse = errors.New("query parse error")
+	// ErrQueryRuntime is returned when a query fails while running.
+	ErrQueryRuntime = errors.New("query runtime error")
+	// ErrQueryRejected is returned when a query exceeds QueryLimits.
+	ErrQueryRejected = errors.New("query rejected")
+)
+
+// QueryLimits bounds resources used by a query. Queries are sent from remote
+// hosts, so they must not be able to hang or exhaust the local machine.
+type QueryLimits struct {
+	// Timeout is the maximum duration to run a query.
+	Timeout time.Duration
+	// MaxSteps is the maximum number of instructions of the gojq virtual
+	// machine to run a query.
+	MaxSteps int64
+	// MaxOutputSize is the maximum size of the query result in bytes.
+	MaxOutputSize int
+	// MaxValueSize is the maximum size of values made by a query, which is
+	// roughly the number of bytes of strings plus the number of other
+	// values. It is checked for operators and builtins which can make values
+	// much larger than their inputs, such as "x" * 1e9. If zero, values are
+	// not checked.
+	MaxValueSize int
+	// MaxMemory is the maximum heap size in bytes of the process which runs
+	// a query. If positive, queries run in child processes, which needs
+	// RunQueryProcess to be called in main. If zero, queries run in this
+	// process, and memory is bounded only by the other limits.
+	MaxMemory int64
+}
+
+// DefaultQueryLimits is large enough for queries to pick fields of an item.
+var DefaultQueryLimits = QueryLimits{
+	Timeout:       time.Second,
+	MaxSteps:      1_000_000,
+	MaxOutputSize: 1 << 20,
+	MaxValueSize:  1 << 20,
+}
+
+var errStepsExceeded = errors.New("query steps exceeded")
+
+// stepContext is a context whose Done method counts calls, which gojq
+// makes before each instruction, and gets done after maxSteps calls.
+type stepContext struct {
+	context.Context
+	steps    int64
+	maxSteps int64
+
+	once  sync.Once
+	doneC chan struct{}
+}
+
+func newStepContext(ctx context.Context, maxSteps int64) *stepContext {
+	return &stepContext{Context: ctx, maxSteps: maxSteps, doneC: make(chan struct{})}
+}
+
+func (c *stepContext) Done() <-chan struct{} {
+	// gojq runs a query in a single goroutine, so steps is not protected.
+	c.steps++
+	if c.steps > c.maxSteps {
+		c.once.Do(func() { close(c.doneC) })
+		return c.doneC
+	}
+	return c.Context.Done()
+}
+
+func (c *stepContext) Err() error {
+	if c.steps > c.maxSteps {
+		return errStepsExceeded
+	}
+	return c.Context.Err()
+}
+
+// runQuery runs query for each JSON value in input in a restricted
+// environment. The query cannot read environment variables nor inputs, and
+// resources are bound by limits. Errors wrap ErrQueryParse, ErrQueryRuntime
+// or ErrQueryRejected. Error messages do not contain input, since it is
+// a secret.
+func runQuery(ctx context.Context, query, input string, limits QueryLimits) (string, error) {
+	if limits.MaxMemory > 0 {
+		return runQueryProcess(ctx, queryProcessRequest{Query: query, Input: input, Limits: limits})
+	}
+	code, err := compileQuery(query, limits)
 	if err != nil {
-		return "", fmt.Errorf("failed to parse query: %s", query)
+		return "", err
 	}
 
+	ctx, cancel := context.WithTimeout(ctx, limits.Timeout)
+	defer cancel()
+
 	var res strings.Builder
-	enc := json.NewEncoder(&res)
 	dec := json.NewDecoder(strings.NewReader(input))
 	for {
 		var obj any
 		if err := dec.Decode(&obj); err == io.EOF {
 			break
 		} else if err != nil {
-			return "", fmt.Errorf("failed to parse input: %s", input)
+			return "", errors.New("failed to parse input")
 		}
+		if err := runCode(ctx, code, obj, nil, limits, &res); err != nil {
+			return "", err
+		}
+	}
+	return res.String(), nil
+}
 
-		iter := q.Run(obj)
-		for {
-			v, ok := iter.Next()
-			if !ok {
-				break
+// RunItemsQuery runs query once with null input and the variable $items
+// bound to an object whose keys are aliases and values are items. items maps
+// aliases to items in JSON. The query is run in the same restricted
+// environment as queries for a single item.
+func RunItemsQuery(ctx context.Context, query string, items map[string]string, limits QueryLimits) (string, error) {
+	if limits.MaxMemory > 0 {
+		if items == nil {
+			items = map[string]string{}
+		}
+		return runQueryProcess(ctx, queryProcessRequest{Query: query, Items: items, Limits: limits})
+	}
+	code, err := compileQuery(query, limits, "$items")
+	if err != nil {
+		return "", err
+	}
+	values := make(map[string]any, len(items))
+	for alias, item := range items {
+		var obj any
+		if err := json.Unmarshal([]byte(item), &obj); err != nil {
+			return "", fmt.Errorf("failed to parse item for %s", alias)
+		}
+		values[alias] = obj
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, limits.Timeout)
+	defer cancel()
+
+	var res strings.Builder
+	if err := runCode(ctx, code, nil, []any{values}, limits, &res); err != nil {
+		return "", err
+	}
+	return res.String(), nil
+}
+
+func compileQuery(query string, limits QueryLimits, variables ...string) (*gojq.Code, error) {
+	q, err := gojq.Parse(query)
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to parse query: %s", ErrQueryParse, err)
+	}
+	// gojq does not allow input and inputs without WithInputIter.
+	opts := []gojq.CompilerOption{
+		gojq.WithEnvironLoader(func() []string { return nil }),
+		gojq.WithVariables(variables),
+	}
+	if limits.MaxValueSize > 0 {
+		limitOpts, err := limitQuery(q, limits.MaxValueSize)
+		if err != nil {
+			return nil, fmt.Errorf("%w: failed to limit query: %s", ErrQueryParse, err)
+		}
+		opts = append(opts, limitOpts...)
+	}
+	code, err := gojq.Compile(q, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to compile query: %s", ErrQueryParse, err)
+	}
+	return code, nil
+}
+
+// runCode runs code for input with values of variables, and appends
+// results to res.
+func runCode(ctx context.Context, code *gojq.Code, input any, values []any, limits QueryLimits, res *strings.Builder) error {
+	enc := json.NewEncoder(res)
+	stepCtx := newStepContext(ctx, limits.MaxSteps)
+	iter := code.RunWithContext(stepCtx, input, values...)
+	for {
+		v, ok := iter.Next()
+		if !ok {
+			return nil
+		}
+		if err, ok := v.(error); ok {
+			if err, ok := err.(*gojq.HaltError); ok && err.Value() == nil {
+				return nil
 			}
-			if err, ok := v.(error); ok {
-				if err, ok := err.(*gojq.HaltError); ok && err.Value() == nil {
-					break
-				}
-				return "", fmt.Errorf("failed to process query: %s", err)
+			switch {
+			case errors.Is(err, errValueTooLarge):
+				return fmt.Errorf("%w: %s", ErrQueryRejected, err)
+			case errors.Is(err, errStepsExceeded):
+				return fmt.Errorf("%w: more than %d steps", ErrQueryRejected, limits.MaxSteps)
+			case errors.Is(err, context.DeadlineExceeded):
+				return fmt.Errorf("%w: took more than %s", ErrQueryRejected, limits.Timeout)
+			case errors.Is(err, context.Canceled):
+				return err
 			}
+			// gojq errors contain values, which may be secrets.
+			return fmt.Errorf("%w: failed to process query (%s)", ErrQueryRuntime, runtimeErrorKind(err))
+		}
 
-			if err := enc.Encode(v); err != nil {
-				return "", fmt.Errorf("failed to marshal query result: %s", err)
-			}
+		// Check the size before encoding not to make a huge result.
+		if valueSize(v, limits.MaxOutputSize) > limits.MaxOutputSize {
+			return fmt.Errorf("%w: result is larger than %d bytes", ErrQueryRejected, limits.MaxOutputSize)
+		}
+		if err := enc.Encode(v); err != nil {
+			return fmt.Errorf("%w: failed to marshal query result", ErrQueryRuntime)
+		}
+		if res.Len() > limits.MaxOutputSize {
+			return fmt.Errorf("%w: result is larger than %d bytes", ErrQueryRejected, limits.MaxOutputSize)
 		}
 	}
-	return res.String(), nil
+}
+
+// runtimeErrorKind returns the kind of a runtime error of gojq, such as
+// "expectedObjectError", instead of its message which contains values.
+func runtimeErrorKind(err error) string {
+	var valueErr gojq.ValueError
+	if errors.As(err, &valueErr) {
+		return "error called in query"
+	}
+	kind := strings.TrimPrefix(fmt.Sprintf("%T", err), "*")
+	return strings.TrimPrefix(kind, "gojq.")
 }
@@ -0,0 +1,411 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"reflect"
+
+	"github.com/itchyny/gojq"
+)
+
+// errValueTooLarge is returned from a query which makes a value larger than
+// QueryLimits.MaxValueSize.
+var errValueTooLarge = errors.New("query made too large a value")
+
+// The step budget bounds the number of instructions, but a single
+// instruction can make a huge value, such as "x" * 1e9 or .+. repeated. So
+// limitQuery rewrites the operators and builtins which can make values much
+// larger than their inputs to call the functions below, which check sizes
+// before making values.
+//
+// This is a heuristic. Builtins which make values at most a few times larger
+// than their inputs, such as @uri, are not checked, and a query can still
+// make many values within the step budget. Set QueryLimits.MaxMemory for
+// a hard bound.
+const (
+	limitAddFunc       = "_pipesecret_add"
+	limitMultiplyFunc  = "_pipesecret_multiply"
+	limitCheckFunc     = "_pipesecret_check"
+	limitCheckJoinFunc = "_pipesecret_check_join"
+	limitCheckPathFunc = "_pipesecret_check_path"
+	limitTransposeFunc = "_pipesecret_check_transpose"
+	limitVariable      = "$__pipesecret_v"
+)
+
+// limitPrelude redefines builtins which are defined in jq with + in gojq, so
+// that their + is rewritten too. The definitions are copied from builtin.jq
+// of gojq.
+const limitPrelude = `
+def sub($re; str; $flags):
+  . as $str |
+  def _sub:
+    if .matches == [] then
+      $str[:.offset] + .string
+    else
+      .matches[-1] as $r |
+      {
+        string: ($r | _capture | str) + $str[$r.offset+$r.length:.offset] + .string,
+        offset: $r.offset,
+        matches: .matches[:-1],
+      } |
+      _sub
+    end;
+  { string: "", matches: [match($re; $flags)] } | _sub;
+def sub($re; str): sub($re; str; null);
+def gsub($re; str): sub($re; str; "g");
+def gsub($re; str; $flags): sub($re; str; $flags + "g");
+.`
+
+// limitCheckedFuncs are builtins without arguments whose results can be much
+// larger than their inputs, so their inputs are checked.
+var limitCheckedFuncs = map[string]bool{
+	"add":      true,
+	"implode":  true,
+	"tojson":   true,
+	"tostring": true,
+}
+
+var (
+	addCode      = mustCompileBinary("$a + $b")
+	multiplyCode = mustCompileBinary("$a * $b")
+)
+
+func mustCompileBinary(query string) *gojq.Code {
+	q, err := gojq.Parse(query)
+	if err != nil {
+		panic(err)
+	}
+	code, err := gojq.Compile(q, gojq.WithVariables([]string{"$a", "$b"}))
+	if err != nil {
+		panic(err)
+	}
+	return code
+}
+
+// limitQuery rewrites q so that values made by the query are checked not to
+// be larger than maxValueSize, and returns compiler options for the functions
+// called by the rewritten query.
+func limitQuery(q *gojq.Query, maxValueSize int) ([]gojq.CompilerOption, error) {
+	prelude, err := gojq.Parse(limitPrelude)
+	if err != nil {
+		return nil, err
+	}
+	limitNode(reflect.ValueOf(prelude))
+	limitNode(reflect.ValueOf(q))
+	// Definitions in the query come after the prelude, so they can
+	// override it.
+	q.FuncDefs = append(prelude.FuncDefs, q.FuncDefs...)
+
+	l := valueLimit(maxValueSize)
+	return []gojq.CompilerOption{
+		gojq.WithFunction(limitAddFunc, 2, 2, l.add),
+		gojq.WithFunction(limitMultiplyFunc, 2, 2, l.multiply),
+		gojq.WithFunction(limitCheckFunc, 0, 0, l.check),
+		gojq.WithFunction(limitCheckJoinFunc, 1, 1, l.checkJoin),
+		gojq.WithFunction(limitCheckPathFunc, 0, 0, l.checkPath),
+		gojq.WithFunction(limitTransposeFunc, 0, 0, l.checkTranspose),
+	}, nil
+}
+
+// limitNode rewrites the nodes of a query under v in post-order, so that
+// nodes made by rewriting are not rewritten again.
+func limitNode(v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Pointer:
+		if v.IsNil() {
+			return
+		}
+		limitNode(v.Elem())
+		switch n := v.Interface().(type) {
+		case *gojq.Query:
+			limitOperator(n)
+		case *gojq.Term:
+			limitTerm(n)
+		case *gojq.Index:
+			n.Start = pipeFunc(n.Start, limitCheckPathFunc)
+			n.End = pipeFunc(n.End, limitCheckPathFunc)
+		case *gojq.String:
+			// gojq compiles queries with Str as literal parts.
+			for i, q := range n.Queries {
+				if q.Term == nil || q.Term.Str == nil {
+					n.Queries[i] = &gojq.Query{Term: &gojq.Term{
+						Type:  gojq.TermTypeQuery,
+						Query: pipeFunc(q, limitCheckFunc),
+					}}
+				}
+			}
+		}
+	case reflect.Struct:
+		for i := range v.NumField() {
+			if v.Type().Field(i).IsExported() {
+				limitNode(v.Field(i))
+			}
+		}
+	case reflect.Slice:
+		for i := range v.Len() {
+			limitNode(v.Index(i))
+		}
+	}
+}
+
+// limitOperator rewrites l + r to _pipesecret_add(l; r), and l += r to
+// r as $v | l |= _pipesecret_add(.; $v). Multiplications are rewritten in
+// the same way.
+func limitOperator(q *gojq.Query) {
+	var name string
+	switch q.Op {
+	case gojq.OpAdd, gojq.OpUpdateAdd:
+		name = limitAddFunc
+	case gojq.OpMul, gojq.OpUpdateMul:
+		name = limitMultiplyFunc
+	default:
+		return
+	}
+	if q.Op == gojq.OpAdd || q.Op == gojq.OpMul {
+		*q = gojq.Query{Term: funcTerm(name, q.Left, q.Right)}
+		return
+	}
+	update := &gojq.Query{
+		Left: q.Left,
+		Op:   gojq.OpModify,
+		Right: &gojq.Query{Term: funcTerm(name,
+			&gojq.Query{Term: &gojq.Term{Type: gojq.TermTypeIdentity}},
+			&gojq.Query{Term: funcTerm(limitVariable)},
+		)},
+	}
+	*q = gojq.Query{Term: bindTerm(q.Right, limitVariable, update)}
+}
+
+// limitTerm rewrites calls of builtins which can make large values to check
+// their inputs first.
+func limitTerm(t *gojq.Term) {
+	switch t.Type {
+	case gojq.TermTypeFunc:
+		f := t.Func
+		switch {
+		case limitCheckedFuncs[f.Name] && len(f.Args) == 0:
+			wrapTerm(t, limitCheckFunc)
+		case f.Name == "transpose" && len(f.Args) == 0:
+			wrapTerm(t, limitTransposeFunc)
+		case f.Name == "add" && len(f.Args) == 1:
+			// add(f) is [f] | add.
+			arr := &gojq.Query{Term: &gojq.Term{Type: gojq.TermTypeArray, Array: &gojq.Array{Query: f.Args[0]}}}
+			t.Func = &gojq.Func{Name: "add"}
+			wrapTerm(t, limitCheckFunc)
+			t.Query = pipe(arr, t.Query)
+		case f.Name == "join" && len(f.Args) == 1:
+			// join($sep) is checked with the separator, and join(f)
+			// is $sep bound for each output of f.
+			sep := &gojq.Query{Term: funcTerm(limitVariable)}
+			body := pipe(
+				&gojq.Query{Term: funcTerm(limitCheckJoinFunc, sep)},
+				&gojq.Query{Term: funcTerm("join", sep)},
+			)
+			*t = gojq.Term{
+				Type:       gojq.TermTypeQuery,
+				Query:      &gojq.Query{Term: bindTerm(f.Args[0], limitVariable, body)},
+				SuffixList: t.SuffixList,
+			}
+		case (f.Name == "setpath" || f.Name == "getpath" || f.Name == "delpaths") && len(f.Args) > 0:
+			f.Args[0] = pipeFunc(f.Args[0], limitCheckPathFunc)
+		}
+	case gojq.TermTypeFormat:
+		if t.Str == nil {
+			// Interpolations in format strings are checked as strings.
+			wrapTerm(t, limitCheckFunc)
+		}
+	}
+}
+
+// wrapTerm rewrites t to (name | t), keeping suffixes of t outside.
+func wrapTerm(t *gojq.Term, name string) {
+	inner := *t
+	inner.SuffixList = nil
+	*t = gojq.Term{
+		Type:       gojq.TermTypeQuery,
+		Query:      pipe(&gojq.Query{Term: funcTerm(name)}, &gojq.Query{Term: &inner}),
+		SuffixList: t.SuffixList,
+	}
+}
+
+func pipeFunc(q *gojq.Query, name string) *gojq.Query {
+	if q == nil {
+		return nil
+	}
+	return pipe(q, &gojq.Query{Term: funcTerm(name)})
+}
+
+func pipe(l, r *gojq.Query) *gojq.Query {
+	return &gojq.Query{Left: l, Op: gojq.OpPipe, Right: r}
+}
+
+func funcTerm(name string, args ...*gojq.Query) *gojq.Term {
+	return &gojq.Term{Type: gojq.TermTypeFunc, Func: &gojq.Func{Name: name, Args: args}}
+}
+
+// bindTerm returns the term of (q as $name | body).
+func bindTerm(q *gojq.Query, name string, body *gojq.Query) *gojq.Term {
+	return &gojq.Term{
+		Type:  gojq.TermTypeQuery,
+		Query: q,
+		SuffixList: []*gojq.Suffix{{
+			Bind: &gojq.Bind{Patterns: []*gojq.Pattern{{Name: name}}, Body: body},
+		}},
+	}
+}
+
+// valueLimit is the maximum size of values, which is measured by valueSize.
+type valueLimit int
+
+func (l valueLimit) err() error {
+	return fmt.Errorf("%w: more than %d bytes", errValueTooLarge, int(l))
+}
+
+func (l valueLimit) check(v any, _ []any) any {
+	if valueSize(v, int(l)) > int(l) {
+		return l.err()
+	}
+	return v
+}
+
+func (l valueLimit) add(_ any, args []any) any {
+	if valueSize(args[0], int(l))+valueSize(args[1], int(l)) > int(l) {
+		return l.err()
+	}
+	return runBinary(addCode, args[0], args[1])
+}
+
+func (l valueLimit) multiply(_ any, args []any) any {
+	size := valueSize(args[0], int(l)) + valueSize(args[1], int(l))
+	// A string multiplied by a number is repeated.
+	if s, ok := args[0].(string); ok {
+		size = repeatedSize(s, args[1])
+	} else if s, ok := args[1].(string); ok {
+		size = repeatedSize(s, args[0])
+	}
+	if size > int(l) {
+		return l.err()
+	}
+	return runBinary(multiplyCode, args[0], args[1])
+}
+
+func repeatedSize(s string, n any) int {
+	f, ok := toFloat(n)
+	if !ok {
+		return len(s)
+	}
+	if size := float64(len(s)) * math.Ceil(f); size < math.MaxInt32 {
+		return int(size)
+	}
+	return math.MaxInt32
+}
+
+// checkJoin checks the size of an array joined with sep.
+func (l valueLimit) checkJoin(v any, args []any) any {
+	sep, _ := args[0].(string)
+	if a, ok := v.([]any); ok {
+		if valueSize(v, int(l))+len(a)*len(sep) > int(l) {
+			return l.err()
+		}
+	}
+	return v
+}
+
+// checkPath checks that numbers in paths and indices are not larger than the
+// limit, since setting an element at a large index makes a large array.
+func (l valueLimit) checkPath(v any, _ []any) any {
+	var walk func(v any) bool
+	walk = func(v any) bool {
+		switch v := v.(type) {
+		case []any:
+			for _, e := range v {
+				if !walk(e) {
+					return false
+				}
+			}
+		case map[string]any:
+			for _, e := range v {
+				if !walk(e) {
+					return false
+				}
+			}
+		default:
+			if f, ok := toFloat(v); ok && math.Abs(f) > float64(l) {
+				return false
+			}
+		}
+		return true
+	}
+	if !walk(v) {
+		return l.err()
+	}
+	return v
+}
+
+// checkTranspose checks the size of a transposed array, which is padded
+// with null.
+func (l valueLimit) checkTranspose(v any, _ []any) any {
+	if a, ok := v.([]any); ok {
+		var maxLen int
+		for _, e := range a {
+			if e, ok := e.([]any); ok {
+				maxLen = max(maxLen, len(e))
+			}
+		}
+		if valueSize(v, int(l))+len(a)*maxLen > int(l) {
+			return l.err()
+		}
+	}
+	return v
+}
+
+func runBinary(code *gojq.Code, a, b any) any {
+	v, _ := code.Run(nil, a, b).Next()
+	return v
+}
+
+func toFloat(v any) (float64, bool) {
+	switch v := v.(type) {
+	case int:
+		return float64(v), true
+	case float64:
+		return v, true
+	case *big.Int:
+		f, _ := v.Float64()
+		return f, true
+	}
+	return 0, false
+}
+
+// valueSize returns the size of v, which is the number of bytes of strings
+// and keys plus the number of other values. It stops counting once the size
+// gets larger than limit.
+func valueSize(v any, limit int) int {
+	var size int
+	var walk func(v any) bool
+	walk = func(v any) bool {
+		size++
+		switch v := v.(type) {
+		case string:
+			size += len(v)
+		case []any:
+			for _, e := range v {
+				if !walk(e) {
+					return false
+				}
+			}
+		case map[string]any:
+			for k, e := range v {
+				size += len(k)
+				if !walk(e) {
+					return false
+				}
+			}
+		}
+		return size <= limit
+	}
+	walk(v)
+	return size
+}
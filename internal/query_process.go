@@ -0,0 +1,172 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// queryProcessEnv is the environment variable which makes the executable run
+// a query as a child process. See RunQueryProcess.
+const queryProcessEnv = "PIPESECRET_QUERY_PROCESS"
+
+// queryProcessRequest is written to stdin of the child process.
+type queryProcessRequest struct {
+	Query string
+	// Input is JSON values for runQuery. It is not used if Items is not nil.
+	Input string
+	// Items is items for RunItemsQuery.
+	Items  map[string]string
+	Limits QueryLimits
+}
+
+// queryProcessResponse is written to stdout by the child process.
+type queryProcessResponse struct {
+	Result string
+	// Kind is "parse", "runtime" or "rejected" for errors wrapping
+	// ErrQueryParse, ErrQueryRuntime or ErrQueryRejected, and "other" for
+	// other errors. It is empty if the query succeeded.
+	Kind    string
+	Message string
+}
+
+// queryProcessError is an error returned from the child process.
+type queryProcessError struct {
+	kind error
+	msg  string
+}
+
+func (e *queryProcessError) Error() string { return e.msg }
+func (e *queryProcessError) Unwrap() error { return e.kind }
+
+var queryErrorKinds = map[string]error{
+	"parse":    ErrQueryParse,
+	"runtime":  ErrQueryRuntime,
+	"rejected": ErrQueryRejected,
+}
+
+// RunQueryProcess runs a query and exits if the process was started as
+// a child process to run a query. It must be called at the start of main,
+// and TestMain of tests which run queries with QueryLimits.MaxMemory.
+func RunQueryProcess() {
+	if os.Getenv(queryProcessEnv) == "" {
+		return
+	}
+	var req queryProcessRequest
+	if err := json.NewDecoder(os.Stdin).Decode(&req); err != nil {
+		os.Stderr.WriteString("failed to read query request\n")
+		os.Exit(2)
+	}
+	var mu sync.Mutex
+	respond := func(resp queryProcessResponse) {
+		mu.Lock()
+		json.NewEncoder(os.Stdout).Encode(resp)
+		os.Exit(0)
+	}
+	watchMemory(req.Limits.MaxMemory, func() {
+		respond(queryProcessResponse{
+			Kind:    "rejected",
+			Message: fmt.Sprintf("%s: used more than %d bytes of memory", ErrQueryRejected, req.Limits.MaxMemory),
+		})
+	})
+
+	limits := req.Limits
+	limits.MaxMemory = 0
+	var result string
+	var err error
+	if req.Items != nil {
+		result, err = RunItemsQuery(context.Background(), req.Query, req.Items, limits)
+	} else {
+		result, err = runQuery(context.Background(), req.Query, req.Input, limits)
+	}
+	if err != nil {
+		kind := "other"
+		for k, e := range queryErrorKinds {
+			if errors.Is(err, e) {
+				kind = k
+			}
+		}
+		respond(queryProcessResponse{Kind: kind, Message: err.Error()})
+	}
+	respond(queryProcessResponse{Result: result})
+}
+
+// watchMemory calls exceeded when the heap gets larger than maxMemory.
+// The garbage collector runs harder near maxMemory, so that garbage is not
+// counted.
+func watchMemory(maxMemory int64, exceeded func()) {
+	debug.SetMemoryLimit(maxMemory)
+	go func() {
+		var ms runtime.MemStats
+		for {
+			runtime.ReadMemStats(&ms)
+			if ms.HeapAlloc > uint64(maxMemory) {
+				exceeded()
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}()
+}
+
+var queryExecutable = sync.OnceValues(os.Executable)
+
+// runQueryProcess runs req in a child process, which exits when it uses more
+// than req.Limits.MaxMemory, and is killed if it does not finish in time.
+// gojq cannot bound memory, since a single instruction such as + of strings
+// can allocate much.
+func runQueryProcess(ctx context.Context, req queryProcessRequest) (string, error) {
+	exe, err := queryExecutable()
+	if err != nil {
+		return "", fmt.Errorf("failed to get executable to run query, err=%s", err)
+	}
+	stdin, err := json.Marshal(req)
+	if err != nil {
+		return "", err
+	}
+
+	// The child process also stops the query after Timeout. The extra time
+	// is for starting the process.
+	ctx, cancel := context.WithTimeout(ctx, req.Limits.Timeout+5*time.Second)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, exe)
+	// Secrets in environment variables of serve are not passed. GORACE is
+	// passed for tests with the race detector.
+	cmd.Env = []string{queryProcessEnv + "=1"}
+	if v, ok := os.LookupEnv("GORACE"); ok {
+		cmd.Env = append(cmd.Env, "GORACE="+v)
+	}
+	cmd.Stdin = bytes.NewReader(stdin)
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = io.Discard
+	if err := cmd.Run(); err != nil {
+		switch {
+		case errors.Is(ctx.Err(), context.DeadlineExceeded):
+			return "", fmt.Errorf("%w: took more than %s", ErrQueryRejected, req.Limits.Timeout)
+		case ctx.Err() != nil:
+			return "", ctx.Err()
+		}
+		return "", fmt.Errorf("%w: query process failed, err=%s", ErrQueryRejected, err)
+	}
+
+	var resp queryProcessResponse
+	if err := json.Unmarshal(stdout.Bytes(), &resp); err != nil {
+		return "", fmt.Errorf("%w: invalid response from query process", ErrQueryRuntime)
+	}
+	if resp.Kind == "" {
+		return resp.Result, nil
+	}
+	if kind, ok := queryErrorKinds[resp.Kind]; ok {
+		return "", &queryProcessError{kind: kind, msg: resp.Message}
+	}
+	return "", errors.New(resp.Message)
+}
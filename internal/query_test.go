@@ -1,10 +1,15 @@
 package internal
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"io"
+	"math"
+	"os"
 	"strings"
 	"testing"
+	"time"
 )
 
 const exampleItem = `{
@@ -54,6 +59,36 @@ const exampleItem = `{
   ]
 }`
 
+func TestMain(m *testing.M) {
+	// Queries with QueryLimits.MaxMemory run in child processes of the test
+	// binary.
+	RunQueryProcess()
+	// The race detector sleeps 1 second at exit of each child process by
+	// default.
+	os.Setenv("GORACE", "atexit_sleep_ms=0")
+	os.Exit(m.Run())
+}
+
+func TestRunQueryMemory(t *testing.T) {
+	// Each + doubles the string in a single instruction of gojq.
+	query := `"x"*1e7 | .+. | .+. | .+. | .+. | .+. | .+. | length`
+	limits := DefaultQueryLimits
+	limits.MaxValueSize = math.MaxInt
+	limits.MaxMemory = 64 << 20
+	_, err := runQuery(context.Background(), query, `{}`, limits)
+	if !errors.Is(err, ErrQueryRejected) {
+		t.Errorf("err mismatch, got=%v, want=%v", err, ErrQueryRejected)
+	}
+
+	got, err := runQuery(context.Background(), `.password`, `{"password": "my_password1"}`, limits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "\"my_password1\"\n"; got != want {
+		t.Errorf("result mismatch, got=%s, want=%s", got, want)
+	}
+}
+
 func TestRunQuery(t *testing.T) {
 	testCases := []struct {
 		query string
@@ -85,6 +120,21 @@ func TestRunQuery(t *testing.T) {
 			input: `{"a":1,"b":2}`,
 			want:  canonicalizeJSON(t, `{"a":2,"b":4}`),
 		},
+		{
+			query: `(1, 2) + (10, 20)`,
+			input: `{}`,
+			want:  "11\n12\n21\n22\n",
+		},
+		{
+			query: `[.[] | tostring] | join(",") | "\(.)!" | gsub(","; "+")`,
+			input: `[1,2,3]`,
+			want:  `"1+2+3!"` + "\n",
+		},
+		{
+			query: `[.[1:], del(.[0]), path(.[0]), add, tojson, @base64, (.[0] = 4)]`,
+			input: `[1,2]`,
+			want:  `[[2],[2],[0],3,"[1,2]","WzEsMl0=",[4,2]]` + "\n",
+		},
 		{
 			query: `. as {$a} ?// [$a] ?// $a | $a`,
 			input: `{"a":1} [2] 3`,
@@ -97,7 +147,7 @@ func TestRunQuery(t *testing.T) {
 		},
 	}
 	for _, tc := range testCases {
-		got, err := runQuery(tc.query, tc.input)
+		got, err := runQuery(context.Background(), tc.query, tc.input, DefaultQueryLimits)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -108,6 +158,133 @@ func TestRunQuery(t *testing.T) {
 	}
 }
 
+func TestRunQuerySandbox(t *testing.T) {
+	t.Setenv("PIPESECRET_TEST_LOCAL_SECRET", "local_secret")
+	limits := QueryLimits{
+		Timeout:       10 * time.Second,
+		MaxSteps:      100_000,
+		MaxOutputSize: 1000,
+	}
+	testCases := []struct {
+		name    string
+		query   string
+		input   string
+		want    string
+		wantErr error
+	}{
+		{name: "env", query: `env`, input: `{}`, want: "{}\n"},
+		{name: "ENV", query: `$ENV.PIPESECRET_TEST_LOCAL_SECRET`, input: `{}`, want: "null\n"},
+		{name: "input", query: `input`, input: `1 2`, wantErr: ErrQueryParse},
+		{name: "inputs", query: `[inputs]`, input: `1 2`, wantErr: ErrQueryParse},
+		{name: "parse", query: `.a |`, input: `{}`, wantErr: ErrQueryParse},
+		{name: "runtime", query: `.a.b`, input: `{"a":"my_password1"}`, wantErr: ErrQueryRuntime},
+		{name: "infiniteLoop", query: `def f: f; f`, input: `{}`, wantErr: ErrQueryRejected},
+		{name: "manySteps", query: `[range(1e9)] | length`, input: `{}`, wantErr: ErrQueryRejected},
+		{name: "largeOutput", query: `range(1000)`, input: `{}`, wantErr: ErrQueryRejected},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := runQuery(context.Background(), tc.query, tc.input, limits)
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("err mismatch, got=%v, want=%v", err, tc.wantErr)
+			}
+			if got != tc.want {
+				t.Errorf("result mismatch, got=%s, want=%s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRunQueryValueSize(t *testing.T) {
+	limits := DefaultQueryLimits
+	limits.MaxValueSize = 1000
+	for _, query := range []string{
+		`"x" * 1e7`,
+		`1e7 * "x"`,
+		`"x" * 100 | .+. | .+. | .+. | .+.`,
+		`{a: ("x" * 100)} | .a += .a | .a += .a | .a += .a | .a += .a`,
+		`"x" * 100 | gsub("x"; "y" * 20)`,
+		`[range(100) | "x" * 20] | add`,
+		`add([range(100) | "x" * 20])`,
+		`[range(100) | "x" * 20] | join("")`,
+		`[range(10)] | join("x" * 200)`,
+		`[range(100) | "x" * 20] | tojson`,
+		`[range(100) | "x" * 20] | "\(.)"`,
+		`[range(100) | "x" * 20] | @base64`,
+		`[range(2000) | 65] | implode`,
+		`[1] | .[1e8] = 1`,
+		`null | setpath([1e8]; 1)`,
+		`[[range(100)], (range(100) | [])] | transpose`,
+	} {
+		_, err := runQuery(context.Background(), query, `{}`, limits)
+		if !errors.Is(err, ErrQueryRejected) {
+			t.Errorf("err mismatch, query=%s, got=%v, want=%v", query, err, ErrQueryRejected)
+		}
+	}
+
+	limits.MaxOutputSize = 1000
+	limits.MaxValueSize = math.MaxInt
+	if _, err := runQuery(context.Background(), `"x" * 1e7`, `{}`, limits); !errors.Is(err, ErrQueryRejected) {
+		t.Errorf("err mismatch, got=%v, want=%v", err, ErrQueryRejected)
+	}
+}
+
+func TestRunQueryTimeout(t *testing.T) {
+	limits := DefaultQueryLimits
+	limits.Timeout = 10 * time.Millisecond
+	limits.MaxSteps = math.MaxInt64
+	_, err := runQuery(context.Background(), `def f: f; f`, `{}`, limits)
+	if !errors.Is(err, ErrQueryRejected) {
+		t.Errorf("err mismatch, got=%v, want=%v", err, ErrQueryRejected)
+	}
+}
+
+func TestRunQueryRuntimeError(t *testing.T) {
+	const input = `{"password": "my_password1"}`
+	for _, query := range []string{`.password.x`, `.password | tonumber`, `error(.password)`, `.password | error`, `.password + 1`, `{(.password|tonumber): 1}`} {
+		_, err := runQuery(context.Background(), query, input, DefaultQueryLimits)
+		if !errors.Is(err, ErrQueryRuntime) {
+			t.Errorf("err mismatch, query=%s, got=%v, want=%v", query, err, ErrQueryRuntime)
+			continue
+		}
+		if strings.Contains(err.Error(), "my_password1") {
+			t.Errorf("error must not contain input, query=%s, err=%v", query, err)
+		}
+	}
+}
+
+func TestRunQueryInvalidInput(t *testing.T) {
+	_, err := runQuery(context.Background(), `.`, `{"password": "my_password1"`, DefaultQueryLimits)
+	if err == nil {
+		t.Fatal("should fail for invalid input")
+	}
+	if strings.Contains(err.Error(), "my_password1") {
+		t.Errorf("error must not contain input, err=%v", err)
+	}
+}
+
+func TestRunItemsQuery(t *testing.T) {
+	items := map[string]string{
+		"db":  exampleItem,
+		"api": `{"fields":[{"id":"token","value":"my_token1"}]}`,
+	}
+	query := `{"dsn": "\($items.db.fields[] | select(.id == "username").value):\($items.db.fields[] | select(.id == "password").value)", "token": $items.api.fields[0].value}`
+	got, err := RunItemsQuery(context.Background(), query, items, DefaultQueryLimits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := canonicalizeJSON(t, `{"dsn":"username1:my_password1","token":"my_token1"}`); got != want {
+		t.Errorf("result mismatch, got=%s, want=%s", got, want)
+	}
+
+	if _, err := RunItemsQuery(context.Background(), `$items | env`, items, DefaultQueryLimits); err != nil {
+		t.Errorf("env should be empty, err=%v", err)
+	}
+	if _, err := RunItemsQuery(context.Background(), `$other`, items, DefaultQueryLimits); !errors.Is(err, ErrQueryParse) {
+		t.Errorf("err mismatch, got=%v, want=%v", err, ErrQueryParse)
+	}
+}
+
 func canonicalizeJSON(t *testing.T, input string) string {
 	var res strings.Builder
 	enc := json.NewEncoder(&res)
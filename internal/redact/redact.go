@@ -0,0 +1,136 @@
+// Package redact masks secret values in logs, so that debug logs can be
+// pasted into bug reports.
+package redact
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+)
+
+// Mask replaces secret values.
+const Mask = "[REDACTED]"
+
+// secretKeyParts are parts of keys whose values are secrets. Keys are
+// compared in lower case without "_" and "-".
+var secretKeyParts = []string{
+	"password", "passphrase", "secret", "token", "session", "totp",
+	"privatekey", "apikey", "credential", "notesplain", "contentbase64",
+}
+
+// secretKeys are keys whose values are secrets. "value" is the value of
+// a field of an item, and "result" is the result of a JSON-RPC response,
+// which is a query result.
+var secretKeys = []string{"value", "result"}
+
+// IsSecretKey returns whether the value of key is a secret.
+func IsSecretKey(key string) bool {
+	k := strings.ToLower(strings.NewReplacer("_", "", "-", "").Replace(key))
+	for _, s := range secretKeys {
+		if k == s {
+			return true
+		}
+	}
+	for _, s := range secretKeyParts {
+		if strings.Contains(k, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// Value returns a copy of v with values of secret keys masked. v is a value
+// decoded from JSON into any.
+func Value(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		m := make(map[string]any, len(v))
+		for key, elem := range v {
+			if IsSecretKey(key) && elem != nil {
+				m[key] = Mask
+			} else {
+				m[key] = Value(elem)
+			}
+		}
+		return m
+	case []any:
+		s := make([]any, len(v))
+		for i, elem := range v {
+			s[i] = Value(elem)
+		}
+		return s
+	default:
+		return v
+	}
+}
+
+// Attr returns a with values of secret keys masked.
+func Attr(a slog.Attr) slog.Attr {
+	v := a.Value.Resolve()
+	if IsSecretKey(a.Key) && !isEmpty(v) {
+		return slog.String(a.Key, Mask)
+	}
+	switch v.Kind() {
+	case slog.KindGroup:
+		attrs := v.Group()
+		redacted := make([]slog.Attr, len(attrs))
+		for i, attr := range attrs {
+			redacted[i] = Attr(attr)
+		}
+		return slog.Attr{Key: a.Key, Value: slog.GroupValue(redacted...)}
+	case slog.KindAny:
+		switch v.Any().(type) {
+		case map[string]any, []any:
+			return slog.Any(a.Key, Value(v.Any()))
+		}
+	}
+	return slog.Attr{Key: a.Key, Value: v}
+}
+
+// isEmpty returns whether v is empty, which is logged as is to show that a
+// secret is not set.
+func isEmpty(v slog.Value) bool {
+	switch v.Kind() {
+	case slog.KindString:
+		return v.String() == ""
+	case slog.KindAny:
+		return v.Any() == nil
+	default:
+		return false
+	}
+}
+
+type handler struct {
+	handler slog.Handler
+}
+
+// NewHandler returns a slog.Handler which masks values of secret keys in
+// attributes and passes records to h.
+func NewHandler(h slog.Handler) slog.Handler {
+	return &handler{handler: h}
+}
+
+func (h *handler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.handler.Enabled(ctx, level)
+}
+
+func (h *handler) Handle(ctx context.Context, r slog.Record) error {
+	redacted := slog.NewRecord(r.Time, r.Level, r.Message, r.PC)
+	r.Attrs(func(a slog.Attr) bool {
+		redacted.AddAttrs(Attr(a))
+		return true
+	})
+	return h.handler.Handle(ctx, redacted)
+}
+
+func (h *handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	redacted := make([]slog.Attr, len(attrs))
+	for i, a := range attrs {
+		redacted[i] = Attr(a)
+	}
+	return &handler{handler: h.handler.WithAttrs(redacted)}
+}
+
+func (h *handler) WithGroup(name string) slog.Handler {
+	return &handler{handler: h.handler.WithGroup(name)}
+}
@@ -0,0 +1,93 @@
+package redact
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+type secretLogValuer struct{}
+
+func (secretLogValuer) LogValue() slog.Value {
+	return slog.GroupValue(slog.String("user", "alice"), slog.String("password", "p@ss"))
+}
+
+func TestHandler(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(NewHandler(slog.NewJSONHandler(&buf, nil))).With("session_key", "s3ss")
+	logger.WithGroup("g").Info("msg",
+		"name", "TOKEN",
+		"value", "v@lue",
+		"empty_password", "",
+		"nested", secretLogValuer{},
+		"resp", map[string]any{
+			"id":     float64(1),
+			"result": `{"password":"p@ss"}`,
+			"fields": []any{map[string]any{"id": "password", "value": "p@ss"}},
+		},
+	)
+
+	out := buf.String()
+	for _, secret := range []string{"s3ss", "v@lue", "p@ss"} {
+		if strings.Contains(out, secret) {
+			t.Errorf("secret %q is logged: %s", secret, out)
+		}
+	}
+	var got struct {
+		SessionKey string `json:"session_key"`
+		G          struct {
+			Name          string `json:"name"`
+			Value         string `json:"value"`
+			EmptyPassword string `json:"empty_password"`
+			Nested        struct {
+				User     string `json:"user"`
+				Password string `json:"password"`
+			} `json:"nested"`
+			Resp struct {
+				ID     int    `json:"id"`
+				Result string `json:"result"`
+				Fields []struct {
+					ID    string `json:"id"`
+					Value string `json:"value"`
+				} `json:"fields"`
+			} `json:"resp"`
+		} `json:"g"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.SessionKey != Mask || got.G.Value != Mask || got.G.Nested.Password != Mask ||
+		got.G.Resp.Result != Mask || got.G.Resp.Fields[0].Value != Mask {
+		t.Errorf("secrets are not masked: %s", out)
+	}
+	if got.G.Name != "TOKEN" || got.G.EmptyPassword != "" || got.G.Nested.User != "alice" ||
+		got.G.Resp.ID != 1 || got.G.Resp.Fields[0].ID != "password" {
+		t.Errorf("non-secret values are changed: %s", out)
+	}
+}
+
+func TestIsSecretKey(t *testing.T) {
+	testCases := []struct {
+		key  string
+		want bool
+	}{
+		{key: "password", want: true},
+		{key: "Password", want: true},
+		{key: "OP_SESSION_my", want: true},
+		{key: "api-key", want: true},
+		{key: "bw_session", want: true},
+		{key: "value", want: true},
+		{key: "result", want: true},
+		{key: "len(result)", want: false},
+		{key: "item", want: false},
+		{key: "query", want: false},
+		{key: "values", want: false},
+	}
+	for _, tc := range testCases {
+		if got := IsSecretKey(tc.key); got != tc.want {
+			t.Errorf("key=%s, got=%v, want=%v", tc.key, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"strings"
+)
+
+type routerItemGetter struct {
+	routes        map[string]ItemGetter
+	defaultGetter ItemGetter
+}
+
+// NewRouterItemGetter returns an ItemGetter which routes each item to
+// a backend by the URI scheme prefix of the item name. For example,
+// "vault://app/db" is passed as "app/db" to the getter for "vault" in routes.
+//
+// Item names without a prefix and item names whose prefix is not in routes
+// are passed to defaultGetter as they are, so that item names like
+// "https://example.com" still work. defaultGetter may be nil.
+func NewRouterItemGetter(routes map[string]ItemGetter, defaultGetter ItemGetter) *routerItemGetter {
+	return &routerItemGetter{
+		routes:        routes,
+		defaultGetter: defaultGetter,
+	}
+}
+
+// ForgetIDs calls ForgetIDs of getters which implement IDForgetter.
+func (g *routerItemGetter) ForgetIDs() {
+	for _, getter := range g.routes {
+		forgetIDs(getter)
+	}
+	forgetIDs(g.defaultGetter)
+}
+
+func (g *routerItemGetter) GetItem(ctx context.Context, itemName string) (string, error) {
+	if scheme, rest, found := strings.Cut(itemName, "://"); found {
+		if getter, ok := g.routes[scheme]; ok {
+			return getter.GetItem(ctx, rest)
+		}
+	}
+	if g.defaultGetter == nil {
+		return "", errors.New("item name must have a scheme prefix since default backend is not configured")
+	}
+	return g.defaultGetter.GetItem(ctx, itemName)
+}
@@ -0,0 +1,48 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"testing"
+)
+
+type stubItemGetter struct {
+	name string
+}
+
+func (g *stubItemGetter) GetItem(ctx context.Context, itemName string) (string, error) {
+	return fmt.Sprintf(`{"backend":%q,"item":%q}`, g.name, itemName), nil
+}
+
+func TestRouterItemGetter(t *testing.T) {
+	getter := NewRouterItemGetter(map[string]ItemGetter{
+		"op":    &stubItemGetter{name: "1password"},
+		"vault": &stubItemGetter{name: "vault"},
+	}, &stubItemGetter{name: "default"})
+
+	testCases := []struct {
+		itemName string
+		want     string
+	}{
+		{itemName: "op://Private/test1", want: `{"backend":"1password","item":"Private/test1"}`},
+		{itemName: "vault://app/db", want: `{"backend":"vault","item":"app/db"}`},
+		{itemName: "test1", want: `{"backend":"default","item":"test1"}`},
+		{itemName: "https://example.com", want: `{"backend":"default","item":"https://example.com"}`},
+	}
+	for _, tc := range testCases {
+		got, err := getter.GetItem(context.Background(), tc.itemName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tc.want {
+			t.Errorf("result mismatch, itemName=%s, got=%s, want=%s", tc.itemName, got, tc.want)
+		}
+	}
+
+	getter = NewRouterItemGetter(map[string]ItemGetter{
+		"op": &stubItemGetter{name: "1password"},
+	}, nil)
+	if _, err := getter.GetItem(context.Background(), "test1"); err == nil {
+		t.Error("should fail without default backend")
+	}
+}
@@ -0,0 +1,169 @@
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hnakamur/pipesecret/internal"
+	"github.com/hnakamur/pipesecret/internal/unixsocketrpc"
+)
+
+// maxBatchItems is the maximum number of items in a getQueryItems request.
+const maxBatchItems = 100
+
+// ItemQuery is an item to get in a getQueryItems request.
+type ItemQuery struct {
+	Item string
+	// Alias is the key for the item in the result, and also in $items of
+	// the query for all items.
+	Alias string
+	// Query is the query for the item. It is not used if the request has
+	// the query for all items.
+	Query string `json:",omitempty"`
+}
+
+// GetQueryItemsRequestParams is the params of getQueryItems, which gets
+// multiple items in a request.
+//
+// If Query is empty, the result is an object whose keys are aliases and
+// values are results of queries for each item. Otherwise, the result is the
+// result of Query run once with $items bound to an object whose keys are
+// aliases and values are items.
+type GetQueryItemsRequestParams struct {
+	Items []ItemQuery
+	Query string `json:",omitempty"`
+	// Peer is the process which requested the items on the remote host.
+	// It is set by remote-serve, and nil if unknown.
+	Peer *unixsocketrpc.Peer `json:",omitempty"`
+}
+
+func (p *GetQueryItemsRequestParams) validate() error {
+	if len(p.Items) == 0 {
+		return errors.New("no items")
+	}
+	if len(p.Items) > maxBatchItems {
+		return fmt.Errorf("more than %d items", maxBatchItems)
+	}
+	aliases := make(map[string]bool, len(p.Items))
+	for _, iq := range p.Items {
+		switch {
+		case iq.Item == "":
+			return errors.New("empty item")
+		case iq.Alias == "":
+			return fmt.Errorf("empty alias for item %s", iq.Item)
+		case aliases[iq.Alias]:
+			return fmt.Errorf("duplicate alias %s", iq.Alias)
+		case p.Query == "" && iq.Query == "":
+			return fmt.Errorf("empty query for item %s", iq.Item)
+		}
+		aliases[iq.Alias] = true
+	}
+	return nil
+}
+
+// getQueryItems gets items in params concurrently in the same way as
+// getQueryItem, and returns the result. Each item is recorded in the audit log.
+// If getting any item fails, no result is returned, and the error is
+// converted to an error response.
+func getQueryItems(ctx context.Context, cfg LocalServerConfig, hostName string, params *GetQueryItemsRequestParams, logger *slog.Logger) (string, error) {
+	startTime := time.Now()
+	itemParams := make([]GetQueryItemRequestParams, len(params.Items))
+	for i, iq := range params.Items {
+		itemParams[i] = GetQueryItemRequestParams{Item: iq.Item, Query: iq.Query, Peer: params.Peer}
+		if params.Query != "" {
+			itemParams[i].Query = params.Query
+		}
+	}
+
+	// With the query for all items, values are items. Otherwise, values are
+	// results of queries for each item.
+	values := make([]string, len(params.Items))
+	errs := make([]error, len(params.Items))
+	var wg sync.WaitGroup
+	for i := range itemParams {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p := &itemParams[i]
+			if params.Query != "" {
+				getter, err := allowItem(ctx, cfg, hostName, p, true, logger)
+				if err != nil {
+					errs[i] = err
+					return
+				}
+				values[i], errs[i] = getter.GetItem(ctx, p.Item)
+				return
+			}
+			values[i], errs[i] = getQueryItem(ctx, cfg, hostName, p, logger)
+		}()
+	}
+	wg.Wait()
+
+	var result string
+	var err error
+	errData := ErrorData{Host: hostName}
+	for i := range errs {
+		if errs[i] != nil {
+			err = errs[i]
+			errData.Item = params.Items[i].Item
+			break
+		}
+	}
+	if err == nil {
+		if params.Query != "" {
+			items := make(map[string]string, len(params.Items))
+			for i, iq := range params.Items {
+				items[iq.Alias] = values[i]
+			}
+			result, err = internal.RunItemsQuery(ctx, params.Query, items, cfg.QueryLimits)
+			// The result must not contain a whole item for any of items.
+			for i := 0; err == nil && i < len(params.Items) && cfg.Policy != nil; i++ {
+				if err = cfg.Policy.CheckResult(params.Items[i].Item, values[i], result); err != nil {
+					logger.InfoContext(ctx, "result not allowed by policy", "item", params.Items[i].Item, "err", err)
+					errData.Item = params.Items[i].Item
+				}
+			}
+		} else {
+			result, err = combineResults(params.Items, values)
+		}
+	}
+
+	for i := range itemParams {
+		// An item is not returned if getting another item fails.
+		itemErr := errs[i]
+		if itemErr == nil {
+			itemErr = err
+		}
+		if auditErr := auditItem(ctx, cfg, hostName, &itemParams[i], startTime, itemErr, logger); auditErr != nil {
+			return "", auditErr
+		}
+	}
+	if err != nil {
+		return "", newResponseError(err, errData)
+	}
+	return result, nil
+}
+
+// combineResults returns a JSON object whose keys are aliases of items and
+// values are results of queries for the items.
+func combineResults(items []ItemQuery, results []string) (string, error) {
+	obj := make(map[string]json.RawMessage, len(items))
+	for i, iq := range items {
+		result := json.RawMessage(strings.TrimSpace(results[i]))
+		if !json.Valid(result) {
+			return "", fmt.Errorf("%w: query for %s must output exactly one value", internal.ErrQueryRuntime, iq.Alias)
+		}
+		obj[iq.Alias] = result
+	}
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return "", fmt.Errorf("%w: failed to marshal query results: %s", internal.ErrQueryRuntime, err)
+	}
+	return string(data), nil
+}
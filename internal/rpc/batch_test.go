@@ -0,0 +1,85 @@
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/hnakamur/pipesecret/internal/piperpc"
+	"golang.org/x/exp/jsonrpc2"
+)
+
+func TestGetQueryItemsFallback(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// A fake serve which does not support getQueryItems.
+	handler := func(ctx context.Context, req *jsonrpc2.Request) (any, error) {
+		switch req.Method {
+		case initializeMethod:
+			return InitializeParams{
+				Version:         "v1.0.0",
+				ProtocolVersion: ProtocolVersion,
+				Methods:         []string{initializeMethod, "heartbeat", "getQueryItem"},
+			}, nil
+		case "getQueryItem":
+			var params GetQueryItemRequestParams
+			if err := json.Unmarshal(req.Params, &params); err != nil {
+				return nil, err
+			}
+			return fmt.Sprintf(`{"password":"password_of_%s"}`, params.Item), nil
+		default:
+			return "ack", nil
+		}
+	}
+	remoteR, localW := io.Pipe()
+	localR, remoteW := io.Pipe()
+	server := piperpc.NewServer(jsonrpc2.RawFramer(), jsonrpc2.HandlerFunc(handler), 1)
+	go server.Run(ctx, localR, localW)
+
+	socketPath := filepath.Join(t.TempDir(), "pipesecret.sock")
+	s := NewRemoteServer(RemoteServerConfig{
+		SocketPath:        socketPath,
+		HeartbeatInterval: time.Minute,
+		Version:           "v1.1.0",
+	})
+	go s.Run(ctx, remoteW, remoteR)
+	for {
+		conn, err := net.Dial("unix", socketPath)
+		if err == nil {
+			conn.Close()
+			break
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatal("timeout waiting remote-serve to start listening")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	items := []ItemQuery{
+		{Item: "app/db", Alias: "db", Query: "."},
+		{Item: "app/api", Alias: "api", Query: "."},
+	}
+	got, err := GetQueryItems(ctx, socketPath, time.Second, items, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]any{
+		"db":  map[string]any{"password": "password_of_app/db"},
+		"api": map[string]any{"password": "password_of_app/api"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("result mismatch, got=%v, want=%v", got, want)
+	}
+
+	if _, err := GetQueryItems(ctx, socketPath, time.Second, items, "$items"); err == nil {
+		t.Error("query for all items should fail with serve which does not support getQueryItems")
+	}
+}
@@ -0,0 +1,118 @@
+package rpc
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/hnakamur/pipesecret/internal"
+	"github.com/hnakamur/pipesecret/internal/approval"
+	"github.com/hnakamur/pipesecret/internal/audit"
+	"github.com/hnakamur/pipesecret/internal/policy"
+	"github.com/hnakamur/pipesecret/internal/unixsocketrpc"
+	"golang.org/x/exp/jsonrpc2"
+)
+
+// JSON-RPC error codes of getQueryItem. Codes from -32000 to -32099 are
+// reserved for implementation-defined server errors. -32000 and -32001 are
+// used by jsonrpc2, and -32020 is unixsocketrpc.CodePeerNotAllowed.
+const (
+	CodeItemNotFound       int64 = -32010
+	CodeAmbiguousItem      int64 = -32011
+	CodeQueryParse         int64 = -32012
+	CodeQueryRuntime       int64 = -32013
+	CodeQueryRejected      int64 = -32014
+	CodePolicyDenied       int64 = -32015
+	CodeApprovalDenied     int64 = -32016
+	CodeApprovalTimeout    int64 = -32017
+	CodeBackendNotSignedIn int64 = -32018
+	CodeBackendUnavailable int64 = -32019
+)
+
+// errorCodes maps errors returned from getting an item to error codes.
+var errorCodes = []struct {
+	err  error
+	code int64
+}{
+	{err: internal.ErrItemNotFound, code: CodeItemNotFound},
+	{err: internal.ErrAmbiguousItem, code: CodeAmbiguousItem},
+	{err: internal.ErrQueryParse, code: CodeQueryParse},
+	{err: internal.ErrQueryRuntime, code: CodeQueryRuntime},
+	{err: internal.ErrQueryRejected, code: CodeQueryRejected},
+	{err: policy.ErrDenied, code: CodePolicyDenied},
+	{err: approval.ErrDenied, code: CodeApprovalDenied},
+	// The human denied the request on the prompt of the backend.
+	{err: internal.ErrBackendAuthorizationDismissed, code: CodeApprovalDenied},
+	{err: approval.ErrTimeout, code: CodeApprovalTimeout},
+	{err: internal.ErrBackendNotSignedIn, code: CodeBackendNotSignedIn},
+	{err: internal.ErrBackendUnavailable, code: CodeBackendUnavailable},
+}
+
+// ErrorData is the data of an error response with one of the codes above.
+type ErrorData struct {
+	// Reason is the same as the reason in the audit log, for example,
+	// "item_not_found".
+	Reason string `json:"reason,omitempty"`
+	// Host is the name of the remote host in serve.
+	Host string `json:"host,omitempty"`
+	// Item is the requested item name.
+	Item string `json:"item,omitempty"`
+}
+
+// Error is an error response received by the run subcommand.
+type Error struct {
+	Code    int64
+	Message string
+	Data    ErrorData
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// newResponseError returns an error to respond for err returned from getting
+// the item. The error has the code for err and data, which are responded by
+// wireFramer.
+func newResponseError(err error, data ErrorData) error {
+	var code int64
+	for _, c := range errorCodes {
+		if errors.Is(err, c.err) {
+			code = c.code
+			break
+		}
+	}
+	if code == 0 {
+		return fmt.Errorf("%w: %w", jsonrpc2.ErrInternal, err)
+	}
+	_, data.Reason = audit.Classify(err)
+	dataJSON, err2 := json.Marshal(data)
+	if err2 != nil {
+		return fmt.Errorf("%w: %w", jsonrpc2.ErrInternal, err)
+	}
+	return &responseError{obj: wireErrorObject{Code: code, Message: err.Error(), Data: dataJSON}}
+}
+
+// asError returns *Error for err if err is an error received in a response
+// with one of the codes above or unixsocketrpc.CodePeerNotAllowed.
+// Otherwise, it returns nil.
+func asError(err error) *Error {
+	obj, ok := wireErrorOf(err)
+	if !ok || (obj.Code != unixsocketrpc.CodePeerNotAllowed && !isGetQueryItemCode(obj.Code)) {
+		return nil
+	}
+	e := &Error{Code: obj.Code, Message: obj.Message}
+	if len(obj.Data) > 0 {
+		// Ignore invalid data, since the code and the message are enough.
+		_ = json.Unmarshal(obj.Data, &e.Data)
+	}
+	return e
+}
+
+func isGetQueryItemCode(code int64) bool {
+	for _, c := range errorCodes {
+		if c.code == code {
+			return true
+		}
+	}
+	return false
+}
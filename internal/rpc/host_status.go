@@ -0,0 +1,76 @@
+package rpc
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+type hostState string
+
+const (
+	hostStateConnecting hostState = "connecting"
+	hostStateConnected  hostState = "connected"
+	hostStateWaiting    hostState = "waiting to reconnect"
+	hostStateStopped    hostState = "stopped"
+)
+
+// hostStatus is the status of the pipe to a remote host.
+// It is logged when the serve process receives SIGUSR1 on unix. The help of
+// the serve subcommand describes it.
+type hostStatus struct {
+	name string
+
+	mu       sync.Mutex
+	state    hostState
+	since    time.Time
+	lastErr  error
+	connects int
+	requests int
+}
+
+func newHostStatus(name string) *hostStatus {
+	return &hostStatus{name: name, state: hostStateConnecting, since: time.Now()}
+}
+
+// set changes the state. err is kept as the last error if not nil.
+func (s *hostStatus) set(state hostState, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.state = state
+	s.since = time.Now()
+	if err != nil {
+		s.lastErr = err
+	}
+	if state == hostStateConnected {
+		s.connects++
+	}
+}
+
+func (s *hostStatus) addRequest() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests++
+}
+
+func (s *hostStatus) LogValue() slog.Value {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	attrs := []slog.Attr{
+		slog.String("state", string(s.state)),
+		slog.Time("since", s.since),
+		slog.Int("connects", s.connects),
+		slog.Int("requests", s.requests),
+	}
+	if s.lastErr != nil {
+		attrs = append(attrs, slog.String("lastErr", s.lastErr.Error()))
+	}
+	return slog.GroupValue(attrs...)
+}
+
+func logHostStatuses(ctx context.Context, logger *slog.Logger, statuses []*hostStatus) {
+	for _, s := range statuses {
+		logger.InfoContext(ctx, "host status", "host", s.name, "status", s)
+	}
+}
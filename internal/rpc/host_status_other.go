@@ -0,0 +1,14 @@
+//go:build !unix
+
+package rpc
+
+import (
+	"context"
+	"log/slog"
+)
+
+// notifyStatusDump does nothing since SIGUSR1 is not available. The help of
+// the serve subcommand says the status dump is only on unix.
+func notifyStatusDump(ctx context.Context, logger *slog.Logger, statuses []*hostStatus) (stop func()) {
+	return func() {}
+}
@@ -0,0 +1,33 @@
+//go:build unix
+
+package rpc
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// notifyStatusDump logs statuses of all hosts each time the process
+// receives SIGUSR1. The returned function stops it.
+func notifyStatusDump(ctx context.Context, logger *slog.Logger, statuses []*hostStatus) (stop func()) {
+	sigC := make(chan os.Signal, 1)
+	signal.Notify(sigC, syscall.SIGUSR1)
+	doneC := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-sigC:
+				logHostStatuses(ctx, logger, statuses)
+			case <-doneC:
+				return
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(sigC)
+		close(doneC)
+	}
+}
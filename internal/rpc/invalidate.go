@@ -0,0 +1,73 @@
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"time"
+
+	"github.com/hnakamur/pipesecret/internal/audit"
+	"github.com/hnakamur/pipesecret/internal/unixsocketrpc"
+	"golang.org/x/exp/jsonrpc2"
+	"golang.org/x/xerrors"
+)
+
+// InvalidateRequestParams is the params of invalidate, which removes items
+// from the item cache of serve.
+type InvalidateRequestParams struct {
+	// Items are names of items to remove. If empty, all items are removed.
+	Items []string `json:",omitempty"`
+	// Peer is the process which requested on the remote host. It is set by
+	// remote-serve, and nil if unknown.
+	Peer *unixsocketrpc.Peer `json:",omitempty"`
+}
+
+// InvalidateResult is the result of invalidate.
+type InvalidateResult struct {
+	// Invalidated is the number of removed items.
+	Invalidated int
+}
+
+// invalidate removes items in params from the item cache, and returns the
+// result. Any remote host can remove items which other hosts got, so it is
+// recorded in the audit log. An item name "*" in the audit log means all
+// items.
+func invalidate(ctx context.Context, cfg LocalServerConfig, hostName string, params *InvalidateRequestParams, logger *slog.Logger) (string, error) {
+	startTime := time.Now()
+	var result InvalidateResult
+	if cfg.Cache != nil {
+		result.Invalidated = cfg.Cache.Invalidate(params.Items...)
+	}
+	logger.InfoContext(ctx, "invalidated item cache", "items", params.Items, "invalidated", result.Invalidated)
+
+	if cfg.Audit != nil {
+		items := params.Items
+		if len(items) == 0 {
+			items = []string{"*"}
+		}
+		for _, item := range items {
+			rec := audit.Record{
+				Time:      startTime,
+				Action:    audit.ActionInvalidate,
+				Host:      hostName,
+				Item:      item,
+				Result:    audit.ResultAllowed,
+				LatencyMS: float64(time.Since(startTime).Microseconds()) / 1000,
+			}
+			if p := params.Peer; p != nil {
+				rec.Peer = &audit.Peer{UID: p.UID, GID: p.GID, PID: p.PID, Exe: p.Exe}
+			}
+			if err := cfg.Audit.Log(rec); err != nil {
+				logger.ErrorContext(ctx, "failed to write audit log", "err", err)
+				return "", xerrors.Errorf("%w: %s", jsonrpc2.ErrInternal, err)
+			}
+		}
+	}
+
+	// Results are JSON in strings like getQueryItem.
+	data, err := json.Marshal(result)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
@@ -5,27 +5,183 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"io/fs"
 	"log/slog"
+	"math/rand/v2"
 	"os"
 	"os/exec"
 	"os/signal"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/GitRowin/orderedmapjson"
 	"github.com/hnakamur/pipesecret/internal"
+	"github.com/hnakamur/pipesecret/internal/approval"
+	"github.com/hnakamur/pipesecret/internal/audit"
 	"github.com/hnakamur/pipesecret/internal/myerrors"
 	"github.com/hnakamur/pipesecret/internal/piperpc"
+	"github.com/hnakamur/pipesecret/internal/policy"
 	"golang.org/x/exp/jsonrpc2"
 	"golang.org/x/xerrors"
 )
 
-func RunLocalServer(ctx context.Context, sshPath, host, remoteCommand, opExePath string) error {
-	logger := slog.Default().With("subcommand", "serve")
+// HostConfig is the configuration of a remote host which the local server
+// connects to with ssh.
+type HostConfig struct {
+	// Name is the name of the host used in logs and status.
+	// If empty, Host is used.
+	Name          string
+	SSHPath       string
+	Host          string
+	RemoteCommand string
+}
+
+func (h HostConfig) name() string {
+	if h.Name != "" {
+		return h.Name
+	}
+	return h.Host
+}
+
+// LocalServerConfig is the configuration of the local server.
+// The getter and the other settings are shared among all hosts.
+type LocalServerConfig struct {
+	Hosts   []HostConfig
+	Getter  internal.ItemGetter
+	Workers int
+	// Policy decides whether to allow requests if not nil.
+	Policy *policy.Policy
+	// Approver asks the human before getting an item if not nil.
+	Approver *approval.Approver
+	// QueryLimits bounds resources used by queries from remote hosts.
+	// If zero, internal.DefaultQueryLimits is used.
+	QueryLimits internal.QueryLimits
+	// Audit records requests for items if not nil.
+	Audit *audit.Logger
+	// Cache is the item cache used by Getter if not nil. It is flushed by
+	// invalidate requests.
+	Cache *internal.ItemCache
+	// Version is the version of the pipesecret binary sent to remote-serve
+	// in the initialize exchange.
+	Version string
+
+	// Reconnect makes the server restart ssh and remote-serve when ssh exits.
+	Reconnect bool
+	// MinBackoff and MaxBackoff are the range of the delay before
+	// reconnecting. The delay doubles after each failure.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+// stableConnectionDuration is the duration of a connection after which
+// the backoff delay is reset.
+const stableConnectionDuration = time.Minute
+
+// RunLocalServer runs a pipe to each host in cfg.Hosts concurrently and
+// returns after all pipes are finished.
+func RunLocalServer(ctx context.Context, cfg LocalServerConfig) error {
+	if len(cfg.Hosts) == 0 {
+		return errors.New("no host is configured")
+	}
+	names := make(map[string]bool)
+	for _, host := range cfg.Hosts {
+		if names[host.name()] {
+			return fmt.Errorf("duplicate host name: %s", host.name())
+		}
+		names[host.name()] = true
+	}
+
+	if cfg.QueryLimits == (internal.QueryLimits{}) {
+		cfg.QueryLimits = internal.DefaultQueryLimits
+	}
 
 	ctx, stop := signal.NotifyContext(ctx, os.Interrupt)
 	defer stop()
 
-	cmd := exec.CommandContext(ctx, sshPath, host, remoteCommand)
+	logger := slog.Default().With("subcommand", "serve")
+	statuses := make([]*hostStatus, len(cfg.Hosts))
+	for i, host := range cfg.Hosts {
+		statuses[i] = newHostStatus(host.name())
+	}
+	stopStatus := notifyStatusDump(ctx, logger, statuses)
+	defer stopStatus()
+
+	errs := make([]error, len(cfg.Hosts))
+	var wg sync.WaitGroup
+	for i, host := range cfg.Hosts {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = runHost(ctx, cfg, host, statuses[i])
+		}()
+	}
+	wg.Wait()
+	return myerrors.Join(errs...)
+}
+
+func runHost(ctx context.Context, cfg LocalServerConfig, host HostConfig, status *hostStatus) error {
+	logger := slog.Default().With("subcommand", "serve", "host", host.name())
+
+	if !cfg.Reconnect {
+		status.set(hostStateConnecting, nil)
+		err := runLocalServerOnce(ctx, cfg, host, status, logger)
+		status.set(hostStateStopped, err)
+		if err != nil {
+			return fmt.Errorf("host %s: %w", host.name(), err)
+		}
+		return nil
+	}
+
+	backoff := cfg.MinBackoff
+	for {
+		logger.InfoContext(ctx, "connecting to remote host")
+		status.set(hostStateConnecting, nil)
+		startTime := time.Now()
+		err := runLocalServerOnce(ctx, cfg, host, status, logger)
+		if ctx.Err() != nil {
+			logger.InfoContext(ctx, "stopped")
+			status.set(hostStateStopped, nil)
+			return nil
+		}
+		if errors.Is(err, ErrIncompatibleProtocol) {
+			// Reconnecting does not help until pipesecret is updated.
+			logger.ErrorContext(ctx, "stopped reconnecting", "err", err)
+			status.set(hostStateStopped, err)
+			return fmt.Errorf("host %s: %w", host.name(), err)
+		}
+		logger.WarnContext(ctx, "disconnected from remote host", "err", err)
+
+		if time.Since(startTime) >= stableConnectionDuration {
+			backoff = cfg.MinBackoff
+		}
+		delay := jitter(backoff)
+		logger.InfoContext(ctx, "waiting to reconnect", "delay", delay)
+		status.set(hostStateWaiting, err)
+		select {
+		case <-ctx.Done():
+			logger.InfoContext(ctx, "stopped")
+			status.set(hostStateStopped, nil)
+			return nil
+		case <-time.After(delay):
+		}
+		backoff = min(backoff*2, cfg.MaxBackoff)
+	}
+}
+
+// jitter returns a random duration between d/2 and d, so that clients
+// disconnected at the same time do not reconnect at the same time.
+func jitter(d time.Duration) time.Duration {
+	half := d / 2
+	return half + rand.N(d-half+1)
+}
+
+func runLocalServerOnce(ctx context.Context, cfg LocalServerConfig, host HostConfig, status *hostStatus, logger *slog.Logger) error {
+	sshCtx, killSSH := context.WithCancel(ctx)
+	defer killSSH()
+	cmd := exec.CommandContext(sshCtx, host.SSHPath, host.Host, host.RemoteCommand)
 	stdin, err := cmd.StdinPipe()
 	if err != nil {
 		return err
@@ -41,11 +197,18 @@ func RunLocalServer(ctx context.Context, sshPath, host, remoteCommand, opExePath
 	if err := cmd.Start(); err != nil {
 		return err
 	}
+	logger.InfoContext(ctx, "started ssh", "pid", cmd.Process.Pid)
 
 	go func() {
 		scanner := bufio.NewScanner(stderr)
 		for scanner.Scan() {
 			line := scanner.Bytes()
+			if !json.Valid(line) {
+				// Messages from ssh and fatal errors of remote-serve, such as
+				// an incompatible protocol, are not JSON and worth showing.
+				logger.WarnContext(ctx, "stderr from remote-serve", "line", string(line))
+				continue
+			}
 			logger.DebugContext(ctx, "stderr from remote-serve", "line", RemoteServerJSONLog{JSON: line})
 		}
 		if err := scanner.Err(); err != nil && !errors.Is(err, fs.ErrClosed) {
@@ -53,22 +216,94 @@ func RunLocalServer(ctx context.Context, sshPath, host, remoteCommand, opExePath
 		}
 	}()
 
+	// remote is set when remote-serve sends a compatible initialize request.
+	var remote atomic.Pointer[InitializeParams]
+	// incompatibleErr is set when remote-serve turns out to be incompatible.
+	var incompatibleErr atomic.Pointer[error]
+	// refusedID is the ID of the request refused first. ssh is killed after
+	// the response is written, since an older remote-serve may keep running
+	// without initialize.
+	var refusedID atomic.Pointer[jsonrpc2.ID]
+	refuse := func(id jsonrpc2.ID, err error) error {
+		if incompatibleErr.CompareAndSwap(nil, &err) {
+			refusedID.Store(&id)
+		}
+		logger.ErrorContext(ctx, "refused remote-serve", "err", err)
+		return xerrors.Errorf("%w: %s", jsonrpc2.ErrInvalidRequest, err)
+	}
+	framer := afterWriteFramer{
+		Framer: wireFramer{},
+		after: func(msg jsonrpc2.Message) {
+			if resp, ok := msg.(*jsonrpc2.Response); ok {
+				if id := refusedID.Load(); id != nil && *id == resp.ID {
+					killSSH()
+				}
+			}
+		},
+	}
+
 	handler := func(ctx context.Context, req *jsonrpc2.Request) (any, error) {
 		switch req.Method {
+		case initializeMethod, "heartbeat":
+		default:
+			if remote.Load() == nil {
+				return nil, refuse(req.ID, fmt.Errorf("%w: remote-serve called %s without %s; it may be older than serve %s",
+					ErrIncompatibleProtocol, req.Method, initializeMethod, cfg.Version))
+			}
+		}
+
+		switch req.Method {
+		case initializeMethod:
+			var params InitializeParams
+			if err := json.Unmarshal(req.Params, &params); err != nil {
+				return nil, xerrors.Errorf("%w: %s", jsonrpc2.ErrParse, err)
+			}
+			if err := checkCompatible(params, cfg.Version); err != nil {
+				return nil, refuse(req.ID, err)
+			}
+			remote.Store(&params)
+			// The host stays connecting until remote-serve turns out to
+			// be compatible.
+			status.set(hostStateConnected, nil)
+			logger.InfoContext(ctx, "initialized", "remoteVersion", params.Version, "protocolVersion", params.ProtocolVersion)
+			return InitializeParams{
+				Version:         cfg.Version,
+				ProtocolVersion: ProtocolVersion,
+				Methods:         localMethods,
+			}, nil
 		case "getQueryItem":
+			status.addRequest()
 			var params GetQueryItemRequestParams
 			if err := json.Unmarshal(req.Params, &params); err != nil {
 				return nil, xerrors.Errorf("%w: %s", jsonrpc2.ErrParse, err)
 			}
-			getter, err := internal.NewOnePasswordItemGetter(opExePath)
-			if err != nil {
-				return nil, xerrors.Errorf("%w: %s", jsonrpc2.ErrInternal, err)
+			logger.DebugContext(ctx, "getQueryItem", "item", params.Item, "peer", params.Peer)
+			startTime := time.Now()
+			result, err := getQueryItem(ctx, cfg, host.name(), &params, logger)
+			if auditErr := auditItem(ctx, cfg, host.name(), &params, startTime, err, logger); auditErr != nil {
+				return nil, auditErr
 			}
-			result, err := internal.GetQueryItem(ctx, getter, params.Item, params.Query)
 			if err != nil {
-				return nil, xerrors.Errorf("%w: %s", jsonrpc2.ErrInvalidRequest, err)
+				return nil, newResponseError(err, ErrorData{Host: host.name(), Item: params.Item})
 			}
 			return result, nil
+		case "getQueryItems":
+			status.addRequest()
+			var params GetQueryItemsRequestParams
+			if err := json.Unmarshal(req.Params, &params); err != nil {
+				return nil, xerrors.Errorf("%w: %s", jsonrpc2.ErrParse, err)
+			}
+			if err := params.validate(); err != nil {
+				return nil, xerrors.Errorf("%w: %s", jsonrpc2.ErrInvalidParams, err)
+			}
+			logger.DebugContext(ctx, "getQueryItems", "items", len(params.Items), "peer", params.Peer)
+			return getQueryItems(ctx, cfg, host.name(), &params, logger)
+		case "invalidate":
+			var params InvalidateRequestParams
+			if err := json.Unmarshal(req.Params, &params); err != nil {
+				return nil, xerrors.Errorf("%w: %s", jsonrpc2.ErrParse, err)
+			}
+			return invalidate(ctx, cfg, host.name(), &params, logger)
 		case "heartbeat":
 			return "ack", nil
 		default:
@@ -76,8 +311,12 @@ func RunLocalServer(ctx context.Context, sshPath, host, remoteCommand, opExePath
 		}
 	}
 
-	server := piperpc.NewServer(jsonrpc2.RawFramer(), jsonrpc2.HandlerFunc(handler))
-	localErr := server.Run(ctx, stdout, stdin)
+	server := piperpc.NewServer(framer, jsonrpc2.HandlerFunc(handler), cfg.Workers)
+	localErr := server.Run(sshCtx, stdout, stdin)
+	if localErr != nil {
+		// ssh may be still running when the pipe is broken.
+		killSSH()
+	}
 	remoteErr := cmd.Wait()
 	if remoteErr != nil {
 		if errors.Is(ctx.Err(), context.Canceled) {
@@ -87,9 +326,179 @@ func RunLocalServer(ctx context.Context, sshPath, host, remoteCommand, opExePath
 		}
 	}
 
+	if err := incompatibleErr.Load(); err != nil {
+		// localErr and remoteErr are caused by killing ssh.
+		return *err
+	}
 	return myerrors.Join(localErr, remoteErr)
 }
 
+// afterWriteFramer is a framer whose writers call after for each message
+// written.
+type afterWriteFramer struct {
+	jsonrpc2.Framer
+	after func(jsonrpc2.Message)
+}
+
+func (f afterWriteFramer) Writer(w io.Writer) jsonrpc2.Writer {
+	return afterWriter{Writer: f.Framer.Writer(w), after: f.after}
+}
+
+type afterWriter struct {
+	jsonrpc2.Writer
+	after func(jsonrpc2.Message)
+}
+
+func (w afterWriter) Write(ctx context.Context, msg jsonrpc2.Message) (int64, error) {
+	n, err := w.Writer.Write(ctx, msg)
+	w.after(msg)
+	return n, err
+}
+
+// getQueryItem gets the item after allowed by the policy and approved,
+// and returns the query result. Errors are converted to error responses
+// by newResponseError.
+func getQueryItem(ctx context.Context, cfg LocalServerConfig, hostName string, params *GetQueryItemRequestParams, logger *slog.Logger) (string, error) {
+	getter, err := allowItem(ctx, cfg, hostName, params, false, logger)
+	if err != nil {
+		return "", err
+	}
+	result, err := internal.GetQueryItem(ctx, getter, params.Item, params.Query, cfg.QueryLimits)
+	if err != nil {
+		return "", err
+	}
+	if err := checkResult(ctx, cfg, getter, params.Item, result, logger); err != nil {
+		return "", err
+	}
+	return result, nil
+}
+
+// checkResult checks the result of the query for the item with the policy.
+// getter must be the one returned by allowItem, which keeps the item.
+func checkResult(ctx context.Context, cfg LocalServerConfig, getter internal.ItemGetter, itemName, result string, logger *slog.Logger) error {
+	if cfg.Policy == nil {
+		return nil
+	}
+	item, err := getter.GetItem(ctx, itemName)
+	if err != nil {
+		return err
+	}
+	if err := cfg.Policy.CheckResult(itemName, item, result); err != nil {
+		logger.InfoContext(ctx, "result not allowed by policy", "item", itemName, "err", err)
+		return err
+	}
+	return nil
+}
+
+// allowItem checks the policy and asks approval for getting the item with
+// the query in params, and returns the getter to get the item. itemsQuery is
+// true if the query is a query for all items of getQueryItems.
+func allowItem(ctx context.Context, cfg LocalServerConfig, hostName string, params *GetQueryItemRequestParams, itemsQuery bool, logger *slog.Logger) (internal.ItemGetter, error) {
+	getter := cfg.Getter
+	// The item may be got for tags in the policy, and then it is reused.
+	memo := &memoItemGetter{getter: cfg.Getter}
+	policyReq := policy.Request{
+		Host:       hostName,
+		Item:       params.Item,
+		Query:      params.Query,
+		ItemsQuery: itemsQuery,
+		Tags: func() ([]string, error) {
+			item, err := memo.GetItem(ctx, params.Item)
+			if err != nil {
+				return nil, err
+			}
+			return policy.ItemTags(item)
+		},
+	}
+	if cfg.Policy != nil {
+		if err := cfg.Policy.Check(policyReq); err != nil {
+			logger.InfoContext(ctx, "request not allowed by policy", "item", params.Item, "err", err)
+			return nil, err
+		}
+		getter = memo
+	}
+	if cfg.Approver != nil {
+		err := cfg.Approver.Approve(ctx, approval.Request{
+			Host:       hostName,
+			Item:       params.Item,
+			Query:      params.Query,
+			ItemsQuery: itemsQuery,
+			Peer:       params.Peer,
+		})
+		if err != nil {
+			logger.InfoContext(ctx, "request not approved", "item", params.Item, "err", err)
+			return nil, err
+		}
+	}
+	if cfg.Policy != nil {
+		// The item is got after approval, as it is for the query anyway.
+		item, err := memo.GetItem(ctx, params.Item)
+		if err != nil {
+			return nil, err
+		}
+		names, err := policy.ItemNames(item)
+		if err != nil {
+			return nil, err
+		}
+		if err := cfg.Policy.CheckResolved(policyReq, names); err != nil {
+			logger.InfoContext(ctx, "request not allowed by policy", "item", params.Item, "err", err)
+			return nil, err
+		}
+	}
+	return getter, nil
+}
+
+// memoItemGetter keeps the item got first, so that the item is got only once
+// in a request.
+type memoItemGetter struct {
+	getter internal.ItemGetter
+	name   string
+	item   string
+}
+
+func (g *memoItemGetter) GetItem(ctx context.Context, itemName string) (string, error) {
+	if g.item != "" && g.name == itemName {
+		return g.item, nil
+	}
+	item, err := g.getter.GetItem(ctx, itemName)
+	if err != nil {
+		return "", err
+	}
+	g.name, g.item = itemName, item
+	return item, nil
+}
+
+// auditItem writes the audit log record of getting the item in params if
+// the audit log is enabled. It returns an error to respond if it fails,
+// since an item which is not recorded must not be returned.
+func auditItem(ctx context.Context, cfg LocalServerConfig, hostName string, params *GetQueryItemRequestParams, startTime time.Time, err error, logger *slog.Logger) error {
+	if cfg.Audit == nil {
+		return nil
+	}
+	if auditErr := writeAuditLog(cfg.Audit, hostName, params, startTime, err); auditErr != nil {
+		logger.ErrorContext(ctx, "failed to write audit log", "err", auditErr)
+		return xerrors.Errorf("%w: %s", jsonrpc2.ErrInternal, auditErr)
+	}
+	return nil
+}
+
+func writeAuditLog(logger *audit.Logger, hostName string, params *GetQueryItemRequestParams, startTime time.Time, err error) error {
+	result, reason := audit.Classify(err)
+	rec := audit.Record{
+		Time:        startTime,
+		Host:        hostName,
+		Item:        params.Item,
+		QuerySHA256: audit.HashQuery(params.Query),
+		Result:      result,
+		Reason:      reason,
+		LatencyMS:   float64(time.Since(startTime).Microseconds()) / 1000,
+	}
+	if p := params.Peer; p != nil {
+		rec.Peer = &audit.Peer{UID: p.UID, GID: p.GID, PID: p.PID, Exe: p.Exe}
+	}
+	return logger.Log(rec)
+}
+
 type RemoteServerJSONLog struct {
 	JSON []byte
 }
@@ -97,7 +506,8 @@ type RemoteServerJSONLog struct {
 func (m RemoteServerJSONLog) LogValue() slog.Value {
 	var obj *orderedmapjson.AnyOrderedMap
 	if err := json.Unmarshal(m.JSON, &obj); err != nil {
-		panic(err)
+		// ssh itself may write messages which are not JSON.
+		return slog.StringValue(string(m.JSON))
 	}
 
 	return slog.AnyValue(obj)
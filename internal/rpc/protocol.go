@@ -0,0 +1,57 @@
+package rpc
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+)
+
+// ProtocolVersion is the version of the protocol between serve and
+// remote-serve. It must be incremented on incompatible changes of the pipe
+// RPC, such as changing request params of existing methods.
+// Adding a new method does not need a new version, since methods are
+// advertised in the initialize exchange.
+const ProtocolVersion = 1
+
+// initializeMethod is the method of the first request which remote-serve
+// sends to serve over the pipe.
+const initializeMethod = "initialize"
+
+// ErrIncompatibleProtocol is returned when serve and remote-serve cannot
+// talk with each other.
+var ErrIncompatibleProtocol = errors.New("incompatible protocol")
+
+// InitializeParams is the params of the initialize request, and also the
+// result of it. Each side sends its own information.
+type InitializeParams struct {
+	// Version is the version of the pipesecret binary.
+	Version string
+	// ProtocolVersion is ProtocolVersion of the binary.
+	ProtocolVersion int
+	// Methods is the list of methods which the sender handles.
+	// For serve, these are methods over the pipe. For remote-serve, these are
+	// methods over the unix socket.
+	Methods []string
+}
+
+// localMethods is the list of methods which serve handles over the pipe.
+var localMethods = []string{initializeMethod, "heartbeat", "getQueryItem", "getQueryItems", "invalidate"}
+
+// remoteMethods is the list of methods which remote-serve handles over the
+// unix socket.
+var remoteMethods = []string{"getQueryItem", "getQueryItems", "invalidate"}
+
+// checkCompatible returns an error wrapping ErrIncompatibleProtocol if peer
+// cannot talk with this binary whose version is version.
+func checkCompatible(peer InitializeParams, version string) error {
+	if peer.ProtocolVersion != ProtocolVersion {
+		return fmt.Errorf("%w: protocol version %d of peer pipesecret %s does not match protocol version %d of this pipesecret %s; install the same version on both sides",
+			ErrIncompatibleProtocol, peer.ProtocolVersion, peer.Version, ProtocolVersion, version)
+	}
+	return nil
+}
+
+// supports returns whether the peer handles method.
+func (p InitializeParams) supports(method string) bool {
+	return slices.Contains(p.Methods, method)
+}
@@ -0,0 +1,95 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/hnakamur/pipesecret/internal/piperpc"
+	"golang.org/x/exp/jsonrpc2"
+)
+
+func TestRemoteServerInitialize(t *testing.T) {
+	testCases := []struct {
+		name    string
+		handler jsonrpc2.HandlerFunc
+	}{
+		{
+			name: "protocolVersionMismatch",
+			handler: func(ctx context.Context, req *jsonrpc2.Request) (any, error) {
+				if req.Method == initializeMethod {
+					return InitializeParams{Version: "v99.0.0", ProtocolVersion: ProtocolVersion + 1}, nil
+				}
+				return "ack", nil
+			},
+		},
+		{
+			name: "initializeNotSupported",
+			handler: func(ctx context.Context, req *jsonrpc2.Request) (any, error) {
+				if req.Method == initializeMethod {
+					return nil, jsonrpc2.ErrNotHandled
+				}
+				return "ack", nil
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			// Connect remote-serve and a fake serve with pipes.
+			remoteR, localW := io.Pipe()
+			localR, remoteW := io.Pipe()
+			server := piperpc.NewServer(jsonrpc2.RawFramer(), tc.handler, 1)
+			go server.Run(ctx, localR, localW)
+
+			socketPath := filepath.Join(t.TempDir(), "pipesecret.sock")
+			s := NewRemoteServer(RemoteServerConfig{
+				SocketPath:        socketPath,
+				HeartbeatInterval: time.Minute,
+				Version:           "v1.0.0",
+			})
+			err := s.Run(ctx, remoteW, remoteR)
+			if !errors.Is(err, ErrIncompatibleProtocol) {
+				t.Errorf("err mismatch, got=%v, want=%v", err, ErrIncompatibleProtocol)
+			}
+		})
+	}
+}
+
+func TestRunHostRefuseRemoteServe(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake ssh is a shell script")
+	}
+	// The fake ssh acts as an older remote-serve which does not send
+	// initialize and keeps running.
+	sshPath := filepath.Join(t.TempDir(), "ssh")
+	script := `#!/bin/sh
+echo '{"jsonrpc":"2.0","id":1,"method":"getQueryItem","params":{"item":"test1","query":"."}}'
+exec sleep 60
+`
+	if err := os.WriteFile(sshPath, []byte(script), 0o700); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	cfg := LocalServerConfig{
+		Version:    "v1.0.0",
+		Workers:    1,
+		Reconnect:  true,
+		MinBackoff: time.Millisecond,
+		MaxBackoff: time.Millisecond,
+	}
+	host := HostConfig{SSHPath: sshPath, Host: "example.com", RemoteCommand: "pipesecret remote-serve"}
+	err := runHost(ctx, cfg, host, newHostStatus(host.name()))
+	if !errors.Is(err, ErrIncompatibleProtocol) {
+		t.Errorf("err mismatch, got=%v, want=%v", err, ErrIncompatibleProtocol)
+	}
+}
@@ -3,6 +3,7 @@ package rpc
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"log/slog"
 	"time"
 
@@ -10,6 +11,8 @@ import (
 	"golang.org/x/xerrors"
 )
 
+// GetQueryItem gets the query result for the item from remote-serve.
+// If serve fails to get the result, the error is *Error.
 func GetQueryItem(ctx context.Context, socketPath string, timeout time.Duration, itemName, query string) (any, error) {
 	logger := slog.Default().With("program", "unixSocketClient")
 	logger.DebugContext(ctx, "GetQueryItem", "socketPath", socketPath)
@@ -20,18 +23,110 @@ func GetQueryItem(ctx context.Context, socketPath string, timeout time.Duration,
 	}
 	defer client.Close()
 
+	return callGetQueryItem(ctx, client, itemName, query)
+}
+
+func callGetQueryItem(ctx context.Context, client *unixsocketrpc.Client, itemName, query string) (any, error) {
 	params := GetQueryItemRequestParams{
 		Item:  itemName,
 		Query: query,
 	}
 	resultJSON, _, err := client.CallSync(ctx, "getQueryItem", params)
 	if err != nil {
+		if rpcErr := asError(err); rpcErr != nil {
+			return nil, rpcErr
+		}
 		return nil, xerrors.Errorf("failed to call getQueryItem: %s", err)
 	}
 
 	var resultObj any
 	if err := json.Unmarshal([]byte(resultJSON), &resultObj); err != nil {
+		return nil, xerrors.Errorf("failed to parse result of getQueryItem: %s", err)
+	}
+	return resultObj, nil
+}
+
+// GetQueryItems gets multiple items from remote-serve in a request.
+// See GetQueryItemsRequestParams for query and the result.
+// If serve fails to get the result, the error is *Error.
+//
+// If serve or remote-serve is older and does not support getQueryItems,
+// items are got one by one with queries for each item. query for all items
+// is not supported in that case.
+func GetQueryItems(ctx context.Context, socketPath string, timeout time.Duration, items []ItemQuery, query string) (any, error) {
+	logger := slog.Default().With("program", "unixSocketClient")
+	logger.DebugContext(ctx, "GetQueryItems", "socketPath", socketPath, "items", len(items))
+
+	client, err := unixsocketrpc.Connect(ctx, socketPath, timeout)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to connect unix socket server: %s", err)
+	}
+	defer client.Close()
+
+	params := GetQueryItemsRequestParams{
+		Items: items,
+		Query: query,
+	}
+	resultJSON, _, err := client.CallSync(ctx, "getQueryItems", params)
+	if err != nil {
+		if isMethodNotFound(err) {
+			if query != "" {
+				return nil, errors.New("pipesecret on the local machine or the remote host is too old to run a query for multiple items; update it")
+			}
+			logger.DebugContext(ctx, "getQueryItems not supported, getting items one by one")
+			return getQueryItemsOneByOne(ctx, client, items)
+		}
+		if rpcErr := asError(err); rpcErr != nil {
+			return nil, rpcErr
+		}
+		return nil, xerrors.Errorf("failed to call getQueryItems: %s", err)
+	}
 
+	var resultObj any
+	if err := json.Unmarshal([]byte(resultJSON), &resultObj); err != nil {
+		return nil, xerrors.Errorf("failed to parse result of getQueryItems: %s", err)
 	}
 	return resultObj, nil
 }
+
+func getQueryItemsOneByOne(ctx context.Context, client *unixsocketrpc.Client, items []ItemQuery) (any, error) {
+	results := make(map[string]any, len(items))
+	for _, iq := range items {
+		result, err := callGetQueryItem(ctx, client, iq.Item, iq.Query)
+		if err != nil {
+			return nil, err
+		}
+		results[iq.Alias] = result
+	}
+	return results, nil
+}
+
+// Invalidate removes items from the item cache of serve, or all items if
+// itemNames is empty, and returns the number of removed items.
+func Invalidate(ctx context.Context, socketPath string, timeout time.Duration, itemNames []string) (int, error) {
+	logger := slog.Default().With("program", "unixSocketClient")
+	logger.DebugContext(ctx, "Invalidate", "socketPath", socketPath, "items", itemNames)
+
+	client, err := unixsocketrpc.Connect(ctx, socketPath, timeout)
+	if err != nil {
+		return 0, xerrors.Errorf("failed to connect unix socket server: %s", err)
+	}
+	defer client.Close()
+
+	resultJSON, _, err := client.CallSync(ctx, "invalidate", InvalidateRequestParams{Items: itemNames})
+	if err != nil {
+		if isMethodNotFound(err) {
+			return 0, errors.New("pipesecret on the local machine or the remote host is too old to invalidate the item cache; update it")
+		}
+		if rpcErr := asError(err); rpcErr != nil {
+			return 0, rpcErr
+		}
+		return 0, xerrors.Errorf("failed to call invalidate: %s", err)
+	}
+
+	var result InvalidateResult
+	if err := json.Unmarshal([]byte(resultJSON), &result); err != nil {
+		return 0, xerrors.Errorf("failed to parse result of invalidate: %s", err)
+	}
+	return result.Invalidated, nil
+}
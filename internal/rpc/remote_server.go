@@ -3,6 +3,7 @@ package rpc
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"log/slog"
 
 	"fmt"
@@ -20,48 +21,131 @@ import (
 
 type RemoteServer struct {
 	socketPath        string
+	allowlist         unixsocketrpc.PeerAllowlist
 	framer            jsonrpc2.Framer
 	requestC          chan piperpc.RequestQueueItem
 	heartbeatInterval time.Duration
+	version           string
+
+	// local is the information of serve received in the initialize
+	// exchange. It is set before the unix socket server starts.
+	local InitializeParams
+}
+
+// RemoteServerConfig is the configuration of the remote server.
+type RemoteServerConfig struct {
+	SocketPath string
+	// Allowlist decides which processes can use the unix socket.
+	Allowlist         unixsocketrpc.PeerAllowlist
+	HeartbeatInterval time.Duration
+	// Version is the version of the pipesecret binary sent to serve in
+	// the initialize exchange.
+	Version string
 }
 
-func NewRemoteServer(socketPath string, heartbeatInterval time.Duration) *RemoteServer {
+func NewRemoteServer(cfg RemoteServerConfig) *RemoteServer {
 	return &RemoteServer{
-		socketPath:        socketPath,
+		socketPath:        cfg.SocketPath,
+		allowlist:         cfg.Allowlist,
 		framer:            jsonrpc2.RawFramer(),
 		requestC:          make(chan piperpc.RequestQueueItem, 1),
-		heartbeatInterval: heartbeatInterval,
+		heartbeatInterval: cfg.HeartbeatInterval,
+		version:           cfg.Version,
 	}
 }
 
 type GetQueryItemRequestParams struct {
 	Item  string
 	Query string
+	// Peer is the process which requested the item on the remote host.
+	// It is set by remote-serve, and nil if unknown.
+	Peer *unixsocketrpc.Peer `json:",omitempty"`
 }
 
 const shutdownMethod = "shutdown"
 
 func (s *RemoteServer) Run(ctx context.Context, out io.WriteCloser, in io.Reader) error {
+	// Stop the unix socket server when the pipe is closed, so that serve
+	// can start a new remote-serve listening on the same socket path.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
 	var unixsocketErr, pipeErr error
 	var wg sync.WaitGroup
 	wg.Add(2)
 	go func() {
 		defer wg.Done()
+		// Do not accept run clients until serve turns out to be compatible.
+		if err := s.initialize(ctx); err != nil {
+			if ctx.Err() == nil {
+				// Otherwise the pipe has been closed before initialized.
+				unixsocketErr = err
+			}
+			cancel()
+			return
+		}
 		unixsocketErr = s.runUnixSocketServer(ctx)
 	}()
 	go func() {
 		defer wg.Done()
+		defer cancel()
 		pipeErr = s.runPipeClient(ctx, out, in)
+		if errors.Is(pipeErr, io.EOF) {
+			slog.DebugContext(ctx, "pipe closed by serve")
+			pipeErr = nil
+		}
 	}()
 	wg.Wait()
 
 	return myerrors.Join(unixsocketErr, pipeErr)
 }
 
+// initialize sends the initialize request to serve and checks the result.
+func (s *RemoteServer) initialize(ctx context.Context) error {
+	params := InitializeParams{
+		Version:         s.version,
+		ProtocolVersion: ProtocolVersion,
+		Methods:         remoteMethods,
+	}
+	req, err := jsonrpc2.NewCall(jsonrpc2.Int64ID(0), initializeMethod, params)
+	if err != nil {
+		return err
+	}
+	resultC := make(chan *jsonrpc2.Response, 1)
+	select {
+	case s.requestC <- piperpc.RequestQueueItem{Context: ctx, Request: req, ResultC: resultC}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	var resp *jsonrpc2.Response
+	select {
+	case resp = <-resultC:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if resp.Error != nil {
+		if isMethodNotFound(resp.Error) {
+			return fmt.Errorf("%w: serve on the local machine does not support %s; it is older than remote-serve %s",
+				ErrIncompatibleProtocol, initializeMethod, s.version)
+		}
+		return fmt.Errorf("%w: serve refused initialize: %s", ErrIncompatibleProtocol, resp.Error)
+	}
+	var local InitializeParams
+	if err := json.Unmarshal(resp.Result, &local); err != nil {
+		return fmt.Errorf("%w: failed to parse initialize result: %s", ErrIncompatibleProtocol, err)
+	}
+	if err := checkCompatible(local, s.version); err != nil {
+		return err
+	}
+	s.local = local
+	slog.DebugContext(ctx, "initialized", "localVersion", local.Version, "localMethods", local.Methods)
+	return nil
+}
+
 func (s *RemoteServer) runUnixSocketServer(ctx context.Context) error {
 	logger := slog.Default().With("program", "remote-serve")
 
-	us, err := unixsocketrpc.Listen(ctx, s.socketPath)
+	us, err := unixsocketrpc.Listen(ctx, s.socketPath, s.allowlist)
 	if err != nil {
 		return err
 	}
@@ -72,26 +156,33 @@ func (s *RemoteServer) runUnixSocketServer(ctx context.Context) error {
 		defer func() {
 			logger.DebugContext(ctx, "handler exit", "method", req.Method)
 		}()
+		if !s.local.supports(req.Method) {
+			return nil, jsonrpc2.ErrNotHandled
+		}
+		// Do not trust Peer sent by the client.
+		peer := unixsocketrpc.PeerFromContext(ctx)
 		switch req.Method {
 		case "getQueryItem":
 			var params GetQueryItemRequestParams
 			if err := json.Unmarshal(req.Params, &params); err != nil {
 				return nil, xerrors.Errorf("%w: %s", jsonrpc2.ErrParse, err)
 			}
-			resultC := make(chan *jsonrpc2.Response)
-			s.requestC <- piperpc.RequestQueueItem{
-				Request: req,
-				ResultC: resultC,
+			params.Peer = peer
+			return s.forward(ctx, req, params, logger)
+		case "getQueryItems":
+			var params GetQueryItemsRequestParams
+			if err := json.Unmarshal(req.Params, &params); err != nil {
+				return nil, xerrors.Errorf("%w: %s", jsonrpc2.ErrParse, err)
 			}
-			select {
-			case <-ctx.Done():
-				logger.DebugContext(ctx, "unixSocketServer received ctx.Done", "err", ctx.Err())
-				return nil, ctx.Err()
-			case result := <-resultC:
-				logger.DebugContext(ctx, "unixSocketServer received result",
-					"result", jsonrpc2debug.DebugMarshalMessage{Msg: result})
-				return result.Result, result.Error
+			params.Peer = peer
+			return s.forward(ctx, req, params, logger)
+		case "invalidate":
+			var params InvalidateRequestParams
+			if err := json.Unmarshal(req.Params, &params); err != nil {
+				return nil, xerrors.Errorf("%w: %s", jsonrpc2.ErrParse, err)
 			}
+			params.Peer = peer
+			return s.forward(ctx, req, params, logger)
 		default:
 			return nil, jsonrpc2.ErrNotHandled
 		}
@@ -103,6 +194,33 @@ func (s *RemoteServer) runUnixSocketServer(ctx context.Context) error {
 	return nil
 }
 
+// forward sends req with params to serve and returns the result.
+func (s *RemoteServer) forward(ctx context.Context, req *jsonrpc2.Request, params any, logger *slog.Logger) (any, error) {
+	fwdReq, err := jsonrpc2.NewCall(req.ID, req.Method, params)
+	if err != nil {
+		return nil, err
+	}
+	resultC := make(chan *jsonrpc2.Response, 1)
+	select {
+	case s.requestC <- piperpc.RequestQueueItem{
+		Context: ctx,
+		Request: fwdReq,
+		ResultC: resultC,
+	}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	select {
+	case <-ctx.Done():
+		logger.DebugContext(ctx, "unixSocketServer received ctx.Done", "err", ctx.Err())
+		return nil, ctx.Err()
+	case result := <-resultC:
+		logger.DebugContext(ctx, "unixSocketServer received result",
+			"result", jsonrpc2debug.DebugMarshalMessage{Msg: result})
+		return result.Result, result.Error
+	}
+}
+
 func (s *RemoteServer) runPipeClient(ctx context.Context, out io.Writer, in io.Reader) error {
 	client := piperpc.NewClient(jsonrpc2.RawFramer(), s.requestC, s.heartbeatInterval)
 	return client.Run(ctx, out, in)
@@ -0,0 +1,127 @@
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"reflect"
+
+	"golang.org/x/exp/jsonrpc2"
+)
+
+// This file adapts errors of jsonrpc2 to JSON-RPC error objects. jsonrpc2
+// does not export its error type and cannot respond with data, so errors
+// with data are responseError written by wireFramer, and error objects of
+// errors made by jsonrpc2 are read with the exported message encoding.
+// wire_error_test.go checks this against the version of jsonrpc2 in go.mod.
+
+// wireErrorObject is the JSON-RPC error object.
+type wireErrorObject struct {
+	Code    int64           `json:"code"`
+	Message string          `json:"message"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+// wireResponse is the JSON-RPC response object with an error.
+type wireResponse struct {
+	JSONRPC string           `json:"jsonrpc"`
+	ID      any              `json:"id"`
+	Error   *wireErrorObject `json:"error,omitempty"`
+}
+
+// responseError is an error which a handler returns to respond with the
+// error object, including data. Responses with it must be written by
+// wireFramer, since jsonrpc2 drops its code and data.
+type responseError struct {
+	obj wireErrorObject
+}
+
+func (e *responseError) Error() string { return e.obj.Message }
+
+func (e *responseError) MarshalJSON() ([]byte, error) {
+	return json.Marshal(e.obj)
+}
+
+// wireFramer is jsonrpc2.RawFramer which writes responses with
+// responseError.
+type wireFramer struct{}
+
+func (wireFramer) Reader(r io.Reader) jsonrpc2.Reader {
+	return jsonrpc2.RawFramer().Reader(r)
+}
+
+func (wireFramer) Writer(w io.Writer) jsonrpc2.Writer {
+	return &wireWriter{out: w, raw: jsonrpc2.RawFramer().Writer(w)}
+}
+
+type wireWriter struct {
+	out io.Writer
+	raw jsonrpc2.Writer
+}
+
+func (w *wireWriter) Write(ctx context.Context, msg jsonrpc2.Message) (int64, error) {
+	resp, ok := msg.(*jsonrpc2.Response)
+	var respErr *responseError
+	if !ok || !errors.As(resp.Error, &respErr) {
+		return w.raw.Write(ctx, msg)
+	}
+	select {
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	default:
+	}
+	data, err := json.Marshal(wireResponse{JSONRPC: "2.0", ID: resp.ID.Raw(), Error: &respErr.obj})
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.out.Write(data)
+	return int64(n), err
+}
+
+// jsonrpc2ErrorType is the type of errors which jsonrpc2 makes for error
+// objects, such as errors received in responses and jsonrpc2.ErrParse.
+var jsonrpc2ErrorType = reflect.TypeOf(jsonrpc2.ErrUnknown)
+
+// wireErrorOf returns the JSON-RPC error object of the innermost error in
+// the chain of err which is an error object, that is, responseError or an
+// error made by jsonrpc2 such as an error received in a response. It returns
+// false if there is no such error.
+func wireErrorOf(err error) (wireErrorObject, bool) {
+	var found error
+	for ; err != nil; err = errors.Unwrap(err) {
+		if _, ok := err.(*responseError); ok || reflect.TypeOf(err) == jsonrpc2ErrorType {
+			found = err
+		}
+	}
+	if found == nil {
+		return wireErrorObject{}, false
+	}
+	if respErr, ok := found.(*responseError); ok {
+		return respErr.obj, true
+	}
+	data, err := jsonrpc2.EncodeMessage(&jsonrpc2.Response{ID: jsonrpc2.Int64ID(0), Error: found})
+	if err != nil {
+		return wireErrorObject{}, false
+	}
+	var resp wireResponse
+	if err := json.Unmarshal(data, &resp); err != nil || resp.Error == nil {
+		return wireErrorObject{}, false
+	}
+	return *resp.Error, true
+}
+
+// codeMethodNotFound is the code of jsonrpc2.ErrMethodNotFound.
+var codeMethodNotFound = func() int64 {
+	obj, _ := wireErrorOf(jsonrpc2.ErrMethodNotFound)
+	return obj.Code
+}()
+
+// isMethodNotFound returns whether err received in a response means the
+// peer does not handle the method.
+func isMethodNotFound(err error) bool {
+	obj, ok := wireErrorOf(err)
+	// Servers before the initialize exchange was added respond with
+	// jsonrpc2.ErrNotHandled, which jsonrpc2 encodes with code 0.
+	return ok && (obj.Code == codeMethodNotFound || obj.Code == 0)
+}
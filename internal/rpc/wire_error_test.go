@@ -0,0 +1,79 @@
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"testing"
+
+	"golang.org/x/exp/jsonrpc2"
+)
+
+// receive returns the error which a client receives for err returned from
+// a handler of a server with wireFramer.
+func receive(t *testing.T, err error) error {
+	t.Helper()
+	resp, err := jsonrpc2.NewResponse(jsonrpc2.Int64ID(1), nil, err)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	if _, err := (wireFramer{}).Writer(&b).Write(context.Background(), resp); err != nil {
+		t.Fatal(err)
+	}
+	msg, _, err := (wireFramer{}).Reader(&b).Read(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, ok := msg.(*jsonrpc2.Response)
+	if !ok || got.ID != resp.ID {
+		t.Fatalf("response mismatch, got=%+v, want=%+v", msg, resp)
+	}
+	return got.Error
+}
+
+func TestWireError(t *testing.T) {
+	want := wireErrorObject{Code: CodeItemNotFound, Message: "item not found: test1", Data: json.RawMessage(`{"item":"test1"}`)}
+	err := &responseError{obj: want}
+	for _, received := range []error{err, receive(t, err), fmt.Errorf("wrapped: %w", receive(t, err))} {
+		got, ok := wireErrorOf(received)
+		if !ok {
+			t.Errorf("error object not found in %v", received)
+			continue
+		}
+		if got.Code != want.Code || got.Message != want.Message || string(got.Data) != string(want.Data) {
+			t.Errorf("error object mismatch, got=%+v, want=%+v", got, want)
+		}
+	}
+
+	if _, ok := wireErrorOf(fmt.Errorf("no code")); ok {
+		t.Error("error which is not received should not have an error object")
+	}
+	// jsonrpc2 keeps the code of a wrapped error.
+	if got, _ := wireErrorOf(receive(t, fmt.Errorf("%w: detail", jsonrpc2.ErrParse))); got.Code != -32700 {
+		t.Errorf("code mismatch, got=%d, want=%d", got.Code, -32700)
+	}
+}
+
+func TestIsMethodNotFound(t *testing.T) {
+	testCases := []struct {
+		err  error
+		want bool
+	}{
+		{err: receive(t, jsonrpc2.ErrMethodNotFound), want: true},
+		{err: receive(t, fmt.Errorf("%w: %q", jsonrpc2.ErrMethodNotFound, "getQueryItems")), want: true},
+		// Servers before the initialize exchange was added.
+		{err: receive(t, jsonrpc2.ErrNotHandled), want: true},
+		{err: receive(t, jsonrpc2.ErrInternal), want: false},
+		{err: receive(t, fmt.Errorf("%w: other error", jsonrpc2.ErrUnknown)), want: false},
+		// Errors which are not received, such as a broken connection.
+		{err: fmt.Errorf("failed to wait result: %w", io.EOF), want: false},
+	}
+	for _, tc := range testCases {
+		if got := isMethodNotFound(tc.err); got != tc.want {
+			t.Errorf("result mismatch for %v, got=%v, want=%v", tc.err, got, tc.want)
+		}
+	}
+}
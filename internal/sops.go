@@ -0,0 +1,151 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+
+	"filippo.io/age"
+	"go.yaml.in/yaml/v3"
+)
+
+type encryptedFileItemGetter struct {
+	path         string
+	identityPath string
+	sopsExePath  string
+}
+
+// NewEncryptedFileItemGetter returns an ItemGetter which reads items from
+// an encrypted YAML or JSON file. Each top-level key of the file is an item.
+//
+// If the filename ends with ".age", the whole file is decrypted with age
+// identities in identityPath. Otherwise, the file is regarded as a SOPS file
+// and decrypted with "sops --decrypt" using identityPath as the age key file.
+//
+// The file is decrypted for each item, so that changes to the file are
+// reflected and decrypted secrets are not kept in memory.
+func NewEncryptedFileItemGetter(path, identityPath, sopsExePath string) (*encryptedFileItemGetter, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, fmt.Errorf("encrypted file not found, err=%s", err)
+	}
+	if _, err := os.Stat(identityPath); err != nil {
+		return nil, fmt.Errorf("age identity file not found, err=%s", err)
+	}
+	if !strings.HasSuffix(path, ".age") {
+		if _, err := exec.LookPath(sopsExePath); err != nil {
+			return nil, fmt.Errorf("sops exe not found, err=%s", err)
+		}
+	}
+	return &encryptedFileItemGetter{
+		path:         path,
+		identityPath: identityPath,
+		sopsExePath:  sopsExePath,
+	}, nil
+}
+
+func (g *encryptedFileItemGetter) GetItem(ctx context.Context, itemName string) (string, error) {
+	var plaintext []byte
+	var err error
+	if strings.HasSuffix(g.path, ".age") {
+		plaintext, err = g.decryptAge()
+	} else {
+		plaintext, err = g.decryptSOPS(ctx)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	// YAML is a superset of JSON, so a YAML decoder can read both.
+	var items map[string]any
+	if err := yaml.Unmarshal(plaintext, &items); err != nil {
+		return "", fmt.Errorf("failed to parse decrypted file, err=%s", err)
+	}
+	value, ok := items[itemName]
+	if !ok {
+		return "", fmt.Errorf("%w: %s", ErrItemNotFound, itemName)
+	}
+	item, err := convertEncryptedFileItem(itemName, value)
+	if err != nil {
+		return "", fmt.Errorf("failed to convert item, err=%s", err)
+	}
+	return item, nil
+}
+
+func (g *encryptedFileItemGetter) decryptAge() ([]byte, error) {
+	identityFile, err := os.Open(g.identityPath)
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to open age identity file, err=%s", ErrBackendUnavailable, err)
+	}
+	defer identityFile.Close()
+	identities, err := age.ParseIdentities(identityFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse age identity file, err=%s", err)
+	}
+
+	file, err := os.Open(g.path)
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to open encrypted file, err=%s", ErrBackendUnavailable, err)
+	}
+	defer file.Close()
+	r, err := age.Decrypt(file, identities...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt file, err=%s", err)
+	}
+	return io.ReadAll(r)
+}
+
+func (g *encryptedFileItemGetter) decryptSOPS(ctx context.Context) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, g.sopsExePath, "--decrypt", "--output-type", "json", g.path)
+	cmd.Env = append(cmd.Environ(), "SOPS_AGE_KEY_FILE="+g.identityPath)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) {
+			return nil, fmt.Errorf("%w: failed to run sops, err=%s", ErrBackendUnavailable, err)
+		}
+		return nil, fmt.Errorf("failed to decrypt file, err=%s, stderr=%s", err, strings.TrimSpace(stderr.String()))
+	}
+	return output, nil
+}
+
+// convertEncryptedFileItem converts a value in a decrypted file to the item
+// JSON format of 1Password CLI. An object value is converted like a Vault
+// secret, and a scalar value is regarded as a password.
+// The original value is kept under the "data" key.
+func convertEncryptedFileItem(itemName string, value any) (string, error) {
+	var fields []itemField
+	switch v := value.(type) {
+	case map[string]any:
+		fields = mapToItemFields(v)
+	case []any:
+		return "", errors.New("item must be an object or a scalar value")
+	default:
+		fields = []itemField{
+			{
+				ID:      "password",
+				Type:    "CONCEALED",
+				Purpose: "PASSWORD",
+				Label:   "password",
+				Value:   v,
+			},
+		}
+	}
+
+	output, err := json.Marshal(map[string]any{
+		"title":  itemName,
+		"fields": fields,
+		"data":   value,
+	})
+	if err != nil {
+		return "", err
+	}
+	return string(output), nil
+}
@@ -0,0 +1,85 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"filippo.io/age"
+)
+
+const exampleSecretsYAML = `db:
+  username: username1
+  password: my_password1
+api_token: my_token1
+`
+
+func TestEncryptedFileItemGetterAge(t *testing.T) {
+	dir := t.TempDir()
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	identityPath := filepath.Join(dir, "keys.txt")
+	if err := os.WriteFile(identityPath, []byte(identity.String()+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	var encrypted bytes.Buffer
+	w, err := age.Encrypt(&encrypted, identity.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte(exampleSecretsYAML)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "secrets.yaml.age")
+	if err := os.WriteFile(path, encrypted.Bytes(), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	getter, err := NewEncryptedFileItemGetter(path, identityPath, "sops")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		itemName string
+		query    string
+		want     string
+	}{
+		{
+			itemName: "db",
+			query:    `{"username": .fields[] | select(.id == "username").value, "password": .fields[] | select(.id == "password").value}`,
+			want:     canonicalizeJSON(t, `{"username":"username1","password":"my_password1"}`),
+		},
+		{
+			itemName: "api_token",
+			query:    `[.data, (.fields[] | select(.id == "password").value)]`,
+			want:     canonicalizeJSON(t, `["my_token1","my_token1"]`),
+		},
+	}
+	for _, tc := range testCases {
+		item, err := getter.GetItem(context.Background(), tc.itemName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := runQuery(context.Background(), tc.query, item, DefaultQueryLimits)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tc.want {
+			t.Errorf("result mismatch, itemName=%s, query=%s, got=%s, want=%s",
+				tc.itemName, tc.query, got, tc.want)
+		}
+	}
+
+	if _, err := getter.GetItem(context.Background(), "no_such_item"); !errors.Is(err, ErrItemNotFound) {
+		t.Errorf("error should be ErrItemNotFound, got=%v", err)
+	}
+}
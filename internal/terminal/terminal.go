@@ -0,0 +1,20 @@
+// Package terminal coordinates prompts on the terminal of serve, so that
+// keystrokes of the human are not split among concurrent prompts, for
+// example, an approval prompt and signing in to a password manager.
+package terminal
+
+import "context"
+
+// sem is held while a prompt uses the terminal.
+var sem = make(chan struct{}, 1)
+
+// Lock locks the terminal unless ctx is done first. The returned function
+// unlocks it.
+func Lock(ctx context.Context) (unlock func(), err error) {
+	select {
+	case sem <- struct{}{}:
+		return func() { <-sem }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
@@ -0,0 +1,230 @@
+// Package testkit runs serve, remote-serve and a fake ssh between them in
+// tests of this module. Tests in other modules use the public testkit
+// package, which wraps this.
+//
+// Tests using the kit must call Main at the start of TestMain, since the test
+// binary is executed as the fake ssh. Then Start runs serve with
+// rpc.LocalServerConfig, and tests get items against Kit.SocketPath.
+package testkit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hnakamur/pipesecret/internal/rpc"
+)
+
+// fakeSSHEnv is the environment variable which makes the test binary act as
+// a fake ssh command. The fake ssh ignores the destination host and runs
+// the remote command "pipesecret ..." in the same machine.
+const fakeSSHEnv = "PIPESECRET_TEST_FAKE_SSH"
+
+// fakeSSHPIDFileEnv is the environment variable for the path of the file
+// which the fake ssh writes its process ID to.
+const fakeSSHPIDFileEnv = "PIPESECRET_TEST_FAKE_SSH_PID_FILE"
+
+// Main runs the fake ssh and exits if the test binary is executed as the fake
+// ssh. Otherwise it returns.
+//
+// remoteMain is main of pipesecret which runs the command in os.Args. If it
+// is nil, the fake ssh supports only "pipesecret remote-serve --socket=PATH",
+// and runs it with rpc.RemoteServer.
+func Main(remoteMain func()) {
+	// The race detector sleeps 1 second at exit of each child process, such
+	// as the fake ssh, by default.
+	os.Setenv("GORACE", "atexit_sleep_ms=0")
+	if os.Getenv(fakeSSHEnv) == "" {
+		return
+	}
+
+	// os.Args is [ssh, host, remoteCommand].
+	if len(os.Args) != 3 {
+		os.Stderr.WriteString("usage: fake-ssh host remoteCommand\n")
+		os.Exit(2)
+	}
+	if pidFile := os.Getenv(fakeSSHPIDFileEnv); pidFile != "" {
+		if err := os.WriteFile(pidFile, []byte(strconv.Itoa(os.Getpid())), 0o600); err != nil {
+			panic(err)
+		}
+	}
+	args := strings.Fields(os.Args[2])
+	os.Args = append([]string{"pipesecret"}, args[1:]...)
+	if remoteMain != nil {
+		remoteMain()
+		os.Exit(0)
+	}
+	if err := runRemoteServe(os.Args[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// runRemoteServe runs remote-serve with args like "remote-serve --socket=PATH".
+func runRemoteServe(args []string) error {
+	if len(args) == 0 || args[0] != "remote-serve" {
+		return fmt.Errorf("fake ssh supports only remote-serve: %q", args)
+	}
+	var socketPath string
+	for _, arg := range args[1:] {
+		if v, ok := strings.CutPrefix(arg, "--socket="); ok {
+			socketPath = v
+		}
+	}
+	if socketPath == "" {
+		return errors.New("--socket=PATH must be specified for remote-serve")
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	s := rpc.NewRemoteServer(rpc.RemoteServerConfig{
+		SocketPath:        socketPath,
+		HeartbeatInterval: 5 * time.Second,
+		Version:           "(devel)",
+	})
+	return s.Run(ctx, os.Stdout, os.Stdin)
+}
+
+// Kit runs serve in the test process. serve starts remote-serve via the fake
+// ssh, so that tests can get items from the unix sockets of remote-serve.
+type Kit struct {
+	// SocketPath is the socket path of remote-serve of the first host.
+	SocketPath string
+	// SocketPaths maps host names to socket paths of remote-serve.
+	SocketPaths map[string]string
+
+	pidFile string
+	cancel  context.CancelFunc
+	errC    chan error
+}
+
+// Start starts serve and waits until remote-serve listens. cfg.Getter must be
+// set. If cfg.Hosts is empty, a host named "fakehost" is used. SSHPath and
+// RemoteCommand of hosts are set by Start to run remote-serve with the fake
+// ssh. serve is stopped when the test finishes.
+func Start(t testing.TB, cfg rpc.LocalServerConfig) *Kit {
+	t.Helper()
+
+	dir := t.TempDir()
+	k := &Kit{
+		SocketPaths: make(map[string]string),
+		pidFile:     filepath.Join(dir, "fake-ssh.pid"),
+		errC:        make(chan error, 1),
+	}
+	t.Setenv(fakeSSHEnv, "1")
+	t.Setenv(fakeSSHPIDFileEnv, k.pidFile)
+	if len(cfg.Hosts) == 0 {
+		cfg.Hosts = []rpc.HostConfig{{Host: "fakehost"}}
+	}
+	for i := range cfg.Hosts {
+		host := &cfg.Hosts[i]
+		socketPath := filepath.Join(dir, host.Host+".sock")
+		k.SocketPaths[host.Host] = socketPath
+		if i == 0 {
+			k.SocketPath = socketPath
+		}
+		host.SSHPath = os.Args[0]
+		host.RemoteCommand = "pipesecret remote-serve --socket=" + socketPath
+	}
+	if cfg.Workers == 0 {
+		cfg.Workers = 4
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	k.cancel = cancel
+	go func() {
+		k.errC <- rpc.RunLocalServer(ctx, cfg)
+	}()
+	t.Cleanup(k.stop)
+
+	k.WaitListening(t, 0)
+	return k
+}
+
+// WaitListening waits until remote-serve listens on the socket of every host.
+// With a single host, it also waits until the process ID of the fake ssh is
+// not oldPID, for example, after KillRemote.
+func (k *Kit) WaitListening(t testing.TB, oldPID int) {
+	t.Helper()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if k.RemotePID(t) != oldPID && k.allListening() {
+			return
+		}
+		select {
+		case err := <-k.errC:
+			t.Fatalf("serve exited before remote-serve started listening, err=%v", err)
+		case <-time.After(10 * time.Millisecond):
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting remote-serve to start listening")
+		}
+	}
+}
+
+func (k *Kit) allListening() bool {
+	for _, socketPath := range k.SocketPaths {
+		// The socket file of a killed remote-serve is left, so
+		// check that the new one accepts a connection.
+		conn, err := net.Dial("unix", socketPath)
+		if err != nil {
+			return false
+		}
+		conn.Close()
+	}
+	return true
+}
+
+// RemotePID returns the process ID of the fake ssh running remote-serve,
+// or 0 if it has not started yet.
+func (k *Kit) RemotePID(t testing.TB) int {
+	t.Helper()
+
+	data, err := os.ReadFile(k.pidFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	pid, err := strconv.Atoi(string(data))
+	if err != nil {
+		// The file is being written.
+		return 0
+	}
+	return pid
+}
+
+// KillRemote kills the fake ssh to simulate a broken ssh connection, and
+// returns its process ID.
+func (k *Kit) KillRemote(t testing.TB) int {
+	t.Helper()
+
+	pid := k.RemotePID(t)
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Kill(); err != nil {
+		t.Fatal(err)
+	}
+	return pid
+}
+
+func (k *Kit) stop() {
+	k.cancel()
+	select {
+	case <-k.errC:
+	case <-time.After(10 * time.Second):
+	}
+}
@@ -38,8 +38,24 @@ func (c *Client) CallSync(ctx context.Context, method string, params any) (strin
 	logger.DebugContext(ctx, "client: created a call", "id", call.ID())
 	var result string
 	if err := call.Await(ctx, &result); err != nil {
-		return "", jsonrpc2.ID{}, fmt.Errorf("failed to wait result from unix socket: %s", err)
+		if ctx.Err() != nil {
+			c.cancelCall(call.ID())
+		}
+		return "", jsonrpc2.ID{}, fmt.Errorf("failed to wait result from unix socket: %w", err)
 	}
-	logger.DebugContext(ctx, "client: received response for a call", "id", call.ID(), "result", result)
+	logger.DebugContext(ctx, "client: received response for a call", "id", call.ID(), "len(result)", len(result))
 	return result, call.ID(), nil
 }
+
+// cancelCall notifies the server that the result of the call is not needed
+// anymore, so that the server can stop processing it.
+func (c *Client) cancelCall(id jsonrpc2.ID) {
+	logger := slog.Default().With("program", "unixSocketClient")
+
+	// Use a new context since the context of the call is already done.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := c.conn.Notify(ctx, cancelRequestMethod, cancelRequestParams{ID: id.Raw()}); err != nil {
+		logger.DebugContext(ctx, "client: failed to send cancel request", "id", id, "err", err)
+	}
+}
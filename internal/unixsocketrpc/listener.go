@@ -0,0 +1,106 @@
+package unixsocketrpc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/exp/jsonrpc2"
+)
+
+// connListener is a jsonrpc2.Listener for a unix socket which notices when
+// each accepted connection is closed by the peer.
+//
+// jsonrpc2.Server calls Accept and then Binder.Bind for the accepted
+// connection sequentially in the same goroutine, so bind can receive
+// the connection accepted just before through acceptedC.
+type connListener struct {
+	listener   *net.UnixListener
+	socketPath string
+	socketInfo fs.FileInfo
+	acceptedC  chan *acceptedConn
+}
+
+type acceptedConn struct {
+	*net.UnixConn
+
+	// ctx is cancelled when reading from the connection fails,
+	// which happens when the peer closes the connection.
+	ctx    context.Context
+	cancel context.CancelFunc
+	once   sync.Once
+}
+
+func listenUnix(ctx context.Context, socketPath string) (*connListener, error) {
+	var lc net.ListenConfig
+	l, err := lc.Listen(ctx, "unix", socketPath)
+	if err != nil {
+		return nil, err
+	}
+	listener := l.(*net.UnixListener)
+	// We remove the socket file by ourselves in Close.
+	listener.SetUnlinkOnClose(false)
+	socketInfo, err := os.Lstat(socketPath)
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return &connListener{
+		listener:   listener,
+		socketPath: socketPath,
+		socketInfo: socketInfo,
+		acceptedC:  make(chan *acceptedConn, 1),
+	}, nil
+}
+
+func (l *connListener) Accept(ctx context.Context) (io.ReadWriteCloser, error) {
+	conn, err := l.listener.AcceptUnix()
+	if err != nil {
+		return nil, err
+	}
+	connCtx, cancel := context.WithCancel(context.Background())
+	accepted := &acceptedConn{
+		UnixConn: conn,
+		ctx:      connCtx,
+		cancel:   cancel,
+	}
+	l.acceptedC <- accepted
+	return accepted, nil
+}
+
+// Close closes the listener and removes the socket file. The socket file is
+// not removed if it has been replaced by another process listening on
+// the same path, for example, a new remote-serve started after reconnecting.
+func (l *connListener) Close() error {
+	err := l.listener.Close()
+	if fi, statErr := os.Lstat(l.socketPath); statErr == nil && os.SameFile(fi, l.socketInfo) {
+		if rmErr := os.Remove(l.socketPath); rmErr != nil && !errors.Is(rmErr, fs.ErrNotExist) && err == nil {
+			err = rmErr
+		}
+	}
+	return err
+}
+
+func (l *connListener) Dialer() jsonrpc2.Dialer {
+	return jsonrpc2.NetDialer("unix", l.socketPath, net.Dialer{
+		Timeout: 5 * time.Second,
+	})
+}
+
+func (c *acceptedConn) Read(p []byte) (int, error) {
+	n, err := c.UnixConn.Read(p)
+	if err != nil {
+		c.once.Do(c.cancel)
+	}
+	return n, err
+}
+
+func (c *acceptedConn) Close() error {
+	c.once.Do(c.cancel)
+	return c.UnixConn.Close()
+}
@@ -0,0 +1,92 @@
+package unixsocketrpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"golang.org/x/exp/jsonrpc2"
+)
+
+// CodePeerNotAllowed is the JSON-RPC error code of ErrPeerNotAllowed. It
+// follows the error codes of getQueryItem in the rpc package, since -32000
+// and -32001 are used by jsonrpc2.
+const CodePeerNotAllowed int64 = -32020
+
+// ErrPeerNotAllowed is the error returned to a client which is not allowed
+// to use the server.
+var ErrPeerNotAllowed = jsonrpc2.NewError(CodePeerNotAllowed, "peer is not allowed")
+
+var errPeerCredUnsupported = errors.New("peer credentials are not supported on this platform")
+
+// Peer is the credentials of the process which connected to the unix socket.
+type Peer struct {
+	UID uint32
+	GID uint32
+	PID int32
+	// Exe is the path of the executable of the process.
+	// It is empty if unknown.
+	Exe string
+}
+
+func (p *Peer) LogValue() slog.Value {
+	if p == nil {
+		return slog.StringValue("unknown")
+	}
+	return slog.GroupValue(
+		slog.Any("uid", p.UID),
+		slog.Any("gid", p.GID),
+		slog.Any("pid", p.PID),
+		slog.String("exe", p.Exe),
+	)
+}
+
+// PeerAllowlist decides which peers can use the server.
+//
+// A peer is allowed if its uid is the uid of the server process or in UIDs,
+// or its gid is in GIDs. In addition, if Exes is not empty, the executable
+// of the peer must be one of Exes.
+type PeerAllowlist struct {
+	UIDs []uint32
+	GIDs []uint32
+	Exes []string
+}
+
+// check returns nil if peer is allowed.
+func (a PeerAllowlist) check(peer *Peer) error {
+	if peer.UID != uint32(os.Getuid()) && !slices.Contains(a.UIDs, peer.UID) && !slices.Contains(a.GIDs, peer.GID) {
+		return fmt.Errorf("uid %d and gid %d are not allowed", peer.UID, peer.GID)
+	}
+	if len(a.Exes) > 0 && !slices.Contains(a.Exes, peer.Exe) {
+		return fmt.Errorf("executable %q is not allowed", peer.Exe)
+	}
+	return nil
+}
+
+// resolveExes makes paths in Exes comparable with executable paths of peers,
+// which have symbolic links resolved.
+func (a PeerAllowlist) resolveExes() (PeerAllowlist, error) {
+	exes := make([]string, 0, len(a.Exes))
+	for _, exe := range a.Exes {
+		resolved, err := filepath.EvalSymlinks(exe)
+		if err != nil {
+			return a, fmt.Errorf("failed to resolve allowed executable path, err=%s", err)
+		}
+		exes = append(exes, resolved)
+	}
+	a.Exes = exes
+	return a, nil
+}
+
+type peerKey struct{}
+
+// PeerFromContext returns the peer of the connection of the request passed
+// to a handler of Server, or nil if the peer is unknown.
+func PeerFromContext(ctx context.Context) *Peer {
+	peer, _ := ctx.Value(peerKey{}).(*Peer)
+	return peer
+}
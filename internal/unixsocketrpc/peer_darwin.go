@@ -0,0 +1,39 @@
+//go:build darwin
+
+package unixsocketrpc
+
+import (
+	"fmt"
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// peerCred returns the credentials of the peer process of conn with
+// LOCAL_PEERCRED and LOCAL_PEERPID. The executable path is not available.
+func peerCred(conn *net.UnixConn) (*Peer, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var xucred *unix.Xucred
+	var pid int
+	var credErr error
+	if err := raw.Control(func(fd uintptr) {
+		xucred, credErr = unix.GetsockoptXucred(int(fd), unix.SOL_LOCAL, unix.LOCAL_PEERCRED)
+		if credErr != nil {
+			return
+		}
+		pid, credErr = unix.GetsockoptInt(int(fd), unix.SOL_LOCAL, unix.LOCAL_PEERPID)
+	}); err != nil {
+		return nil, err
+	}
+	if credErr != nil {
+		return nil, fmt.Errorf("failed to get LOCAL_PEERCRED, err=%s", credErr)
+	}
+	peer := &Peer{UID: xucred.Uid, PID: int32(pid)}
+	if xucred.Ngroups > 0 {
+		peer.GID = xucred.Groups[0]
+	}
+	return peer, nil
+}
@@ -0,0 +1,37 @@
+//go:build linux
+
+package unixsocketrpc
+
+import (
+	"fmt"
+	"net"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// peerCred returns the credentials of the peer process of conn with
+// SO_PEERCRED, and its executable path from /proc.
+func peerCred(conn *net.UnixConn) (*Peer, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var ucred *unix.Ucred
+	var credErr error
+	if err := raw.Control(func(fd uintptr) {
+		ucred, credErr = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	}); err != nil {
+		return nil, err
+	}
+	if credErr != nil {
+		return nil, fmt.Errorf("failed to get SO_PEERCRED, err=%s", credErr)
+	}
+	peer := &Peer{UID: ucred.Uid, GID: ucred.Gid, PID: ucred.Pid}
+	// The executable cannot be read if the peer process has exited or is
+	// owned by another user. It is left empty then.
+	if exe, err := os.Readlink(fmt.Sprintf("/proc/%d/exe", ucred.Pid)); err == nil {
+		peer.Exe = exe
+	}
+	return peer, nil
+}
@@ -0,0 +1,9 @@
+//go:build !linux && !darwin
+
+package unixsocketrpc
+
+import "net"
+
+func peerCred(conn *net.UnixConn) (*Peer, error) {
+	return nil, errPeerCredUnsupported
+}
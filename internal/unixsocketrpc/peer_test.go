@@ -0,0 +1,103 @@
+package unixsocketrpc
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/exp/jsonrpc2"
+)
+
+func TestPeerAllowlistCheck(t *testing.T) {
+	uid := uint32(os.Getuid())
+	otherUID := uid + 1000
+	testCases := []struct {
+		name      string
+		allowlist PeerAllowlist
+		peer      Peer
+		allowed   bool
+	}{
+		{name: "owner", peer: Peer{UID: uid}, allowed: true},
+		{name: "otherUser", peer: Peer{UID: otherUID}, allowed: false},
+		{name: "allowedUID", allowlist: PeerAllowlist{UIDs: []uint32{otherUID}}, peer: Peer{UID: otherUID}, allowed: true},
+		{name: "allowedGID", allowlist: PeerAllowlist{GIDs: []uint32{100}}, peer: Peer{UID: otherUID, GID: 100}, allowed: true},
+		{name: "allowedExe", allowlist: PeerAllowlist{Exes: []string{"/usr/bin/pipesecret"}}, peer: Peer{UID: uid, Exe: "/usr/bin/pipesecret"}, allowed: true},
+		{name: "notAllowedExe", allowlist: PeerAllowlist{Exes: []string{"/usr/bin/pipesecret"}}, peer: Peer{UID: uid, Exe: "/usr/bin/python3"}, allowed: false},
+		{name: "allowedExeOtherUser", allowlist: PeerAllowlist{Exes: []string{"/usr/bin/pipesecret"}}, peer: Peer{UID: otherUID, Exe: "/usr/bin/pipesecret"}, allowed: false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.allowlist.check(&tc.peer)
+			if got := err == nil; got != tc.allowed {
+				t.Errorf("allowed mismatch, got=%v, want=%v, err=%v", got, tc.allowed, err)
+			}
+		})
+	}
+}
+
+func TestServerPeer(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("executable path of peer is available only on linux")
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name      string
+		allowlist PeerAllowlist
+		wantErr   string
+	}{
+		{name: "default"},
+		{name: "allowedExe", allowlist: PeerAllowlist{Exes: []string{exe}}},
+		{name: "notAllowedExe", allowlist: PeerAllowlist{Exes: []string{"/bin/sh"}}, wantErr: "peer is not allowed"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			socketPath := filepath.Join(t.TempDir(), "test.sock")
+			s, err := Listen(ctx, socketPath, tc.allowlist)
+			if err != nil {
+				t.Fatal(err)
+			}
+			handler := func(ctx context.Context, req *jsonrpc2.Request) (any, error) {
+				// CallSync receives a string result.
+				data, err := json.Marshal(PeerFromContext(ctx))
+				return string(data), err
+			}
+			go s.Run(ctx, jsonrpc2.HandlerFunc(handler), "shutdown", 0)
+
+			client, err := Connect(ctx, socketPath, time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+			result, _, err := client.CallSync(ctx, "getPeer", nil)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Errorf("error mismatch, got=%v, want=%s", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var peer Peer
+			if err := json.Unmarshal([]byte(result), &peer); err != nil {
+				t.Fatal(err)
+			}
+			want := Peer{UID: uint32(os.Getuid()), GID: uint32(os.Getgid()), PID: int32(os.Getpid()), Exe: exe}
+			if peer != want {
+				t.Errorf("peer mismatch, got=%+v, want=%+v", peer, want)
+			}
+		})
+	}
+}
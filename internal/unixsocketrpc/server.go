@@ -2,29 +2,48 @@ package unixsocketrpc
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io/fs"
 	"log"
+	"log/slog"
+	"net"
 	"os"
 	"time"
 
 	"github.com/hnakamur/pipesecret/internal/myerrors"
 	"golang.org/x/exp/jsonrpc2"
+	"golang.org/x/xerrors"
 )
 
+// cancelRequestMethod is the method of a notification which a client sends
+// to cancel a request in flight.
+const cancelRequestMethod = "$/cancelRequest"
+
+type cancelRequestParams struct {
+	ID any `json:"id"`
+}
+
 type Server struct {
 	socketPath          string
-	listener            jsonrpc2.Listener
+	listener            *connListener
+	allowlist           PeerAllowlist
 	handler             jsonrpc2.Handler
 	shutdownGracePeriod time.Duration
 }
 
-func Listen(ctx context.Context, socketPath string) (*Server, error) {
+// Listen listens on socketPath. Only peers allowed by allowlist can use
+// the server, and other peers get ErrPeerNotAllowed for every request.
+func Listen(ctx context.Context, socketPath string, allowlist PeerAllowlist) (*Server, error) {
+	allowlist, err := allowlist.resolveExes()
+	if err != nil {
+		return nil, err
+	}
 	if err := os.Remove(socketPath); err != nil && !errors.Is(err, fs.ErrNotExist) {
 		return nil, fmt.Errorf("failed to remove socket: %s", err)
 	}
-	listener, err := jsonrpc2.NetListener(ctx, "unix", socketPath, jsonrpc2.NetListenOptions{})
+	listener, err := listenUnix(ctx, socketPath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to listen unix socket: %s", err)
 	}
@@ -32,25 +51,80 @@ func Listen(ctx context.Context, socketPath string) (*Server, error) {
 	return &Server{
 		socketPath: socketPath,
 		listener:   listener,
+		allowlist:  allowlist,
 	}, nil
 }
 
+// authorize returns the peer of conn and nil if the peer is allowed.
+func (s *Server) authorize(conn *net.UnixConn) (*Peer, error) {
+	peer, err := peerCred(conn)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.allowlist.check(peer); err != nil {
+		return peer, err
+	}
+	return peer, nil
+}
+
+type binderFunc func(ctx context.Context, conn *jsonrpc2.Connection) (jsonrpc2.ConnectionOptions, error)
+
+func (f binderFunc) Bind(ctx context.Context, conn *jsonrpc2.Connection) (jsonrpc2.ConnectionOptions, error) {
+	return f(ctx, conn)
+}
+
+// Run serves requests with handler. The context passed to handler is
+// cancelled when the client sends a cancel request notification for
+// the request or the client closes the connection.
 func (s *Server) Run(ctx context.Context, handler jsonrpc2.Handler, shutdownMethod string, shutdownGracePeriod time.Duration) error {
 	shutdownCh := make(chan struct{}, 1)
-	wrappedHandler := func(ctx context.Context, req *jsonrpc2.Request) (any, error) {
-		switch req.Method {
-		case shutdownMethod:
-			close(shutdownCh)
-			return "", nil
-		default:
-			return handler.Handle(ctx, req)
+	binder := func(ctx context.Context, conn *jsonrpc2.Connection) (jsonrpc2.ConnectionOptions, error) {
+		accepted := <-s.listener.acceptedC
+		peer, authErr := s.authorize(accepted.UnixConn)
+		if authErr != nil {
+			slog.WarnContext(ctx, "rejected unix socket client", "peer", peer, "err", authErr)
+		}
+		wrappedHandler := func(ctx context.Context, req *jsonrpc2.Request) (any, error) {
+			if authErr != nil {
+				return nil, xerrors.Errorf("%w: %s", ErrPeerNotAllowed, authErr)
+			}
+			ctx = context.WithValue(ctx, peerKey{}, peer)
+			switch req.Method {
+			case shutdownMethod:
+				close(shutdownCh)
+				return "", nil
+			default:
+				ctx, cancel := context.WithCancel(ctx)
+				defer cancel()
+				stop := context.AfterFunc(accepted.ctx, cancel)
+				defer stop()
+				return handler.Handle(ctx, req)
+			}
+		}
+		// preempter handles cancel request notifications before they are
+		// queued behind the request being handled.
+		preempter := func(ctx context.Context, req *jsonrpc2.Request) (any, error) {
+			if req.Method != cancelRequestMethod {
+				return nil, jsonrpc2.ErrNotHandled
+			}
+			var params cancelRequestParams
+			if err := json.Unmarshal(req.Params, &params); err != nil {
+				return nil, fmt.Errorf("%w: %s", jsonrpc2.ErrParse, err)
+			}
+			if id, ok := params.ID.(float64); ok {
+				conn.Cancel(jsonrpc2.Int64ID(int64(id)))
+			} else if id, ok := params.ID.(string); ok {
+				conn.Cancel(jsonrpc2.StringID(id))
+			}
+			return nil, nil
 		}
+		return jsonrpc2.ConnectionOptions{
+			Handler:   jsonrpc2.HandlerFunc(wrappedHandler),
+			Preempter: preempterFunc(preempter),
+		}, nil
 	}
 
-	connOpts := jsonrpc2.ConnectionOptions{
-		Handler: jsonrpc2.HandlerFunc(wrappedHandler),
-	}
-	server, err := jsonrpc2.Serve(ctx, s.listener, connOpts)
+	server, err := jsonrpc2.Serve(ctx, s.listener, binderFunc(binder))
 	if err != nil {
 		log.Printf("serve error=%v", err)
 		return err
@@ -58,8 +132,11 @@ func (s *Server) Run(ctx context.Context, handler jsonrpc2.Handler, shutdownMeth
 
 	var closeErr error
 	go func() {
-		<-shutdownCh
-		<-time.After(s.shutdownGracePeriod)
+		select {
+		case <-shutdownCh:
+			<-time.After(s.shutdownGracePeriod)
+		case <-ctx.Done():
+		}
 		if err := s.listener.Close(); err != nil && !errors.Is(err, fs.ErrNotExist) {
 			closeErr = err
 		}
@@ -69,3 +146,9 @@ func (s *Server) Run(ctx context.Context, handler jsonrpc2.Handler, shutdownMeth
 	}
 	return nil
 }
+
+type preempterFunc func(ctx context.Context, req *jsonrpc2.Request) (any, error)
+
+func (f preempterFunc) Preempt(ctx context.Context, req *jsonrpc2.Request) (any, error) {
+	return f(ctx, req)
+}
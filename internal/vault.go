@@ -0,0 +1,167 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+type vaultItemGetter struct {
+	addr       string
+	token      string
+	namespace  string
+	mount      string
+	kvVersion  int
+	httpClient *http.Client
+}
+
+// NewVaultItemGetter returns an ItemGetter which reads secrets from
+// a KV secrets engine of HashiCorp Vault mounted at mount.
+// kvVersion must be 1 or 2.
+func NewVaultItemGetter(addr, token, namespace, mount string, kvVersion int, httpClient *http.Client) (*vaultItemGetter, error) {
+	if addr == "" {
+		return nil, errors.New("vault address must not be empty")
+	}
+	if _, err := url.Parse(addr); err != nil {
+		return nil, fmt.Errorf("invalid vault address, err=%s", err)
+	}
+	if token == "" {
+		return nil, errors.New("vault token must not be empty")
+	}
+	if kvVersion != 1 && kvVersion != 2 {
+		return nil, fmt.Errorf("unsupported KV secrets engine version: %d", kvVersion)
+	}
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return &vaultItemGetter{
+		addr:       strings.TrimRight(addr, "/"),
+		token:      token,
+		namespace:  namespace,
+		mount:      strings.Trim(mount, "/"),
+		kvVersion:  kvVersion,
+		httpClient: httpClient,
+	}, nil
+}
+
+func (g *vaultItemGetter) GetItem(ctx context.Context, itemName string) (string, error) {
+	secretPath, err := escapeVaultPath(itemName)
+	if err != nil {
+		return "", err
+	}
+	var reqURL string
+	if g.kvVersion == 2 {
+		reqURL = g.addr + "/v1/" + g.mount + "/data/" + secretPath
+	} else {
+		reqURL = g.addr + "/v1/" + g.mount + "/" + secretPath
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, reqURL, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to create request, err=%s", err)
+	}
+	req.Header.Set("X-Vault-Token", g.token)
+	if g.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", g.namespace)
+	}
+	resp, err := g.httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("%w: failed to send request to vault, err=%s", ErrBackendUnavailable, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("failed to read response from vault, err=%s", err)
+	}
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return "", fmt.Errorf("%w: %s", ErrItemNotFound, itemName)
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		// Vault returns 403 also for an invalid or expired token.
+		return "", fmt.Errorf("%w: status=%d, errors=%s", ErrBackendNotSignedIn, resp.StatusCode, vaultErrors(body))
+	case resp.StatusCode >= http.StatusInternalServerError:
+		// Vault returns 503 when it is sealed or in standby.
+		return "", fmt.Errorf("%w: status=%d, errors=%s", ErrBackendUnavailable, resp.StatusCode, vaultErrors(body))
+	case resp.StatusCode != http.StatusOK:
+		return "", fmt.Errorf("failed to get item, status=%d, errors=%s", resp.StatusCode, vaultErrors(body))
+	}
+
+	item, err := g.convertSecret(itemName, body)
+	if err != nil {
+		return "", fmt.Errorf("failed to convert item, err=%s", err)
+	}
+	return item, nil
+}
+
+// convertSecret converts a response body from a KV secrets engine to
+// the item JSON format of 1Password CLI. The secret data is also kept under
+// the "data" key and the metadata of KV version 2 under the "metadata" key.
+func (g *vaultItemGetter) convertSecret(itemName string, body []byte) (string, error) {
+	var data, metadata map[string]any
+	if g.kvVersion == 2 {
+		var secret struct {
+			Data struct {
+				Data     map[string]any `json:"data"`
+				Metadata map[string]any `json:"metadata"`
+			} `json:"data"`
+		}
+		if err := json.Unmarshal(body, &secret); err != nil {
+			return "", err
+		}
+		data = secret.Data.Data
+		metadata = secret.Data.Metadata
+	} else {
+		var secret struct {
+			Data map[string]any `json:"data"`
+		}
+		if err := json.Unmarshal(body, &secret); err != nil {
+			return "", err
+		}
+		data = secret.Data
+	}
+	if data == nil {
+		// KV version 2 returns null data for a deleted version.
+		return "", fmt.Errorf("item has no data: %s", itemName)
+	}
+
+	output, err := json.Marshal(map[string]any{
+		"title":    itemName,
+		"fields":   mapToItemFields(data),
+		"data":     data,
+		"metadata": metadata,
+	})
+	if err != nil {
+		return "", err
+	}
+	return string(output), nil
+}
+
+// escapeVaultPath escapes each segment of a secret path. It rejects empty,
+// "." and ".." segments since itemName comes from the remote server and
+// must not be used to access other Vault API endpoints.
+func escapeVaultPath(itemName string) (string, error) {
+	segments := strings.Split(itemName, "/")
+	for i, seg := range segments {
+		if seg == "" || seg == "." || seg == ".." {
+			return "", fmt.Errorf("invalid item name: %s", itemName)
+		}
+		segments[i] = url.PathEscape(seg)
+	}
+	return strings.Join(segments, "/"), nil
+}
+
+func vaultErrors(body []byte) string {
+	var resp struct {
+		Errors []string `json:"errors"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil || len(resp.Errors) == 0 {
+		return string(body)
+	}
+	return strings.Join(resp.Errors, "; ")
+}
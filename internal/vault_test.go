@@ -0,0 +1,95 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestVaultItemGetter(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "token1" {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"errors":["permission denied"]}`))
+			return
+		}
+		if r.Header.Get("X-Vault-Namespace") != "ns1" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/secret/data/app/db":
+			w.Write([]byte(`{"data":{"data":{"username":"username1","password":"my_password1"},"metadata":{"version":3}}}`))
+		case "/v1/kv/app/db":
+			w.Write([]byte(`{"data":{"username":"username2","password":"my_password2"}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"errors":[]}`))
+		}
+	}))
+	defer ts.Close()
+
+	const defaultQuery = `{"username": .fields[] | select(.id == "username").value, "password": .fields[] | select(.id == "password").value}`
+	testCases := []struct {
+		mount     string
+		kvVersion int
+		query     string
+		want      string
+	}{
+		{
+			mount:     "secret",
+			kvVersion: 2,
+			query:     defaultQuery,
+			want:      canonicalizeJSON(t, `{"username":"username1","password":"my_password1"}`),
+		},
+		{
+			mount:     "secret",
+			kvVersion: 2,
+			query:     `[.data.password, .metadata.version]`,
+			want:      canonicalizeJSON(t, `["my_password1",3]`),
+		},
+		{
+			mount:     "kv",
+			kvVersion: 1,
+			query:     defaultQuery,
+			want:      canonicalizeJSON(t, `{"username":"username2","password":"my_password2"}`),
+		},
+	}
+	for _, tc := range testCases {
+		getter, err := NewVaultItemGetter(ts.URL, "token1", "ns1", tc.mount, tc.kvVersion, ts.Client())
+		if err != nil {
+			t.Fatal(err)
+		}
+		item, err := getter.GetItem(context.Background(), "app/db")
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := runQuery(context.Background(), tc.query, item, DefaultQueryLimits)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tc.want {
+			t.Errorf("result mismatch, query=%s, got=%s, want=%s", tc.query, got, tc.want)
+		}
+	}
+
+	getter, err := NewVaultItemGetter(ts.URL, "token1", "ns1", "secret", 2, ts.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, itemName := range []string{"app/no_such_item", "../../sys/seal-status", "app//db"} {
+		if _, err := getter.GetItem(context.Background(), itemName); err == nil {
+			t.Errorf("should fail for itemName=%s", itemName)
+		}
+	}
+
+	getter, err = NewVaultItemGetter(ts.URL, "expired_token", "ns1", "secret", 2, ts.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := getter.GetItem(context.Background(), "app/db"); !errors.Is(err, ErrBackendNotSignedIn) {
+		t.Errorf("error should be ErrBackendNotSignedIn, got=%v", err)
+	}
+}
@@ -0,0 +1,84 @@
+// Package testkit runs serve and remote-serve of pipesecret in tests, with
+// a fake ssh between them and fixture items instead of a password manager,
+// so that wrappers of pipesecret can be tested against the real
+// serve → remote-serve → run flow.
+//
+// Tests using the kit must call Main at the start of TestMain, since the test
+// binary is executed as the fake ssh:
+//
+//	func TestMain(m *testing.M) {
+//		testkit.Main()
+//		os.Exit(m.Run())
+//	}
+//
+//	func TestWrapper(t *testing.T) {
+//		k := testkit.Start(t, testkit.Config{
+//			Items: map[string]json.RawMessage{
+//				"app/db": json.RawMessage(`{"title":"app/db","fields":[{"id":"password","value":"pass1"}]}`),
+//			},
+//		})
+//		t.Setenv("PIPESECRET_SOCKET", k.SocketPath)
+//		// Run the wrapper, which runs "pipesecret run --item=app/db ...".
+//	}
+package testkit
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/hnakamur/pipesecret/internal"
+	"github.com/hnakamur/pipesecret/internal/rpc"
+	itestkit "github.com/hnakamur/pipesecret/internal/testkit"
+)
+
+// Main runs the fake ssh and exits if the test binary is executed as the fake
+// ssh. Otherwise it returns.
+func Main() {
+	itestkit.Main(nil)
+}
+
+// Config is the configuration of serve started by Start.
+type Config struct {
+	// Items maps item names to items in the JSON format of the 1Password
+	// CLI, that is, objects with a "fields" array of objects with "id" and
+	// "value".
+	Items map[string]json.RawMessage
+	// Hosts is names of remote hosts which serve connects to. If empty,
+	// a host named "fakehost" is used.
+	Hosts []string
+}
+
+// Kit is serve running in the test process, which is connected to
+// remote-serve of each host.
+type Kit struct {
+	// SocketPath is the socket path of remote-serve of the first host, which
+	// is passed to "pipesecret run" with --socket or PIPESECRET_SOCKET.
+	SocketPath string
+	// SocketPaths maps host names to socket paths of remote-serve.
+	SocketPaths map[string]string
+
+	kit *itestkit.Kit
+}
+
+// Start starts serve and waits until remote-serve listens. serve is stopped
+// when the test finishes.
+func Start(t testing.TB, cfg Config) *Kit {
+	t.Helper()
+
+	var hosts []rpc.HostConfig
+	for _, host := range cfg.Hosts {
+		hosts = append(hosts, rpc.HostConfig{Host: host})
+	}
+	k := itestkit.Start(t, rpc.LocalServerConfig{
+		Hosts:  hosts,
+		Getter: internal.NewFixtureItemGetterFromMap(cfg.Items),
+	})
+	return &Kit{SocketPath: k.SocketPath, SocketPaths: k.SocketPaths, kit: k}
+}
+
+// KillRemote kills the fake ssh to simulate a broken ssh connection, and
+// returns its process ID. It is for tests with a single host.
+func (k *Kit) KillRemote(t testing.TB) int {
+	t.Helper()
+	return k.kit.KillRemote(t)
+}
@@ -0,0 +1,39 @@
+package testkit
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/hnakamur/pipesecret/internal/rpc"
+)
+
+func TestMain(m *testing.M) {
+	Main()
+	os.Exit(m.Run())
+}
+
+func TestKit(t *testing.T) {
+	k := Start(t, Config{
+		Items: map[string]json.RawMessage{
+			"test1": json.RawMessage(`{"title":"test1","fields":[{"id":"password","value":"my_password1"}]}`),
+		},
+		Hosts: []string{"dev1", "dev2"},
+	})
+
+	for _, host := range []string{"dev1", "dev2"} {
+		got, err := rpc.GetQueryItem(context.Background(), k.SocketPaths[host], 5*time.Second, "test1", `{password: .fields[0].value}`)
+		if err != nil {
+			t.Fatalf("host=%s, err=%v", host, err)
+		}
+		if want := map[string]any{"password": "my_password1"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("result mismatch, host=%s, got=%v, want=%v", host, got, want)
+		}
+	}
+	if k.SocketPath != k.SocketPaths["dev1"] {
+		t.Errorf("socket path mismatch, got=%s, want=%s", k.SocketPath, k.SocketPaths["dev1"])
+	}
+}